@@ -3,11 +3,15 @@ package audio
 import (
 	"fmt"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gordonklaus/portaudio"
 	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/midi"
 	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/ianmcmahon/fmsynth/tuning"
 	"github.com/rakyll/portmidi"
 )
 
@@ -23,6 +27,7 @@ const (
 	ProgramChange   = 0xC
 	ChannelPressure = 0xD
 	PitchBend       = 0xE
+	SystemMessage   = 0xF
 )
 
 // anything can be an output if it makes noise
@@ -36,48 +41,136 @@ type Engine struct {
 	samplingRate int // in samples/sec default 48kHz
 
 	input      Output
+	master     *limiter
 	midiEvents <-chan portmidi.Event
 
 	voices   []*Voice
-	voiceMap map[byte]*Voice
+	voiceMap map[voiceKey]*Voice
 
-	// one global patch right now; this will need to be somewhere else once we're multitimbral
-	patch *patch.Patch
+	// one track right now; there'll be more once we're multitimbral
+	tracks []*track
 
-	audioChan chan fp.Fp32
+	// midi events waiting for their sample, only touched by the render loop
+	clock   int64 // samples rendered so far, written atomically so others can tell the time
+	eventAt int64 // the sample the event being handled landed on
+	queue   eventQueue
+	sched   scheduler
+
+	recording atomic.Value // *recording, nil when we're not
+	meters    meters
+
+	// MPE zones, the lower's member count in the low byte and the upper's above it, atomic
+	// so they can be set from outside.  The rest is the render loop's, see mpe.go
+	mpe        uint32
+	expression [16]expression
+	bendRange  [16]float64 // semitones, for channels that aren't MPE members
+
+	// running (N)RPN and 14 bit cc state for each midi channel
+	controls [16]midi.ControlDecoder
+	feedback atomic.Value // *midi.Feedback echoing param changes, once there's a midi out
+
+	audioChan  chan fp.Fp32
+	openStream func(e *Engine) (audioStream, error) // the sound card, replaced in tests
+
+	// closed by Stop, and by runAudio once it's let go of the sound card
+	stop     chan struct{}
+	stopped  chan struct{}
+	running  int32 // atomic, set once Run has started the audio
+	stopOnce sync.Once
+}
+
+// the part of a portaudio stream runAudio uses
+type audioStream interface {
+	Start() error
+	Stop() error
+	Close() error
+}
+
+// the same note can be held on several channels at once
+type voiceKey struct {
+	channel, note byte
 }
 
 func NewEngine(midiStream <-chan portmidi.Event) *Engine {
+	engine := newEngine(midiStream)
+	go engine.Run()
+	return engine
+}
+
+func newEngine(midiStream <-chan portmidi.Event) *Engine {
 	engine := &Engine{
 		samplingRate: SAMPLING_RATE,
 		midiEvents:   midiStream,
 		voices:       make([]*Voice, NUM_VOICES),
-		voiceMap:     make(map[byte]*Voice, 0),
-		patch:        patch.InitialPatch(),
+		voiceMap:     make(map[voiceKey]*Voice, 0),
+		tracks:       []*track{newTrack(patch.InitialPatch())},
+		queue:        make(eventQueue, 0, 1024),
+		sched:        scheduler{rate: SAMPLING_RATE, latency: BUFFER_LEN},
 		audioChan:    make(chan fp.Fp32, BUFFER_LEN*2),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		openStream:   openDefaultStream,
+	}
+	for i := range engine.bendRange {
+		engine.bendRange[i] = defaultBendRange
 	}
 
 	mixer := LevelMixer(NUM_VOICES)
-	engine.input = mixer
+	engine.master = MasterLimiter(mixer, DefaultDynamics)
+	engine.input = engine.master
 
 	for i := range engine.voices {
 		engine.voices[i] = engine.NewSimpleVoice(byte(i))
-		engine.voices[i].applyPatch(engine.patch)
+		engine.voices[i].track = engine.tracks[0]
+		engine.voices[i].applyPatch(engine.tracks[0].patch)
 		mixer.Inputs[i].from = engine.voices[i]
 	}
 
-	go engine.Run()
-
 	return engine
 }
 
+// Run starts rendering, midi is picked up by the render loop as it goes
 func (e *Engine) Run() {
+	if !atomic.CompareAndSwapInt32(&e.running, 0, 1) {
+		return
+	}
 	go e.runAudio()
-	go e.handleMidi()
 }
 
 func (e *Engine) CurrentPatch() *patch.Patch {
-	return e.patch
+	return e.tracks[0].patch
+}
+
+// SetTuning replaces the tuning table a track's notes are played in
+// notes already sounding keep their pitch until they're retriggered
+func (e *Engine) SetTuning(trackNum int, t *tuning.Tuning) {
+	if trackNum < 0 || trackNum >= len(e.tracks) {
+		return
+	}
+	e.tracks[trackNum].setTuning(t)
+}
+
+// SetChannels chooses the midi channels a track receives on, it starts out omni
+func (e *Engine) SetChannels(trackNum int, c midi.Channels) {
+	if trackNum < 0 || trackNum >= len(e.tracks) {
+		return
+	}
+	e.tracks[trackNum].setChannels(c)
+}
+
+// the track listening to a channel, or nil if none are
+func (e *Engine) trackFor(channel byte) *track {
+	for _, t := range e.tracks {
+		if t.receives(channel) {
+			return t
+		}
+	}
+	return nil
+}
+
+// SetDynamics reconfigures the master limiter and saturator
+func (e *Engine) SetDynamics(d Dynamics) {
+	e.master.SetDynamics(d)
 }
 
 func (e *Engine) getVoice(note byte) *Voice {
@@ -98,35 +191,141 @@ func (e *Engine) getVoice(note byte) *Voice {
 	return bestV
 }
 
-func (e *Engine) handleMidi() {
-	for event := range e.midiEvents {
-		switch event.Status >> 4 {
-		case NoteOn:
-			note := byte(event.Data1)
-			vel := byte(event.Data2)
-			voice := e.getVoice(note)
-			if voice != nil {
-				e.voiceMap[note] = voice
-				voice.NoteOn(note, vel)
-			} else {
-				fmt.Printf("nil voice\n")
-			}
-		case NoteOff:
-			note := byte(event.Data1)
-			if voice, ok := e.voiceMap[note]; ok {
-				delete(e.voiceMap, note)
-				voice.NoteOff(note)
+// handleEvent applies a midi event.  It runs on the render loop, in the middle of a
+// block, so it must never block: nothing here or in what it calls may wait on a lock
+// that's held for long, do I/O or print.  Anything slow is handed to another goroutine
+// without waiting, the way midi learn's profile saving is
+func (e *Engine) handleEvent(event portmidi.Event) {
+	if r := e.currentRecording(); r != nil {
+		r.record(e.eventAt, event)
+	}
+
+	if event.Status>>4 == SystemMessage {
+		if len(event.SysEx) > 0 {
+			// MTS retunes every track, we don't do per-track tuning programs
+			for _, t := range e.tracks {
+				if retuned, ok := t.currentTuning().Retune(event.SysEx); ok {
+					t.setTuning(retuned)
+				}
 			}
-		case CC:
-			num := byte(event.Data1)
-			val := byte(event.Data2)
-			e.patch.HandleCC(num, val)
-		default:
-			fmt.Printf("unknown message: %x %x %x\n", event.Status, event.Data1, event.Data2)
+		}
+		return
+	}
+
+	channel := byte(event.Status & 0x0F)
+	t := e.trackFor(channel)
+	if t == nil {
+		return
+	}
+
+	switch event.Status >> 4 {
+	case NoteOn:
+		note := byte(event.Data1)
+		vel := byte(event.Data2)
+		if t.currentTuning().Pitch(note) == 0 {
+			// unmapped in the current tuning, there's nothing to play or to release later
+			return
+		}
+		if voice := e.getVoice(note); voice != nil {
+			e.voiceMap[voiceKey{channel, note}] = voice
+			voice.channel = channel
+			e.expressVoice(voice)
+			voice.NoteOn(note, vel)
+		}
+	case NoteOff:
+		note := byte(event.Data1)
+		key := voiceKey{channel, note}
+		if voice, ok := e.voiceMap[key]; ok {
+			delete(e.voiceMap, key)
+			voice.NoteOff(note)
+		}
+	case CC:
+		if event.Data1 == midi.CC_ALL_NOTES_OFF {
+			e.allNotesOff(channel)
+			return
+		}
+		if _, member := e.mpeMaster(channel); member && event.Data1 == midi.CC_MPE_TIMBRE {
+			e.handleTimbre(channel, byte(event.Data2))
+			return
+		}
+		ctl, ok := e.controls[channel].Decode(byte(event.Data1), byte(event.Data2))
+		if ok {
+			e.handleControl(t, channel, ctl)
+		}
+	case PitchBend:
+		e.handleBend(channel, byte(event.Data1), byte(event.Data2))
+	case ChannelPressure:
+		e.handlePressure(channel, byte(event.Data1))
+	}
+	// program changes and poly aftertouch aren't used yet
+
+}
+
+// SetMidiOut echoes param changes to a midi output, starting with the whole patch
+// so the controller matches it
+func (e *Engine) SetMidiOut(out midi.Writer) {
+	f := midi.NewFeedback(out, e.tracks[0].patch)
+	if old, ok := e.feedback.Load().(*midi.Feedback); ok {
+		old.Close()
+	}
+	e.feedback.Store(f)
+	f.SendAll()
+}
+
+// releases every note held on a channel
+func (e *Engine) allNotesOff(channel byte) {
+	for key, voice := range e.voiceMap {
+		if key.channel == channel {
+			delete(e.voiceMap, key)
+			voice.NoteOff(key.note)
 		}
 	}
 }
 
+func (e *Engine) handleControl(t *track, channel byte, ctl midi.Control) {
+	var prm patch.Param
+	switch ctl.Kind {
+	case midi.ControlChange, midi.ControlChange14:
+		prm = t.patch.ControlledParam(channel, byte(ctl.Number))
+	case midi.NRPN:
+		prm = t.patch.GetParam(patch.ParamId(ctl.Number))
+	case midi.RPN:
+		e.handleRPN(t, channel, ctl)
+	}
+	if prm == nil {
+		return
+	}
+
+	// the feedbacks are told either side of the change, so they can tell it came from midi
+	var recorded *midi.Feedback
+	if r := e.currentRecording(); r != nil {
+		recorded = r.params
+	}
+	echoed, _ := e.feedback.Load().(*midi.Feedback)
+	if recorded != nil {
+		recorded.Receiving(prm)
+	}
+	if echoed != nil {
+		echoed.Receiving(prm)
+	}
+
+	switch {
+	case ctl.Kind == midi.ControlChange:
+		prm.SetFromCC(byte(ctl.Value))
+	case ctl.Delta != 0:
+		t.patch.Step(prm.ID(), ctl.Delta)
+	default:
+		prm.SetFromCC14(ctl.Value)
+	}
+
+	if recorded != nil {
+		recorded.Received(prm)
+	}
+	if echoed != nil {
+		echoed.Received(prm)
+	}
+}
+
 func (e *Engine) HandleCC(num, val byte) {
 	fmt.Printf("CC %x -> %x\n", num, val)
 
@@ -150,24 +349,43 @@ func (e *Engine) HandleCC(num, val byte) {
 // TODO: this currently handles only mono 16bit audio
 // if we implement stereo effects this will need to be changed
 func (e *Engine) runAudio() {
-	stream, err := portaudio.OpenDefaultStream(0, 1, float64(e.samplingRate), BUFFER_LEN, e.processAudio)
+	defer close(e.stopped)
+
+	// without a sound card there's nothing to render to, but Stop still works
+	stream, err := e.openStream(e)
 	if err != nil {
-		panic(err)
+		fmt.Printf("error opening audio: %v\n", err)
+		return
 	}
 	if err := stream.Start(); err != nil {
-		panic(err)
+		fmt.Printf("error starting audio: %v\n", err)
+		stream.Close()
+		return
 	}
+	defer func() {
+		// stopping waits for the callback, which plays silence once we've stopped
+		if err := stream.Stop(); err != nil {
+			fmt.Printf("error stopping audio: %v\n", err)
+		}
+		stream.Close()
+	}()
 
 	renderTime := make([]time.Duration, 100)
 	go func() {
+		tick := time.NewTicker(5 * time.Second)
+		defer tick.Stop()
 		for {
+			select {
+			case <-tick.C:
+			case <-e.stop:
+				return
+			}
 			var sum time.Duration
 			for _, d := range renderTime {
 				sum = sum + d
 			}
 			avg := sum / time.Duration(len(renderTime))
 			fmt.Printf("average render time: %s\n", avg)
-			time.Sleep(5 * time.Second)
 		}
 	}()
 
@@ -177,24 +395,41 @@ func (e *Engine) runAudio() {
 	buf := make([]fp.Fp32, BUFFER_LEN)
 	for {
 		start := time.Now()
-		e.input.Render(buf)
+		e.render(buf)
 		elapsed := time.Now().Sub(start)
 		renderTime = append(renderTime[:len(renderTime)-1], elapsed)
 		for _, s := range buf {
-			e.audioChan <- s
+			select {
+			case e.audioChan <- s:
+			case <-e.stop:
+				return
+			}
 		}
 	}
 }
 
-var underrun bool
+func openDefaultStream(e *Engine) (audioStream, error) {
+	return portaudio.OpenDefaultStream(0, 1, float64(e.samplingRate), BUFFER_LEN, e.processAudio)
+}
 
 func (e *Engine) processAudio(_, out []int16) {
 	for i := range out {
-		sample := <-e.audioChan
-		out[i] = sample.To16bit()
+		select {
+		case sample := <-e.audioChan:
+			out[i] = sample.To16bit()
+		case <-e.stop:
+			out[i] = 0
+		}
 	}
 }
 
+// Stop stops rendering and closes the audio stream, returning once the sound card's
+// been let go of.  Notes still sounding are cut off.  It's safe to call more than once
 func (e *Engine) Stop() {
-	fmt.Printf("Engine.Stop() should probably do something\n")
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+	if atomic.LoadInt32(&e.running) == 1 {
+		<-e.stopped
+	}
 }
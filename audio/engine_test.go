@@ -0,0 +1,293 @@
+package audio
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/ianmcmahon/fmsynth/tuning"
+	"github.com/rakyll/portmidi"
+)
+
+// run with -race: the midi goroutine sets params while the audio thread renders
+func TestHandleCCDuringRender(t *testing.T) {
+	p := patch.InitialPatch()
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+
+	e := &Engine{tracks: []*track{newTrack(p)}}
+	voices := make([]*Voice, 4)
+	for i := range voices {
+		voices[i] = e.NewSimpleVoice(byte(i))
+		voices[i].track = e.tracks[0]
+		voices[i].applyPatch(p)
+		voices[i].NoteOn(byte(48+i*7), 100)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			p.HandleCC(3, byte(i%3))
+			for cc := byte(0x14); cc <= 0x17; cc++ {
+				p.HandleCC(cc, byte(i*13)&0x7F)
+			}
+		}
+	}()
+
+	out := make([]fp.Fp32, BUFFER_LEN)
+	for block := 0; block < 200; block++ {
+		for _, v := range voices {
+			v.Render(out)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRenderDoesNotAllocate(t *testing.T) {
+	p := patch.InitialPatch()
+	e := &Engine{tracks: []*track{newTrack(p)}}
+	v := e.NewSimpleVoice(0)
+	v.track = e.tracks[0]
+	v.applyPatch(p)
+	v.NoteOn(60, 100)
+
+	out := make([]fp.Fp32, BUFFER_LEN)
+	if allocs := testing.AllocsPerRun(100, func() { v.Render(out) }); allocs != 0 {
+		t.Errorf("voice render allocated %.1f times per block", allocs)
+	}
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteShort(status, data1, data2 int64) error { return nil }
+
+func TestControlsDoNotAllocate(t *testing.T) {
+	e := newEngine(nil)
+	e.SetMidiOut(discardWriter{})
+	// a subscriber that never reads, and the feedback that does
+	sub := e.CurrentPatch().Subscribe()
+	defer sub.Unsubscribe()
+
+	out := make([]fp.Fp32, BUFFER_LEN)
+	e.Queue(e.clock, portmidi.Event{Status: NoteOn << 4, Data1: 60, Data2: 100})
+	e.render(out)
+
+	detune := patch.OPR_DETUNE | patch.GRP_A
+	msb, lsb := detune.NRPN()
+	val := 0
+	allocs := testing.AllocsPerRun(100, func() {
+		val = (val + 1) % 128
+		at := e.clock
+		// attack on its controller, then detune as an NRPN, in the middle of the block
+		e.Queue(at, portmidi.Event{Status: CC << 4, Data1: 0x14, Data2: int64(val)})
+		e.Queue(at+10, portmidi.Event{Status: CC << 4, Data1: midi.CC_NRPN_MSB, Data2: int64(msb)})
+		e.Queue(at+10, portmidi.Event{Status: CC << 4, Data1: midi.CC_NRPN_LSB, Data2: int64(lsb)})
+		e.Queue(at+20, portmidi.Event{Status: CC << 4, Data1: midi.CC_DATA_ENTRY, Data2: int64(val)})
+		e.render(out)
+	})
+	if allocs != 0 {
+		t.Errorf("rendering controllers allocated %.1f times per block", allocs)
+	}
+	if got := e.CurrentPatch().GetParam(patch.ENV_ATTACK | patch.GRP_VCA).ValAsCC(); got != byte(val) {
+		t.Errorf("attack is at cc %d, want %d", got, val)
+	}
+}
+
+func TestChannelFiltering(t *testing.T) {
+	p := patch.InitialPatch()
+	e := &Engine{tracks: []*track{newTrack(p)}, voiceMap: make(map[voiceKey]*Voice)}
+	v := e.NewSimpleVoice(0)
+	v.track = e.tracks[0]
+	v.applyPatch(p)
+	e.voices = []*Voice{v}
+
+	e.SetChannels(0, midi.Channel(1)|midi.Channel(2))
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 0, Data1: 60, Data2: 100})
+	if v.CurNote() != 0 {
+		t.Fatalf("a note on channel 1 played on a track receiving 2 and 3")
+	}
+
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 1, Data1: 60, Data2: 100})
+	if v.CurNote() != 60 {
+		t.Fatalf("a note on channel 2 didn't play, voice has %d", v.CurNote())
+	}
+	// the same note off on another channel isn't this note's
+	e.handleEvent(portmidi.Event{Status: NoteOff<<4 | 2, Data1: 60})
+	if v.CurNote() != 60 {
+		t.Errorf("a note off on channel 3 released channel 2's note")
+	}
+	e.handleEvent(portmidi.Event{Status: NoteOff<<4 | 1, Data1: 60})
+	if v.CurNote() != 0 {
+		t.Errorf("the note off on channel 2 didn't release it")
+	}
+}
+
+// stands in for the sound card, pulling buffers through processAudio until it's stopped
+type fakeStream struct {
+	e       *Engine
+	fail    bool
+	quit    chan struct{}
+	done    chan struct{}
+	stopped bool
+	closed  bool
+}
+
+func (s *fakeStream) Start() error {
+	if s.fail {
+		return errors.New("no sound card")
+	}
+	go func() {
+		defer close(s.done)
+		out := make([]int16, BUFFER_LEN)
+		for {
+			select {
+			case <-s.quit:
+				return
+			default:
+				s.e.processAudio(nil, out)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *fakeStream) Stop() error {
+	s.stopped = true
+	close(s.quit)
+	<-s.done
+	return nil
+}
+
+func (s *fakeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func fakeCard(fail bool) (func(*Engine) (audioStream, error), *fakeStream) {
+	s := &fakeStream{fail: fail, quit: make(chan struct{}), done: make(chan struct{})}
+	return func(e *Engine) (audioStream, error) {
+		s.e = e
+		return s, nil
+	}, s
+}
+
+func stopWithin(t *testing.T, e *Engine) {
+	done := make(chan struct{})
+	go func() {
+		e.Stop()
+		e.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the engine didn't stop")
+	}
+}
+
+func TestStop(t *testing.T) {
+	// an engine that was never started stops straight away
+	newEngine(nil).Stop()
+
+	e := newEngine(nil)
+	open, stream := fakeCard(false)
+	e.openStream = open
+	e.Run()
+	time.Sleep(10 * time.Millisecond)
+
+	stopWithin(t, e)
+	if !stream.stopped || !stream.closed {
+		t.Errorf("the stream was left open, stopped %v closed %v", stream.stopped, stream.closed)
+	}
+
+	// the sound card's callback plays silence rather than waiting on a stopped engine
+	out := []int16{1, 2, 3}
+	e.processAudio(nil, out)
+	for _, s := range out {
+		if s != 0 {
+			t.Fatalf("a stopped engine played %v", out)
+		}
+	}
+}
+
+func TestStopWithoutSoundCard(t *testing.T) {
+	e := newEngine(nil)
+	e.openStream = func(*Engine) (audioStream, error) { return nil, errors.New("no sound card") }
+	e.Run()
+	stopWithin(t, e)
+
+	e = newEngine(nil)
+	open, stream := fakeCard(true)
+	e.openStream = open
+	e.Run()
+	stopWithin(t, e)
+	if !stream.closed {
+		t.Errorf("a stream that didn't start wasn't closed")
+	}
+}
+
+func TestUnmappedNote(t *testing.T) {
+	e := newEngine(nil)
+	// every other key is left unmapped
+	scale, err := tuning.ParseScale(strings.NewReader("whole tone\n6\n200.\n400.\n600.\n800.\n1000.\n2/1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kbm := &tuning.KeyboardMap{Size: 2, First: 0, Last: 127, Middle: 60, RefNote: 70, RefFreq: 440, Period: 6, Mapping: []int{0, -1}}
+	e.SetTuning(0, tuning.New(scale, kbm, 0))
+
+	e.handleEvent(portmidi.Event{Status: NoteOn << 4, Data1: 61, Data2: 100})
+	if len(e.voiceMap) != 0 {
+		t.Errorf("an unmapped note took a voice")
+	}
+	e.handleEvent(portmidi.Event{Status: NoteOn << 4, Data1: 60, Data2: 100})
+	if len(e.voiceMap) != 1 {
+		t.Errorf("a mapped note didn't take a voice")
+	}
+}
+
+func TestMTSRetunesWithoutChangingTheOldTuning(t *testing.T) {
+	e := newEngine(nil)
+	before := e.tracks[0].currentTuning()
+	e.handleEvent(portmidi.Event{Status: 0xF0, SysEx: []byte{0xF0, 0x7F, 0x00, 0x08, 0x02, 0x00, 0x01, 69, 69, 0x40, 0x00, 0xF7}})
+
+	if before.Freq(69) != 440 {
+		t.Errorf("the tuning voices were reading changed under them")
+	}
+	if after := e.tracks[0].currentTuning(); after == before || after.Freq(69) <= 440 {
+		t.Errorf("MTS didn't retune, A4 is %f", after.Freq(69))
+	}
+}
+
+func TestAllNotesOff(t *testing.T) {
+	e := newEngine(nil)
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 0, Data1: 60, Data2: 100})
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 0, Data1: 64, Data2: 100})
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 1, Data1: 67, Data2: 100})
+
+	e.handleEvent(portmidi.Event{Status: CC<<4 | 0, Data1: midi.CC_ALL_NOTES_OFF})
+	if len(e.voiceMap) != 1 {
+		t.Fatalf("%d notes held after all notes off on channel 1", len(e.voiceMap))
+	}
+	for _, v := range e.voices {
+		if len(v.notesOn) > 0 && v.CurNote() != 67 {
+			t.Errorf("note %d is still held", v.CurNote())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package audio
 
 import (
+	"math"
+
 	"github.com/ianmcmahon/fmsynth/fp"
 	"github.com/ianmcmahon/fmsynth/patch"
 )
@@ -16,31 +18,39 @@ const (
 )
 
 // an envelope returns a CV for a given time based params
-// attack and decay are times in units of 32 samples (about 0.7ms)
+// attack, decay and release are times in milliseconds, and each segment
+// has a curvature param shaping it between logarithmic, linear and exponential
+// the note is passed to the triggers for keyboard rate scaling
 type envelope interface {
-	Trigger()
-	Retrigger()
+	Trigger(note byte)
+	Retrigger(note byte)
 	Release()
 	Scale(fp.Fp32) fp.Fp32
 	applyPatch(p *patch.Patch)
 }
 
 type adeEnvelope struct {
-	group     patch.ParamId
-	gated     patch.Param
-	retrigger patch.Param
-	attack    patch.Param
-	decay     patch.Param
-	endLevel  patch.Param
-	index     patch.Param // this is stored with the envelope in the digitone style algorithm, it scales the envelope output
+	group       patch.ParamId
+	gated       *patch.BoolParam
+	retrigger   *patch.BoolParam
+	attack      *patch.Uint16Param
+	decay       *patch.Uint16Param
+	endLevel    *patch.Fp32Param
+	rateScale   *patch.Fp32Param
+	attackCurve *patch.Fp32Param
+	decayCurve  *patch.Fp32Param
+	loopMode    *patch.ByteParam
 
 	state       State
 	sampleCount uint32
 	current     fp.Fp32
+	start       fp.Fp32 // where the attack rises from, looping attacks start from the end level
+	held        bool
+	timeScale   fp.Fp32 // from keyboard rate scaling, set on trigger
 }
 
 func AdeEnvelope(group patch.ParamId) *adeEnvelope {
-	return &adeEnvelope{group: group}
+	return &adeEnvelope{group: group, timeScale: 1 << 16}
 }
 
 func (e *adeEnvelope) applyPatch(p *patch.Patch) {
@@ -49,71 +59,87 @@ func (e *adeEnvelope) applyPatch(p *patch.Patch) {
 	e.attack = p.Uint16Param(patch.ENV_ATTACK | e.group)
 	e.decay = p.Uint16Param(patch.ENV_DECAY | e.group)
 	e.endLevel = p.Fp32Param(patch.ENV_ENDLEVEL | e.group)
-	e.index = p.Fp32Param(patch.ENV_INDEX | e.group)
+	e.rateScale = p.Fp32Param(patch.ENV_RATE_SCALE | e.group)
+	e.attackCurve = p.Fp32Param(patch.ENV_ATTACK_CURVE | e.group)
+	e.decayCurve = p.Fp32Param(patch.ENV_DECAY_CURVE | e.group)
+	e.loopMode = p.ByteParam(patch.ENV_LOOP_MODE | e.group)
 }
 
-func (e *adeEnvelope) Trigger() {
+func (e *adeEnvelope) Trigger(note byte) {
 	e.state = ATTACK
 	e.current = 0
+	e.start = 0
+	e.held = true
 	e.sampleCount = 0
+	e.timeScale = keyTimeScale(note, e.rateScale.Fp32())
 }
 
-func (e *adeEnvelope) Retrigger() {
-	if !e.retrigger.Value().(bool) {
+func (e *adeEnvelope) Retrigger(note byte) {
+	if !e.retrigger.Bool() {
 		return
 	}
-	e.Trigger()
+	e.Trigger(note)
 }
 
 func (e *adeEnvelope) Release() {
-	if e.gated.Value().(bool) {
+	loop := e.loopMode.Byte()
+	if loop == patch.LOOP_FOREVER {
+		return
+	}
+	e.held = false
+	// a gated loop finishes the cycle it's in rather than cutting to the decay
+	if e.gated.Bool() && (loop == patch.LOOP_ONE_SHOT || e.state == SUSTAIN) {
 		e.state = DECAY
 		e.sampleCount = 0
 	}
 }
 
-// the modulation index is stored on the envelope in this scheme
-// this function scales the index parameter by the current envelope amplitude
-func (e *adeEnvelope) ScaledIndex() fp.Fp32 {
-	return e.Scale(e.index.Value().(fp.Fp32))
+// whether to go round again at the end of the decay
+func (e *adeEnvelope) looping() bool {
+	switch e.loopMode.Byte() {
+	case patch.LOOP_GATED:
+		return e.held
+	case patch.LOOP_FOREVER:
+		return true
+	}
+	return false
 }
 
 func (e *adeEnvelope) Scale(s fp.Fp32) fp.Fp32 {
-	// attack and decay are times in units of 1024 samples (about 22.8us for 44.1kHz)
-	// this way I can shift down the sample count 10 bits and divide
 	e.sampleCount++
 
-	attack := e.attack.Value().(uint16)
-	decay := e.decay.Value().(uint16)
-	endlevel := e.endLevel.Value().(fp.Fp32)
+	// msToSamples won't return a zero length, which matters for the attack
+	// since a zero attack gets us phase discontinuities (clicks)
+	attack := msToSamples(e.attack.Uint16(), e.timeScale)
+	decay := msToSamples(e.decay.Uint16(), e.timeScale)
+	endlevel := e.endLevel.Fp32()
 	switch e.state {
 	case ATTACK:
-		// can't have a zero attack or we get phase discontinuities (clicks)
-		if attack == 0 {
-			attack++
-		}
-		if e.current >= 1<<16 {
+		t := progress(e.sampleCount, attack)
+		e.current = e.start + curve(t, e.attackCurve.Fp32()).Mul(1<<16-e.start)
+		if t >= 1<<16 {
 			e.current = 1 << 16
-			if e.gated.Value().(bool) {
+			// a looping envelope goes straight into the decay rather than sustaining
+			if e.gated.Bool() && e.loopMode.Byte() == patch.LOOP_ONE_SHOT {
 				e.state = SUSTAIN
 				e.sampleCount = 0
 			} else {
 				e.state = DECAY
 				e.sampleCount = 0
 			}
-		} else {
-			e.current = fp.Fp32((e.sampleCount << 11) / uint32(attack))
 		}
 	case DECAY:
-		if decay == 0 {
-			decay++
-		}
-		if decay == 0 || e.current <= endlevel {
+		t := progress(e.sampleCount, decay)
+		e.current = fp.Fp32(1<<16) - curve(t, e.decayCurve.Fp32()).Mul(1<<16-endlevel)
+		if t >= 1<<16 {
 			e.current = endlevel
-			e.state = COMPLETE
 			e.sampleCount = 0
-		} else {
-			e.current = fp.Fp32(1<<16) - fp.Fp32((e.sampleCount<<11)/uint32(decay)).Mul(1<<16-endlevel)
+			if e.looping() {
+				e.state = ATTACK
+				e.start = endlevel
+			} else {
+				e.state = COMPLETE
+			}
 		}
 	case SUSTAIN:
 		e.current = 1 << 16
@@ -125,22 +151,28 @@ func (e *adeEnvelope) Scale(s fp.Fp32) fp.Fp32 {
 }
 
 type adsrEnvelope struct {
-	group     patch.ParamId
-	gated     patch.Param
-	retrigger patch.Param
-	attack    patch.Param
-	decay     patch.Param
-	sustain   patch.Param
-	release   patch.Param
+	group        patch.ParamId
+	gated        *patch.BoolParam
+	retrigger    *patch.BoolParam
+	attack       *patch.Uint16Param
+	decay        *patch.Uint16Param
+	sustain      *smoothedParam
+	release      *patch.Uint16Param
+	rateScale    *patch.Fp32Param
+	attackCurve  *patch.Fp32Param
+	decayCurve   *patch.Fp32Param
+	releaseCurve *patch.Fp32Param
+	loopMode     *patch.ByteParam
 
 	state       State
 	sampleCount uint32
 	current     fp.Fp32
 	ref         fp.Fp32
+	timeScale   fp.Fp32
 }
 
 func AdsrEnvelope(group patch.ParamId) *adsrEnvelope {
-	return &adsrEnvelope{group: group}
+	return &adsrEnvelope{group: group, timeScale: 1 << 16}
 }
 
 func (e *adsrEnvelope) applyPatch(p *patch.Patch) {
@@ -149,23 +181,32 @@ func (e *adsrEnvelope) applyPatch(p *patch.Patch) {
 	e.attack = p.Uint16Param(patch.ENV_ATTACK | e.group)
 	e.decay = p.Uint16Param(patch.ENV_DECAY | e.group)
 	e.release = p.Uint16Param(patch.ENV_RELEASE | e.group)
-	e.sustain = p.Fp32Param(patch.ENV_SUSTAIN | e.group)
+	e.sustain = smoothed(p, patch.ENV_SUSTAIN|e.group)
+	e.rateScale = p.Fp32Param(patch.ENV_RATE_SCALE | e.group)
+	e.attackCurve = p.Fp32Param(patch.ENV_ATTACK_CURVE | e.group)
+	e.decayCurve = p.Fp32Param(patch.ENV_DECAY_CURVE | e.group)
+	e.releaseCurve = p.Fp32Param(patch.ENV_RELEASE_CURVE | e.group)
+	e.loopMode = p.ByteParam(patch.ENV_LOOP_MODE | e.group)
 }
 
-func (e *adsrEnvelope) Trigger() {
+func (e *adsrEnvelope) Trigger(note byte) {
 	e.state = ATTACK
 	e.ref = e.current
 	e.sampleCount = 0
+	e.timeScale = keyTimeScale(note, e.rateScale.Fp32())
 }
 
-func (e *adsrEnvelope) Retrigger() {
-	if !e.retrigger.Value().(bool) {
+func (e *adsrEnvelope) Retrigger(note byte) {
+	if !e.retrigger.Bool() {
 		return
 	}
-	e.Trigger()
+	e.Trigger(note)
 }
 
 func (e *adsrEnvelope) Release() {
+	if e.loopMode.Byte() == patch.LOOP_FOREVER {
+		return
+	}
 	e.state = RELEASE
 	e.ref = e.current
 	e.sampleCount = 0
@@ -174,60 +215,171 @@ func (e *adsrEnvelope) Release() {
 func (e *adsrEnvelope) Scale(s fp.Fp32) fp.Fp32 {
 	e.sampleCount++
 
-	attack := e.attack.Value().(uint16)
-	decay := e.decay.Value().(uint16)
-	sustain := e.sustain.Value().(fp.Fp32)
-	release := e.release.Value().(uint16)
+	attack := msToSamples(e.attack.Uint16(), e.timeScale)
+	decay := msToSamples(e.decay.Uint16(), e.timeScale)
+	sustain := e.sustain.Value()
+	release := msToSamples(e.release.Uint16(), e.timeScale)
 	switch e.state {
 	case ATTACK:
-		if attack == 0 {
-			attack++
+		t := progress(e.sampleCount, attack)
+		e.current = curve(t, e.attackCurve.Fp32())
+		// this nice little hack ensures that if we trigger during the release of a previous cycle,
+		// the level stays continuous at where it was until the rise catches up
+		// to avoid a click at the discontinuity when it drops to 0
+		if e.ref > e.current {
+			e.current = e.ref
 		}
-		if attack == 0 || e.current >= 1<<16 {
+		if t >= 1<<16 {
 			e.current = 1 << 16
-			if e.gated.Value().(bool) {
+			if e.gated.Bool() || e.loopMode.Byte() != patch.LOOP_ONE_SHOT {
 				e.state = DECAY
 				e.sampleCount = 0
 			} else {
 				e.state = RELEASE
+				e.ref = e.current
 				e.sampleCount = 0
 			}
-		} else {
-			e.current = fp.Fp32((e.sampleCount << 11) / uint32(attack))
-			// this nice little hack ensures that if we trigger during the release of a previous cycle,
-			// the level stays continuous at where it was until the rise catches up
-			// to avoid a click at the discontinuity when it drops to 0
-			if e.ref > e.current {
-				e.current = e.ref
-			}
 		}
 	case DECAY:
-		if decay == 0 {
-			decay++
-		}
-		if e.current <= sustain {
+		t := progress(e.sampleCount, decay)
+		e.current = fp.Fp32(1<<16) - curve(t, e.decayCurve.Fp32()).Mul(1<<16-sustain)
+		if t >= 1<<16 {
 			e.current = sustain
-			e.state = SUSTAIN
 			e.ref = e.current
 			e.sampleCount = 0
-		} else {
-			e.current = fp.Fp32(1<<16) - fp.Fp32((e.sampleCount<<11)/uint32(decay)).Mul(1<<16-sustain)
+			// release takes us out of DECAY, so if we're still here the gate is held
+			if e.loopMode.Byte() == patch.LOOP_ONE_SHOT {
+				e.state = SUSTAIN
+			} else {
+				e.state = ATTACK
+			}
 		}
 	case SUSTAIN:
 		e.current = sustain
 	case RELEASE:
-		if release == 0 {
-			release++
-		}
-		if e.current <= 0 {
+		t := progress(e.sampleCount, release)
+		e.current = fp.Fp32(1<<16 - curve(t, e.releaseCurve.Fp32())).Mul(e.ref)
+		if t >= 1<<16 {
 			e.current = 0
 			e.state = COMPLETE
 			e.sampleCount = 0
-		} else {
-			e.current = fp.Fp32(1<<16 - (e.sampleCount<<11)/uint32(release)).Mul(e.ref)
 		}
 	case COMPLETE:
 	}
 
 	return s.Mul(e.current)
 }
+
+// the modulation index is stored with the envelope in the digitone style algorithm,
+// indexEnvelope scales the index param by the current envelope amplitude
+// mod is added to the index first, from the voice's expression
+type indexEnvelope struct {
+	envelope
+	group patch.ParamId
+	index *smoothedParam
+	mod   fp.Fp32
+}
+
+func IndexEnvelope(group patch.ParamId, env envelope) *indexEnvelope {
+	return &indexEnvelope{envelope: env, group: group}
+}
+
+func (e *indexEnvelope) applyPatch(p *patch.Patch) {
+	e.envelope.applyPatch(p)
+	e.index = smoothed(p, patch.ENV_INDEX|e.group)
+}
+
+func (e *indexEnvelope) ScaledIndex() fp.Fp32 {
+	index := e.index.Value() + e.mod
+	if index < 0 {
+		index = 0
+	}
+	return e.Scale(index)
+}
+
+// envelopeSelector lets the patch choose the envelope implementation with PATCH_ENV_MODE
+// the choice is made when a note is triggered, so changing modes never cuts off a note
+type envelopeSelector struct {
+	mode    *patch.ByteParam
+	envs    []envelope // indexed by mode
+	current envelope
+}
+
+func EnvelopeSelector(envs ...envelope) *envelopeSelector {
+	return &envelopeSelector{envs: envs, current: envs[0]}
+}
+
+func (e *envelopeSelector) applyPatch(p *patch.Patch) {
+	e.mode = p.ByteParam(patch.PATCH_ENV_MODE)
+	for _, env := range e.envs {
+		env.applyPatch(p)
+	}
+}
+
+func (e *envelopeSelector) Trigger(note byte) {
+	mode := int(e.mode.Byte())
+	if mode < len(e.envs) {
+		e.current = e.envs[mode]
+	}
+	e.current.Trigger(note)
+}
+
+func (e *envelopeSelector) Retrigger(note byte) {
+	e.current.Retrigger(note)
+}
+
+func (e *envelopeSelector) Release() {
+	e.current.Release()
+}
+
+func (e *envelopeSelector) Scale(s fp.Fp32) fp.Fp32 {
+	return e.current.Scale(s)
+}
+
+// keyboard rate scaling: at full depth envelope times halve for every
+// octave above middle C and double for every octave below
+func keyTimeScale(note byte, depth fp.Fp32) fp.Fp32 {
+	if depth == 0 {
+		return 1 << 16
+	}
+	octaves := float64(int(note)-60) / 12.0
+	return fp.Float2Fp32(math.Pow(2, -octaves*float64(depth)/float64(1<<16)))
+}
+
+// converts an envelope time to a segment length in samples, applying the rate scaling
+// never returns zero
+func msToSamples(ms uint16, scale fp.Fp32) uint32 {
+	samples := (uint64(ms) * SAMPLING_RATE / 1000 * uint64(scale)) >> 16
+	if samples == 0 {
+		samples = 1
+	}
+	return uint32(samples)
+}
+
+// how far through a segment we are, 0 to 1.0
+func progress(sampleCount, length uint32) fp.Fp32 {
+	if sampleCount >= length {
+		return 1 << 16
+	}
+	return fp.Fp32((uint64(sampleCount) << 16) / uint64(length))
+}
+
+// shapes a segment's linear progress t by a curvature from -1.0 to 1.0
+// zero is a straight line.  Positive curvature bends toward an exponential,
+// moving quickly at first and easing into the target like an RC circuit,
+// negative bends the other way, starting slowly and rushing in at the end.
+// The curves are 1-(1-t)^4 and t^4, close enough to the real thing and cheap to do per sample
+func curve(t, curvature fp.Fp32) fp.Fp32 {
+	if curvature == 0 {
+		return t
+	}
+	if curvature > 0 {
+		u := fp.Fp32(1<<16) - t
+		u2 := u.Mul(u)
+		fast := fp.Fp32(1<<16) - u2.Mul(u2)
+		return t + (fast - t).Mul(curvature)
+	}
+	t2 := t.Mul(t)
+	slow := t2.Mul(t2)
+	return t + (t - slow).Mul(curvature)
+}
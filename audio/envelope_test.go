@@ -0,0 +1,147 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+func TestCurveEndpoints(t *testing.T) {
+	for _, c := range []float64{-1.0, -0.5, 0, 0.5, 1.0} {
+		curvature := fp.Float2Fp32(c)
+		if v := curve(0, curvature); v != 0 {
+			t.Errorf("curvature %.1f: curve(0) = %d", c, v)
+		}
+		if v := curve(1<<16, curvature); v != 1<<16 {
+			t.Errorf("curvature %.1f: curve(1) = %d", c, v)
+		}
+	}
+
+	half := fp.Fp32(1 << 15)
+	if exp, lin, log := curve(half, 1<<16), curve(half, 0), curve(half, -1<<16); !(exp > lin && lin > log) {
+		t.Errorf("expected exponential > linear > logarithmic at the midpoint, got %d %d %d", exp, lin, log)
+	}
+}
+
+func TestAdsrTiming(t *testing.T) {
+	p := testPatch()
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+	p.Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA).Set(10)
+	p.Uint16Param(patch.ENV_DECAY | patch.GRP_VCA).Set(20)
+	p.Fp32Param(patch.ENV_SUSTAIN | patch.GRP_VCA).Set(fp.Float2Fp32(0.5))
+
+	env := AdsrEnvelope(patch.GRP_VCA)
+	env.applyPatch(p)
+	env.Trigger(60)
+
+	// 10ms of attack and 20ms of decay at 44.1kHz
+	attack := 441
+	decay := 882
+	for i := 0; i < attack; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.state != DECAY || env.current != 1<<16 {
+		t.Fatalf("expected to be at the top of the attack, state %d level %d", env.state, env.current)
+	}
+	for i := 0; i < decay; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.state != SUSTAIN || env.current != fp.Float2Fp32(0.5) {
+		t.Fatalf("expected to be sustaining at 0.5, state %d level %d", env.state, env.current)
+	}
+}
+
+func TestRateLevelEnvelope(t *testing.T) {
+	p := testPatch()
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+	p.ByteParam(patch.ENV_L2 | patch.GRP_VCA).Set(80)
+	p.ByteParam(patch.ENV_L3 | patch.GRP_VCA).Set(60)
+
+	env := RateLevelEnvelope(patch.GRP_VCA)
+	env.applyPatch(p)
+	env.Trigger(60)
+
+	// rate 99 segments are a few ms long, so after 50ms we're holding on L3
+	for i := 0; i < SAMPLING_RATE/20; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.stage != rlHold || env.level != 60<<rlLevelShift {
+		t.Fatalf("expected to hold at L3, stage %d level %d", env.stage, env.level>>rlLevelShift)
+	}
+	if s := env.Scale(1 << 16); s != rlAmplitude[60<<rlTableShift] {
+		t.Errorf("expected L3 amplitude %d, got %d", rlAmplitude[60<<rlTableShift], s)
+	}
+
+	// R4 is 70, comfortably under a second to fall to L4
+	env.Release()
+	for i := 0; i < SAMPLING_RATE; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.stage != rlDone || env.Scale(1<<16) != 0 {
+		t.Fatalf("expected to finish silent, stage %d level %d", env.stage, env.level>>rlLevelShift)
+	}
+
+	// loop points alone don't loop a one shot, it runs straight through to the hold
+	p.ByteParam(patch.ENV_LOOP_END | patch.GRP_VCA).Set(1)
+	env.Trigger(60)
+	for i := 0; i < SAMPLING_RATE/20; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.stage != rlHold {
+		t.Fatalf("expected a one shot to hold on L3, stage %d", env.stage)
+	}
+
+	// looping L1 and L2 never reaches the hold stage
+	p.ByteParam(patch.ENV_LOOP_MODE | patch.GRP_VCA).Set(patch.LOOP_GATED)
+	env.Trigger(60)
+	for i := 0; i < SAMPLING_RATE/20; i++ {
+		env.Scale(1 << 16)
+		if env.stage > 1 {
+			t.Fatalf("looping envelope left the loop for stage %d", env.stage)
+		}
+	}
+}
+
+func TestAdeGatedLoop(t *testing.T) {
+	p := testPatch()
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+	p.Uint16Param(patch.ENV_ATTACK | patch.GRP_A).Set(5)
+	p.Uint16Param(patch.ENV_DECAY | patch.GRP_A).Set(5)
+	p.ByteParam(patch.ENV_LOOP_MODE | patch.GRP_A).Set(patch.LOOP_GATED)
+
+	env := AdeEnvelope(patch.GRP_A)
+	env.applyPatch(p)
+	env.Trigger(60)
+
+	// 5ms + 5ms cycles, so 100ms of holding the note should go round about ten times
+	attacks := 0
+	last := env.state
+	for i := 0; i < SAMPLING_RATE/10; i++ {
+		env.Scale(1 << 16)
+		if env.state == ATTACK && last != ATTACK {
+			attacks++
+		}
+		last = env.state
+	}
+	if attacks < 8 {
+		t.Fatalf("expected the envelope to keep cycling while held, only restarted %d times", attacks)
+	}
+
+	env.Release()
+	for i := 0; i < SAMPLING_RATE/10; i++ {
+		env.Scale(1 << 16)
+	}
+	if env.state != COMPLETE {
+		t.Errorf("expected the loop to stop after release, state %d", env.state)
+	}
+}
@@ -0,0 +1,140 @@
+package audio
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/rakyll/portmidi"
+)
+
+/*
+	Midi events are applied by the render loop, between samples rather than between
+	blocks.  Each event is given a time on the sample clock (the number of samples
+	rendered so far) and a block is rendered in pieces, split wherever an event falls.
+
+	Events from a live input are timed by their portmidi timestamps.  The two clocks
+	aren't locked together so the first event anchors one to the other, landing a
+	block's worth of latency after it's picked up, and later events keep the same
+	spacing they were played with.  If the clocks drift apart, so an event would land
+	in the past or more than a few blocks beyond the latency, or portmidi's clock
+	restarts, that event anchors them again.  Drift either way is caught within a few
+	blocks rather than letting the latency creep up.
+
+	Offline rendering queues events at exact sample times and gets the same output
+	every time.
+*/
+
+type timedEvent struct {
+	at    int64 // on the sample clock
+	event portmidi.Event
+}
+
+// events waiting to be applied, in time order with ties in the order they were queued
+type eventQueue []timedEvent
+
+func (q *eventQueue) push(at int64, ev portmidi.Event) {
+	*q = append(*q, timedEvent{})
+	i := len(*q) - 1
+	for i > 0 && (*q)[i-1].at > at {
+		(*q)[i] = (*q)[i-1]
+		i--
+	}
+	(*q)[i] = timedEvent{at, ev}
+}
+
+// drops the first n events, keeping the queue's storage so it doesn't allocate
+func (q *eventQueue) drop(n int) {
+	*q = (*q)[:copy(*q, (*q)[n:])]
+}
+
+// how much further than the latency ahead an event can land before the clocks are
+// taken to have drifted.  It covers an event being picked up a block late and the
+// sound card pulling blocks unevenly
+const driftSlack = 4 * BUFFER_LEN
+
+// scheduler turns portmidi timestamps, in ms, into times on the sample clock
+type scheduler struct {
+	rate    int64
+	latency int64 // in samples
+
+	anchored bool
+	offset   int64
+}
+
+func (s *scheduler) at(ts portmidi.Timestamp, now int64) int64 {
+	t := int64(ts) * s.rate / 1000
+	if s.anchored {
+		// late events, or ones too far ahead, mean the clocks have wandered
+		if at := t + s.offset; at >= now && at <= now+s.latency+driftSlack {
+			return at
+		}
+	}
+	s.offset = now + s.latency - t
+	s.anchored = true
+	return now + s.latency
+}
+
+// moves events that have arrived from the live input into the queue
+func (e *Engine) receiveMidi() {
+	for {
+		select {
+		case ev, ok := <-e.midiEvents:
+			if !ok {
+				e.midiEvents = nil
+				return
+			}
+			e.queue.push(e.sched.at(ev.Timestamp, e.clock), ev)
+		default:
+			return
+		}
+	}
+}
+
+// render fills out, applying each event that falls inside it at its sample
+func (e *Engine) render(out []fp.Fp32) {
+	began := time.Now()
+	e.receiveMidi()
+
+	start := e.clock
+	pos := 0
+	for pos < len(out) {
+		n := 0
+		for n < len(e.queue) && e.queue[n].at <= start+int64(pos) {
+			e.eventAt = start + int64(pos)
+			e.handleEvent(e.queue[n].event)
+			n++
+		}
+		e.queue.drop(n)
+
+		end := len(out)
+		if len(e.queue) > 0 && e.queue[0].at < start+int64(end) {
+			end = int(e.queue[0].at - start)
+		}
+		e.input.Render(out[pos:end])
+		pos = end
+	}
+	atomic.AddInt64(&e.clock, int64(len(out)))
+	e.meter(out, time.Since(began))
+}
+
+// NewOfflineEngine makes an engine that renders when asked instead of to the sound card,
+// for bouncing to a file.  Events are queued at the sample they should happen on
+func NewOfflineEngine() *Engine {
+	return newEngine(nil)
+}
+
+// Queue schedules an event at a sample on an offline engine's clock
+// queue events as the block they fall in comes up, applying them shifts the rest of the queue
+func (e *Engine) Queue(at int64, ev portmidi.Event) {
+	e.queue.push(at, ev)
+}
+
+// Render renders an offline engine's next len(out) samples
+func (e *Engine) Render(out []fp.Fp32) {
+	e.render(out)
+}
+
+func (e *Engine) SamplingRate() int {
+	return e.samplingRate
+}
@@ -0,0 +1,93 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/rakyll/portmidi"
+)
+
+func TestEventQueueOrder(t *testing.T) {
+	var q eventQueue
+	q.push(10, portmidi.Event{Data1: 1})
+	q.push(5, portmidi.Event{Data1: 2})
+	q.push(10, portmidi.Event{Data1: 3})
+	q.push(0, portmidi.Event{Data1: 4})
+
+	want := []int64{4, 2, 1, 3}
+	for i, ev := range q {
+		if ev.event.Data1 != want[i] {
+			t.Fatalf("event %d is %d, want %d", i, ev.event.Data1, want[i])
+		}
+	}
+	q.drop(3)
+	if len(q) != 1 || q[0].event.Data1 != 3 {
+		t.Errorf("dropping left %v", q)
+	}
+}
+
+func TestSchedulerKeepsSpacing(t *testing.T) {
+	s := scheduler{rate: 1000, latency: 64}
+	if at := s.at(5000, 100); at != 164 {
+		t.Errorf("first event at %d, want 164", at)
+	}
+	// 10ms later is 10 samples later no matter when it's picked up
+	if at := s.at(5010, 128); at != 174 {
+		t.Errorf("second event at %d, want 174", at)
+	}
+	// a late event anchors the clocks again
+	if at := s.at(5020, 500); at != 564 {
+		t.Errorf("late event at %d, want 564", at)
+	}
+}
+
+// a sound card running slow against portmidi doesn't let the latency creep up
+func TestSchedulerFollowsDrift(t *testing.T) {
+	s := scheduler{rate: 1000, latency: 64}
+	s.at(0, 0)
+	for i := int64(1); i < 10000; i++ {
+		// an event every 10ms, but only 9.9ms of audio pulled between them
+		now := i * 99 / 10
+		if at := s.at(portmidi.Timestamp(i*10), now); at < now || at > now+s.latency+driftSlack {
+			t.Fatalf("event %d at %d, picked up at %d", i, at, now)
+		}
+	}
+}
+
+// a note starts on its sample, not at the start of the block it's in
+func TestSampleAccurateNotes(t *testing.T) {
+	render := func() []fp.Fp32 {
+		e := newEngine(nil)
+		e.queue.push(200, portmidi.Event{Status: NoteOn << 4, Data1: 60, Data2: 100})
+		out := make([]fp.Fp32, 0, 4*BUFFER_LEN)
+		buf := make([]fp.Fp32, BUFFER_LEN)
+		for i := 0; i < 4; i++ {
+			e.render(buf)
+			out = append(out, buf...)
+		}
+		return out
+	}
+
+	out := render()
+	for i, s := range out[:200] {
+		if s != 0 {
+			t.Fatalf("sample %d is %d before the note's started", i, s)
+		}
+	}
+	sounding := false
+	for _, s := range out[200:] {
+		if s != 0 {
+			sounding = true
+		}
+	}
+	if !sounding {
+		t.Fatalf("the note never sounded")
+	}
+
+	again := render()
+	for i := range out {
+		if out[i] != again[i] {
+			t.Fatalf("rendering again differs at sample %d", i)
+		}
+	}
+}
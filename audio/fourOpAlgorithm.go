@@ -19,24 +19,26 @@ var algorithms []algorithmVector
 
 type fourOpAlgorithm struct {
 	voiceId      patch.ParamId
-	algNum       patch.Param
+	algNum       *patch.ByteParam
 	A, B1, B2, C *operator
-	envA, envB   *adeEnvelope
-	oprMix       patch.Param
+	envA, envB   *indexEnvelope
+	oprMix       *smoothedParam
 
-	freq fp.Fp32
+	pitch fp.Fp32 // of the note
+	bend  fp.Fp32 // ratio to bend it by
+	freq  fp.Fp32 // what's played, the two together
 }
 
 func (a *fourOpAlgorithm) applyPatch(p *patch.Patch) {
 	a.algNum = p.ByteParam(patch.PATCH_ALGORITHM)
-	algorithms[a.algNum.Value().(byte)].applyPatch(a, p)
+	algorithms[a.algNum.Byte()].applyPatch(a, p)
 	a.A.applyPatch(p)
 	a.B1.applyPatch(p)
 	a.B2.applyPatch(p)
 	a.C.applyPatch(p)
 	a.envA.applyPatch(p)
 	a.envB.applyPatch(p)
-	a.oprMix = p.Fp32Param(patch.PATCH_MIX)
+	a.oprMix = smoothed(p, patch.PATCH_MIX)
 }
 
 func init() {
@@ -61,11 +63,11 @@ func init() {
 				b1Val := a.B1.rotate(a.freq, b2Val).Mul(a.envB.ScaledIndex())
 				cMod := (aVal + b1Val) >> 1 // todo: is this atten necessary/desirable?
 				cVal := a.C.rotate(a.freq, cMod)
-				out[i] = crossMix(cVal, b1Val, a.oprMix.Value().(fp.Fp32))
+				out[i] = crossMix(cVal, b1Val, a.oprMix.Value())
 			}
 		},
 		applyPatch: func(a *fourOpAlgorithm, p *patch.Patch) {
-			a.A.feedback = p.Fp32Param(patch.PATCH_FEEDBACK)
+			a.A.feedback = smoothed(p, patch.PATCH_FEEDBACK)
 		},
 	}
 
@@ -80,11 +82,11 @@ func init() {
 				x := a.C.rotate(a.freq, aVal)
 				b2Val := a.B2.rotate(a.freq, 0)
 				y := a.B1.rotate(a.freq, b2Val).Mul(a.envB.ScaledIndex())
-				out[i] = crossMix(x, y, a.oprMix.Value().(fp.Fp32))
+				out[i] = crossMix(x, y, a.oprMix.Value())
 			}
 		},
 		applyPatch: func(a *fourOpAlgorithm, p *patch.Patch) {
-			a.B2.feedback = p.Fp32Param(patch.PATCH_FEEDBACK)
+			a.B2.feedback = smoothed(p, patch.PATCH_FEEDBACK)
 		},
 	}
 
@@ -100,11 +102,11 @@ func init() {
 				b1Val := a.B1.rotate(a.freq, aVal).Mul(a.envB.ScaledIndex())
 				cVal := a.C.rotate(a.freq, aVal)
 				x := (cVal + b1Val) >> 1
-				out[i] = crossMix(x, y, a.oprMix.Value().(fp.Fp32))
+				out[i] = crossMix(x, y, a.oprMix.Value())
 			}
 		},
 		applyPatch: func(a *fourOpAlgorithm, p *patch.Patch) {
-			a.A.feedback = p.Fp32Param(patch.PATCH_FEEDBACK)
+			a.A.feedback = smoothed(p, patch.PATCH_FEEDBACK)
 		},
 	}
 }
@@ -123,19 +125,55 @@ func crossMix(a, b, mix fp.Fp32) fp.Fp32 {
 }
 
 func (a *fourOpAlgorithm) Render(out []fp.Fp32) {
-	algorithms[a.algNum.Value().(byte)].render(a, out)
+	algorithms[a.algNum.Byte()].render(a, out)
 }
 
-func (a *fourOpAlgorithm) Trigger(pitch fp.Fp32, velocity byte) {
-	a.freq = pitch
-	a.envA.Trigger()
-	a.envB.Trigger()
+func (a *fourOpAlgorithm) Trigger(note byte, pitch fp.Fp32, velocity byte) {
+	a.pitch = pitch
+	a.bendPitch()
+	a.setKey(note)
+	a.envA.Trigger(note)
+	a.envB.Trigger(note)
 }
 
-func (a *fourOpAlgorithm) Retrigger(pitch fp.Fp32) {
-	a.freq = pitch
-	a.envA.Retrigger()
-	a.envB.Retrigger()
+func (a *fourOpAlgorithm) Retrigger(note byte, pitch fp.Fp32) {
+	a.pitch = pitch
+	a.bendPitch()
+	a.setKey(note)
+	a.envA.Retrigger(note)
+	a.envB.Retrigger(note)
+}
+
+// modulate bends the pitch by a ratio and adds to both modulation indexes
+func (a *fourOpAlgorithm) modulate(bend, index fp.Fp32) {
+	if bend != a.bend {
+		a.bend = bend
+		a.bendPitch()
+	}
+	a.envA.mod = index
+	a.envB.mod = index
+}
+
+// the highest pitch we'll bend to, the operators' phase can only move so far a sample
+const maxBentPitch = 20000 << 16
+
+func (a *fourOpAlgorithm) bendPitch() {
+	if a.bend == 1<<16 {
+		a.freq = a.pitch
+		return
+	}
+	f := int64(a.pitch) * int64(a.bend) >> 16
+	if f > maxBentPitch {
+		f = maxBentPitch
+	}
+	a.freq = fp.Fp32(f)
+}
+
+func (a *fourOpAlgorithm) setKey(note byte) {
+	a.A.setKey(note)
+	a.B1.setKey(note)
+	a.B2.setKey(note)
+	a.C.setKey(note)
 }
 
 func (a *fourOpAlgorithm) Release() {
@@ -150,7 +188,8 @@ func newFourOpAlgorithm(vId patch.ParamId) algorithm {
 		B1:      Operator(patch.GRP_B1),
 		B2:      Operator(patch.GRP_B2),
 		C:       Operator(patch.GRP_C),
-		envA:    AdeEnvelope(patch.GRP_A),
-		envB:    AdeEnvelope(patch.GRP_B),
+		envA:    IndexEnvelope(patch.GRP_A, EnvelopeSelector(AdeEnvelope(patch.GRP_A), RateLevelEnvelope(patch.GRP_A))),
+		envB:    IndexEnvelope(patch.GRP_B, EnvelopeSelector(AdeEnvelope(patch.GRP_B), RateLevelEnvelope(patch.GRP_B))),
+		bend:    1 << 16,
 	}
 }
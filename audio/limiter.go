@@ -0,0 +1,171 @@
+package audio
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// Dynamics configures the master bus stage that sits between the voice mixer
+// and the 16 bit output.  The mix is boosted by Makeup, optionally driven
+// through a soft saturator, then a lookahead peak limiter holds it under Ceiling
+type Dynamics struct {
+	Makeup    float64 // linear gain applied to the mix, 1.0 is unity
+	Ceiling   float64 // peak output level, 1.0 is full scale
+	Lookahead time.Duration
+	Release   time.Duration
+	Saturate  bool
+}
+
+// the mixer attenuates each voice by 1/NUM_VOICES so a full chord can't overflow,
+// making back sqrt(NUM_VOICES) puts a single note at a sensible level and leaves
+// the limiter to deal with the peaks when many voices stack up
+var DefaultDynamics = Dynamics{
+	Makeup:    math.Sqrt(NUM_VOICES),
+	Ceiling:   0.98,
+	Lookahead: 2 * time.Millisecond,
+	Release:   150 * time.Millisecond,
+	Saturate:  false,
+}
+
+type limiter struct {
+	from Output
+
+	makeup   fp.Fp32
+	ceiling  fp.Fp32
+	attack   fp.Fp32 // per-sample coefficients for the gain follower
+	release  fp.Fp32
+	saturate bool
+
+	// the delay line holds the samples we've looked ahead at, and
+	// required holds the gain each of them needs to stay under the ceiling
+	delay    []fp.Fp32
+	required []fp.Fp32
+	pos      int
+	gain     fp.Fp32
+
+	pending atomic.Value // *Dynamics waiting to be picked up by the render thread
+}
+
+func MasterLimiter(from Output, d Dynamics) *limiter {
+	l := &limiter{
+		from: from,
+		gain: 1 << 16,
+	}
+	l.configure(d)
+	return l
+}
+
+// SetDynamics can be called from any goroutine, the new settings
+// take effect at the start of the next rendered buffer
+func (l *limiter) SetDynamics(d Dynamics) {
+	l.pending.Store(&d)
+}
+
+func (l *limiter) configure(d Dynamics) {
+	lookahead := int(d.Lookahead.Seconds() * SAMPLING_RATE)
+	if lookahead < 1 {
+		lookahead = 1
+	}
+	releaseSamples := d.Release.Seconds() * SAMPLING_RATE
+	if releaseSamples < 1 {
+		releaseSamples = 1
+	}
+
+	l.makeup = fp.Float2Fp32(d.Makeup)
+	l.ceiling = fp.Float2Fp32(d.Ceiling)
+	if l.ceiling <= 0 || l.ceiling > 1<<16 {
+		l.ceiling = 1 << 16
+	}
+	l.saturate = d.Saturate
+	// the attack has to get most of the way to the required gain before
+	// the peak comes out of the delay line, a quarter of the lookahead gets us ~98%
+	l.attack = fp.Float2Fp32(math.Min(1.0, 4.0/float64(lookahead)))
+	l.release = fp.Float2Fp32(1.0 - math.Exp(-1.0/releaseSamples))
+
+	if len(l.delay) != lookahead {
+		l.delay = make([]fp.Fp32, lookahead)
+		l.required = make([]fp.Fp32, lookahead)
+		for i := range l.required {
+			l.required[i] = 1 << 16
+		}
+		l.pos = 0
+	}
+}
+
+func (l *limiter) Render(out []fp.Fp32) {
+	if d, _ := l.pending.Swap((*Dynamics)(nil)).(*Dynamics); d != nil {
+		l.configure(*d)
+	}
+
+	l.from.Render(out)
+
+	for i, s := range out {
+		s = s.Mul(l.makeup)
+		if l.saturate {
+			s = softClip(s)
+		}
+
+		// swap the new sample into the lookahead line and take the oldest one out
+		delayed := l.delay[l.pos]
+		l.delay[l.pos] = s
+		l.required[l.pos] = requiredGain(s, l.ceiling)
+		l.pos++
+		if l.pos >= len(l.delay) {
+			l.pos = 0
+		}
+
+		target := fp.Fp32(1 << 16)
+		for _, r := range l.required {
+			if r < target {
+				target = r
+			}
+		}
+
+		if target < l.gain {
+			l.gain -= (l.gain - target).Mul(l.attack)
+		} else {
+			l.gain += (target - l.gain).Mul(l.release)
+		}
+
+		s = delayed.Mul(l.gain)
+		// the follower is smooth so it can lag a hair behind a very sharp peak,
+		// anything that slips past gets clamped here rather than in To16bit
+		if s > l.ceiling {
+			s = l.ceiling
+		}
+		if s < -l.ceiling {
+			s = -l.ceiling
+		}
+		out[i] = s
+	}
+}
+
+// the gain that brings s down to the ceiling, or unity if it's already under
+func requiredGain(s, ceiling fp.Fp32) fp.Fp32 {
+	if s < 0 {
+		s = -s
+	}
+	if s <= ceiling {
+		return 1 << 16
+	}
+	return fp.Fp32((int64(ceiling) << 16) / int64(s))
+}
+
+// softClip is a rational approximation of tanh, x(27+x²)/(27+9x²)
+// it's within a couple percent of tanh up to |x| = 3 where it reaches 1.0,
+// and we hold it there beyond that
+func softClip(x fp.Fp32) fp.Fp32 {
+	if x >= 3<<16 {
+		return 1 << 16
+	}
+	if x <= -3<<16 {
+		return -1 << 16
+	}
+	x2 := int64(x) * int64(x) >> 16
+	num := int64(x) * (27<<16 + x2)
+	den := 27<<16 + 9*x2
+	return fp.Fp32(num / den)
+}
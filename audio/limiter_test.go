@@ -0,0 +1,67 @@
+package audio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// constantOutput renders the same sample over and over
+type constantOutput fp.Fp32
+
+func (c constantOutput) Render(out []fp.Fp32) {
+	for i := range out {
+		out[i] = fp.Fp32(c)
+	}
+}
+
+func TestLimiterHoldsCeiling(t *testing.T) {
+	d := Dynamics{Makeup: 4.0, Ceiling: 0.9, Lookahead: time.Millisecond, Release: 50 * time.Millisecond}
+	l := MasterLimiter(constantOutput(fp.Float2Fp32(0.75)), d)
+
+	ceiling := fp.Float2Fp32(d.Ceiling)
+	buf := make([]fp.Fp32, BUFFER_LEN)
+	for n := 0; n < 20; n++ {
+		l.Render(buf)
+		for i, s := range buf {
+			if s > ceiling || s < -ceiling {
+				t.Fatalf("buffer %d sample %d: %d exceeds ceiling %d", n, i, s, ceiling)
+			}
+		}
+	}
+	// once the follower has settled we should be sitting right at the ceiling
+	if last := buf[len(buf)-1]; last < ceiling-ceiling/100 {
+		t.Errorf("expected limited output near %d, got %d", ceiling, last)
+	}
+}
+
+func TestLimiterPassesQuietSignal(t *testing.T) {
+	d := Dynamics{Makeup: 1.0, Ceiling: 1.0, Lookahead: time.Millisecond, Release: 50 * time.Millisecond}
+	in := fp.Float2Fp32(0.25)
+	l := MasterLimiter(constantOutput(in), d)
+
+	buf := make([]fp.Fp32, BUFFER_LEN)
+	l.Render(buf)
+	// after the lookahead delay the signal comes out untouched
+	if s := buf[len(buf)-1]; s != in {
+		t.Errorf("expected %d, got %d", in, s)
+	}
+}
+
+func TestSoftClip(t *testing.T) {
+	if softClip(0) != 0 {
+		t.Errorf("softClip(0) = %d", softClip(0))
+	}
+	prev := softClip(-4 << 16)
+	for x := fp.Fp32(-4 << 16); x <= 4<<16; x += 1 << 10 {
+		y := softClip(x)
+		if y < prev {
+			t.Fatalf("softClip not monotonic at %d: %d < %d", x, y, prev)
+		}
+		if y > 1<<16 || y < -1<<16 {
+			t.Fatalf("softClip(%d) = %d out of range", x, y)
+		}
+		prev = y
+	}
+}
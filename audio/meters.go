@@ -0,0 +1,78 @@
+package audio
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// how fast the peak meter falls back once the peak has passed, a peak is
+// still visible to something looking at the meters a few times a second
+const peakFall = 20.0 // dB per second
+
+// Meters are the engine's levels, read from any goroutine
+type Meters struct {
+	Peak      float64 `json:"peak"`      // 0-1, held and falling off slowly
+	RMS       float64 `json:"rms"`       // 0-1, over the last buffer
+	Reduction float64 `json:"reduction"` // the master limiter's gain, 1 when it isn't limiting
+	Notes     int     `json:"notes"`     // voices with a note held
+	Load      float64 `json:"load"`      // render time over the buffer's duration
+}
+
+// the render loop's half of the meters, published as float64 bits so they can be
+// read without locking
+type meters struct {
+	peak      float64 // only touched by the render loop
+	published [5]uint64
+}
+
+// called by the render loop after each buffer
+func (e *Engine) meter(out []fp.Fp32, took time.Duration) {
+	if len(out) == 0 {
+		return
+	}
+	var peak, sum float64
+	for _, s := range out {
+		v := math.Abs(float64(s) / (1 << 16))
+		peak = math.Max(peak, v)
+		sum += v * v
+	}
+	duration := float64(len(out)) / float64(e.samplingRate)
+	m := &e.meters
+	m.peak = math.Max(peak, m.peak*math.Pow(10, -peakFall*duration/20))
+
+	notes := 0
+	for _, v := range e.voices {
+		if len(v.notesOn) > 0 {
+			notes++
+		}
+	}
+
+	values := [5]float64{
+		m.peak,
+		math.Sqrt(sum / float64(len(out))),
+		float64(e.master.gain) / (1 << 16),
+		float64(notes),
+		took.Seconds() / duration,
+	}
+	for i, v := range values {
+		atomic.StoreUint64(&m.published[i], math.Float64bits(v))
+	}
+}
+
+// Meters reads the levels as of the last buffer rendered
+func (e *Engine) Meters() Meters {
+	var values [5]float64
+	for i := range values {
+		values[i] = math.Float64frombits(atomic.LoadUint64(&e.meters.published[i]))
+	}
+	return Meters{
+		Peak:      values[0],
+		RMS:       values[1],
+		Reduction: values[2],
+		Notes:     int(values[3]),
+		Load:      values[4],
+	}
+}
@@ -0,0 +1,40 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/rakyll/portmidi"
+)
+
+func TestMeters(t *testing.T) {
+	e := newEngine(nil)
+	buf := make([]fp.Fp32, BUFFER_LEN)
+	e.render(buf)
+	if m := e.Meters(); m.Peak != 0 || m.RMS != 0 || m.Notes != 0 {
+		t.Errorf("silence metered as %+v", m)
+	}
+
+	e.queue.push(e.clock, portmidi.Event{Status: NoteOn << 4, Data1: 60, Data2: 127})
+	for i := 0; i < 20; i++ {
+		e.render(buf)
+	}
+	m := e.Meters()
+	if m.Peak <= 0 || m.RMS <= 0 || m.RMS > m.Peak || m.Notes != 1 {
+		t.Errorf("a note metered as %+v", m)
+	}
+	if m.Reduction <= 0 || m.Reduction > 1 {
+		t.Errorf("limiter gain is %f", m.Reduction)
+	}
+
+	// the peak holds on after the note's gone, falling slowly
+	e.queue.push(e.clock, portmidi.Event{Status: NoteOff << 4, Data1: 60})
+	e.render(buf)
+	for i := 0; i < 2000 && e.Meters().RMS > 0; i++ {
+		e.render(buf)
+	}
+	after := e.Meters()
+	if after.Notes != 0 || after.Peak <= 0 || after.Peak >= m.Peak {
+		t.Errorf("after the note %+v, peak was %f", after, m.Peak)
+	}
+}
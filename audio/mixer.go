@@ -20,6 +20,7 @@ type Mixer interface {
 type levelMixer struct {
 	Inputs []*mixerChannel
 	wg     sync.WaitGroup
+	bufs   [][]fp.Fp32 // one per input, kept between blocks so rendering doesn't allocate
 }
 
 func LevelMixer(inputs int) *levelMixer {
@@ -39,9 +40,15 @@ func LevelMixer(inputs int) *levelMixer {
 }
 
 func (m *levelMixer) Render(out []fp.Fp32) {
-	bufs := make([][]fp.Fp32, len(m.Inputs))
+	if len(m.bufs) != len(m.Inputs) || (len(m.bufs) > 0 && cap(m.bufs[0]) < len(out)) {
+		m.bufs = make([][]fp.Fp32, len(m.Inputs))
+		for i := range m.bufs {
+			m.bufs[i] = make([]fp.Fp32, len(out))
+		}
+	}
+	bufs := m.bufs
 	for i, channel := range m.Inputs {
-		bufs[i] = make([]fp.Fp32, len(out))
+		bufs[i] = bufs[i][:len(out)]
 		channel.from.Render(bufs[i])
 	}
 	for i := range out {
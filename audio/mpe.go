@@ -0,0 +1,149 @@
+package audio
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+/*
+	MIDI Polyphonic Expression.
+
+	An MPE controller plays each note on a channel of its own so every note can have its
+	own pitch bend, pressure and timbre (CC74).  These member channels belong to a zone
+	whose master channel carries what applies to all of them: the lower zone's master is
+	channel 1 with members counting up from 2, the upper zone's is 16 with members
+	counting down from 15.  A controller sets the zones up with the MPE configuration
+	message, RPN 6 on a master channel with the number of members as its value, or they
+	can be set with SetMPE.
+
+	Every voice follows the bend and pressure of the channel its note came in on, so they
+	work per channel for ordinary controllers as well.  A member channel's bend reaches
+	PATCH_BEND_RANGE, 48 semitones by default like the spec asks, and its notes follow
+	their master's bend and pressure on top of their own.  Other channels bend 2 semitones
+	until they're told otherwise with RPN 0.
+
+	The patch decides what pressure and timbre do: PATCH_PRESSURE_LEVEL, PATCH_PRESSURE_INDEX
+	and PATCH_TIMBRE_INDEX.
+*/
+
+const defaultBendRange = 2
+
+// a channel's expression, as it was last sent
+type expression struct {
+	bend     fp.Fp32 // -1-1
+	pressure fp.Fp32 // 0-1
+	timbre   fp.Fp32 // -1-1
+}
+
+// SetMPE sets how many member channels the lower and upper zones have, 0 turns a zone off
+// the zones share channels 2-15, the lower one wins if they overlap
+func (e *Engine) SetMPE(lower, upper int) {
+	lower = clampInt(lower, 0, 15)
+	upper = clampInt(upper, 0, 15-lower)
+	atomic.StoreUint32(&e.mpe, uint32(lower)|uint32(upper)<<8)
+}
+
+func (e *Engine) mpeZones() (lower, upper int) {
+	z := atomic.LoadUint32(&e.mpe)
+	return int(z & 0xFF), int(z >> 8)
+}
+
+// the master channel of the zone a channel is a member of
+func (e *Engine) mpeMaster(channel byte) (master byte, member bool) {
+	lower, upper := e.mpeZones()
+	switch {
+	case lower > 0 && channel >= 1 && int(channel) <= lower:
+		return 0, true
+	case upper > 0 && channel <= 14 && int(channel) >= 15-upper:
+		return 15, true
+	}
+	return 0, false
+}
+
+func (e *Engine) handleBend(channel byte, lsb, msb byte) {
+	v := int(msb)<<7 | int(lsb)
+	e.expression[channel].bend = fp.Fp32((v - 0x2000) << 16 / 0x2000)
+	e.express(channel)
+}
+
+func (e *Engine) handlePressure(channel byte, v byte) {
+	e.expression[channel].pressure = fp.Fp32(int(v) << 16 / 127)
+	e.express(channel)
+}
+
+func (e *Engine) handleTimbre(channel byte, v byte) {
+	e.expression[channel].timbre = fp.Fp32(clampInt((int(v)-64)<<16/63, -1<<16, 1<<16))
+	e.express(channel)
+}
+
+func (e *Engine) handleRPN(t *track, channel byte, ctl midi.Control) {
+	if ctl.Delta != 0 {
+		return
+	}
+	switch ctl.Number {
+	case midi.RPN_MPE_CONFIGURATION:
+		members := int(ctl.Value >> 7)
+		lower, upper := e.mpeZones()
+		switch channel {
+		case 0:
+			e.SetMPE(members, upper)
+		case 15:
+			// a new upper zone takes its channels from the lower one
+			e.SetMPE(clampInt(lower, 0, 14-members), members)
+		}
+	case midi.RPN_PITCH_BEND_SENSITIVITY:
+		semitones := float64(ctl.Value>>7) + float64(ctl.Value&0x7F)/100
+		if _, member := e.mpeMaster(channel); member {
+			t.patch.Uint16Param(patch.PATCH_BEND_RANGE).Set(uint16(ctl.Value >> 7))
+		} else {
+			e.bendRange[channel] = semitones
+		}
+	}
+}
+
+// passes a channel's new expression on to the voices playing on it, or for a master
+// channel to all of its zone's voices
+func (e *Engine) express(channel byte) {
+	for _, v := range e.voices {
+		if v.channel == channel {
+			e.expressVoice(v)
+		} else if master, member := e.mpeMaster(v.channel); member && master == channel {
+			e.expressVoice(v)
+		}
+	}
+}
+
+func (e *Engine) expressVoice(v *Voice) {
+	ex := e.expression[v.channel]
+	var semitones float64
+	if master, member := e.mpeMaster(v.channel); member {
+		semitones = fpFloat(ex.bend) * float64(v.track.patch.Uint16Param(patch.PATCH_BEND_RANGE).Uint16())
+		m := e.expression[master]
+		semitones += fpFloat(m.bend) * e.bendRange[master]
+		ex.pressure = fp.Fp32(clampInt(int(ex.pressure+m.pressure), 0, 1<<16))
+	} else {
+		semitones = fpFloat(ex.bend) * e.bendRange[v.channel]
+	}
+
+	v.bend = fp.Float2Fp32(math.Pow(2, semitones/12))
+	v.pressure = ex.pressure
+	v.timbre = ex.timbre
+}
+
+func fpFloat(v fp.Fp32) float64 {
+	return float64(v) / float64(1<<16)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
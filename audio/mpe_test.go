@@ -0,0 +1,60 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+func cc(channel, num, val byte) portmidi.Event {
+	return portmidi.Event{Status: int64(CC<<4 | channel), Data1: int64(num), Data2: int64(val)}
+}
+
+func TestMPE(t *testing.T) {
+	e := newEngine(nil)
+
+	// the controller configures a lower zone with 15 members
+	for _, ev := range []portmidi.Event{
+		cc(0, midi.CC_RPN_MSB, 0), cc(0, midi.CC_RPN_LSB, midi.RPN_MPE_CONFIGURATION), cc(0, midi.CC_DATA_ENTRY, 15),
+	} {
+		e.handleEvent(ev)
+	}
+	if lower, upper := e.mpeZones(); lower != 15 || upper != 0 {
+		t.Fatalf("zones are %d and %d members", lower, upper)
+	}
+
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 1, Data1: 60, Data2: 100})
+	e.handleEvent(portmidi.Event{Status: NoteOn<<4 | 2, Data1: 64, Data2: 100})
+	v1, v2 := e.voiceMap[voiceKey{1, 60}], e.voiceMap[voiceKey{2, 64}]
+	if v1 == nil || v2 == nil || v1 == v2 {
+		t.Fatalf("notes didn't get voices of their own")
+	}
+
+	// a full bend up on the first note's channel is 48 semitones, four octaves
+	e.handleEvent(portmidi.Event{Status: PitchBend<<4 | 1, Data1: 0x7F, Data2: 0x7F})
+	if ratio := fpFloat(v1.bend); ratio < 15.9 || ratio > 16 {
+		t.Errorf("bent by %f, want 16", ratio)
+	}
+	if v2.bend != 1<<16 {
+		t.Errorf("the other note bent too")
+	}
+
+	// pressure and timbre are per note too
+	e.handleEvent(portmidi.Event{Status: ChannelPressure<<4 | 2, Data1: 127})
+	e.handleEvent(cc(2, midi.CC_MPE_TIMBRE, 0))
+	if v2.pressure != 1<<16 || v2.timbre != -1<<16 || v1.pressure != 0 || v1.timbre != 0 {
+		t.Errorf("pressure %x and timbre %x on the second note, %x and %x on the first", v2.pressure, v2.timbre, v1.pressure, v1.timbre)
+	}
+	// and timbre on a member channel isn't a controller for the patch
+	if e.CurrentPatch().GetParam(patch.PATCH_TIMBRE_INDEX).ValAsCC() != 64 {
+		t.Errorf("timbre changed a param")
+	}
+
+	// the master channel bends every note in the zone, by its own 2 semitones
+	e.handleEvent(portmidi.Event{Status: PitchBend<<4 | 0, Data1: 0x00, Data2: 0x00})
+	if ratio := fpFloat(v2.bend); ratio < 0.89 || ratio > 0.9 {
+		t.Errorf("master bend took the second note to %f, want 0.891", ratio)
+	}
+}
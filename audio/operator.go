@@ -12,56 +12,158 @@ var sineTable = makeSineTable(SAMPLING_RATE)
 // an operator is a single oscillator that can be phase modulated
 type operator struct {
 	group    patch.ParamId
-	ratio    patch.Param
-	feedback patch.Param
-	phase    fp.Fp32
+	ratio    *smoothedParam
+	feedback *smoothedParam
+	waveform *patch.ByteParam
+
+	// in fixed mode the operator ignores the note and runs at freq
+	fixed     *patch.BoolParam
+	fixedFreq *smoothedParam
+	detune    *patch.Fp32Param // in cents
+
+	// pow() is too expensive to call per sample, so we cache
+	// the detune multiplier and recompute it when the param moves
+	lastDetune fp.Fp32
+	detuneMul  fp.Fp32
+
+	// keyboard level scaling, the curve is evaluated once per note into keyScale
+	lsBreak  *patch.ByteParam
+	lsLDepth *patch.Fp32Param
+	lsRDepth *patch.Fp32Param
+	lsLCurve *patch.ByteParam
+	lsRCurve *patch.ByteParam
+	keyScale fp.Fp32
+
+	// 16.16 like the frequencies that drive it, so pitches between whole Hz aren't lost.
+	// it's wider than an Fp32 because a second of table at 16.16 doesn't fit in one
+	phase int64
 }
 
+// one cycle of the tables, in the phase's 16.16
+const phasePeriod = int64(SAMPLING_RATE) << 16
+
 func Operator(group patch.ParamId) *operator {
-	return &operator{group: group}
+	return &operator{group: group, detuneMul: 1 << 16, keyScale: 1 << 16}
 }
 
 func (o *operator) applyPatch(p *patch.Patch) {
-	o.ratio = p.Fp32Param(patch.OPR_RATIO | o.group)
+	o.ratio = smoothed(p, patch.OPR_RATIO|o.group)
+	o.waveform = p.ByteParam(patch.OPR_WAVEFORM | o.group)
+	o.fixed = p.BoolParam(patch.OPR_FIXED | o.group)
+	o.fixedFreq = smoothed(p, patch.OPR_FREQ|o.group)
+	o.detune = p.Fp32Param(patch.OPR_DETUNE | o.group)
+	o.lsBreak = p.ByteParam(patch.OPR_LS_BREAK | o.group)
+	o.lsLDepth = p.Fp32Param(patch.OPR_LS_LDEPTH | o.group)
+	o.lsRDepth = p.Fp32Param(patch.OPR_LS_RDEPTH | o.group)
+	o.lsLCurve = p.ByteParam(patch.OPR_LS_LCURVE | o.group)
+	o.lsRCurve = p.ByteParam(patch.OPR_LS_RCURVE | o.group)
+}
+
+// evaluates the keyboard level scaling for a note
+// the operator output is multiplied by the result, which for a modulator
+// is the same as scaling its index
+func (o *operator) setKey(note byte) {
+	breakpoint := int(o.lsBreak.Byte())
+	distance := int(note) - breakpoint
+	depth := o.lsRDepth.Fp32()
+	curve := o.lsRCurve.Byte()
+	if distance < 0 {
+		distance = -distance
+		depth = o.lsLDepth.Fp32()
+		curve = o.lsLCurve.Byte()
+	}
+	o.keyScale = levelScale(distance, depth, curve)
+}
+
+// full depth takes an operator all the way down (or up to double) four octaves from the break,
+// the linear curves get there evenly and the exponential ones hang back and then rush in
+func levelScale(semitones int, depth fp.Fp32, curve byte) fp.Fp32 {
+	if depth == 0 || semitones == 0 {
+		return 1 << 16
+	}
+	span := float64(semitones) / 48.0
+	if curve == patch.CURVE_NEG_EXP || curve == patch.CURVE_POS_EXP {
+		span = (math.Pow(2, 4*span) - 1) / 15.0
+	}
+	amount := math.Min(span, 1.0) * float64(depth) / float64(1<<16)
+	if curve == patch.CURVE_POS_LIN || curve == patch.CURVE_POS_EXP {
+		return fp.Float2Fp32(1.0 + amount)
+	}
+	return fp.Float2Fp32(math.Max(0, 1.0-amount))
+}
+
+func (o *operator) table() []fp.Fp32 {
+	if o.waveform == nil {
+		return sineTable
+	}
+	w := o.waveform.Byte()
+	if int(w) >= len(waveTables) {
+		return sineTable
+	}
+	return waveTables[w]
+}
+
+func (o *operator) detuneMultiplier() fp.Fp32 {
+	cents := o.detune.Fp32()
+	if cents != o.lastDetune {
+		o.lastDetune = cents
+		o.detuneMul = fp.Float2Fp32(math.Pow(2, float64(cents)/float64(1<<16)/1200.0))
+	}
+	return o.detuneMul
 }
 
 // increments the phase based on frequency and returns the next sample
 func (o *operator) rotate(freq, mod fp.Fp32) fp.Fp32 {
-	f := freq.Mul(o.ratio.Value().(fp.Fp32)) + mod
+	var f fp.Fp32
+	if o.fixed.Bool() {
+		f = o.fixedFreq.Value()
+	} else {
+		f = freq.Mul(o.ratio.Value())
+	}
+	f = f.Mul(o.detuneMultiplier()) + mod
+	table := o.table()
 
 	// phase (pitch / table_freq) * (table_len / sampling_rate) I believe
 	// but since our table is 1Hz at sampling_rate, len/rate = 1 and pitch/table = pitch
-	o.phase += f >> 16
-	if o.phase >= SAMPLING_RATE {
-		o.phase -= SAMPLING_RATE
+	o.advance(int64(f))
+	sample := table[o.phase>>16]
+
+	// only the operator the algorithm wires feedback to has it
+	var feedback fp.Fp32
+	if o.feedback != nil {
+		feedback = o.feedback.Value()
 	}
-	if o.phase < 0 {
-		o.phase = 0
+	if feedback != 0 {
+		// now apply feedback
+		o.advance(int64(sample.Mul(feedback)))
+		sample = table[o.phase>>16]
+	}
+	if o.keyScale != 1<<16 {
+		sample = sample.Mul(o.keyScale)
 	}
-	sample := sineTable[o.phase]
+	return sample
+}
 
-	if o.feedback != nil && o.feedback.Value().(fp.Fp32) != 0 {
-		// now apply feedback
-		o.phase += sample.Mul(o.feedback.Value().(fp.Fp32)) >> 16
-		if o.phase >= SAMPLING_RATE {
-			o.phase -= SAMPLING_RATE
-		}
+// moves the phase on by a 16.16 step, wrapping either way round the table
+func (o *operator) advance(step int64) {
+	o.phase += step
+	if o.phase >= phasePeriod || o.phase < 0 {
+		o.phase %= phasePeriod
 		if o.phase < 0 {
-			o.phase = 0
+			o.phase += phasePeriod
 		}
-		sample = sineTable[o.phase]
 	}
-	return sample
 }
 
 // an algorithm is a particular configuration of operators and envelopes
 // that exposes parameter inputs
 type algorithm interface {
-	Trigger(pitch fp.Fp32, velocity byte)
-	Retrigger(pitch fp.Fp32)
+	Trigger(note byte, pitch fp.Fp32, velocity byte)
+	Retrigger(note byte, pitch fp.Fp32)
 	Release()
 	Render(out []fp.Fp32)
 	applyPatch(p *patch.Patch)
+	modulate(bend, index fp.Fp32)
 }
 
 type digitoneFourOpAlgorithm struct {
@@ -1,18 +1,72 @@
 package audio
 
-import "testing"
+import (
+	"testing"
 
-func testPatch() *patch {
-	patch := &patch{
-		params: make(map[paramId]param, 0),
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+func testPatch() *patch.Patch {
+	return patch.InitialPatch()
+}
+
+func TestRotate(t *testing.T) {
+	p := testPatch()
+	p.Fp32Param(patch.OPR_RATIO | patch.GRP_A).Set(1 << 16)
+	op := Operator(patch.GRP_A)
+	op.applyPatch(p)
+
+	// half a Hz gets half way round the table in a second, whole Hz steps never would
+	for i := 0; i < SAMPLING_RATE; i++ {
+		op.rotate(1<<15, 0)
+	}
+	if got := op.phase >> 16; got != SAMPLING_RATE/2 {
+		t.Errorf("phase after a second at 0.5Hz is %d, want %d", got, SAMPLING_RATE/2)
 	}
 
-	patch.addFp32(OPR_RATIO|GRP_A, 1.0)
+	// modulation can push it backwards past the start, it wraps
+	op.phase = 0
+	op.rotate(0, -1<<16)
+	if got := op.phase >> 16; got != SAMPLING_RATE-1 {
+		t.Errorf("phase wrapped backwards to %d", got)
+	}
+}
 
-	return patch
+func TestWaveTables(t *testing.T) {
+	if len(waveTables) != NUM_WAVEFORMS {
+		t.Fatalf("expected %d wave tables, got %d", NUM_WAVEFORMS, len(waveTables))
+	}
+	for w, table := range waveTables {
+		if len(table) != SAMPLING_RATE {
+			t.Errorf("wave %d: table length %d", w, len(table))
+		}
+		for i, s := range table {
+			if s > 1<<16 || s < -1<<16 {
+				t.Fatalf("wave %d: sample %d out of range: %d", w, i, s)
+			}
+		}
+	}
 }
 
-func TestRotate(t *testing.T) {
-	// how the hell do I test this lol
-	//op := Operator(GRP_A)
+func TestLevelScale(t *testing.T) {
+	full := fp.Fp32(1 << 16)
+	half := fp.Fp32(1 << 15)
+
+	if s := levelScale(24, 0, patch.CURVE_NEG_LIN); s != full {
+		t.Errorf("zero depth should leave the level alone, got %d", s)
+	}
+	if s := levelScale(24, full, patch.CURVE_NEG_LIN); s != half {
+		t.Errorf("two octaves at full depth on a linear curve should halve the level, got %d", s)
+	}
+	if s := levelScale(48, full, patch.CURVE_NEG_LIN); s != 0 {
+		t.Errorf("four octaves at full depth should silence, got %d", s)
+	}
+	if s := levelScale(48, full, patch.CURVE_POS_EXP); s != 2*full {
+		t.Errorf("four octaves at full depth on a positive curve should double, got %d", s)
+	}
+	// the exponential curve hangs back near the breakpoint
+	if lin, exp := levelScale(12, full, patch.CURVE_NEG_LIN), levelScale(12, full, patch.CURVE_NEG_EXP); exp <= lin {
+		t.Errorf("expected exponential curve (%d) to be above linear (%d) near the break", exp, lin)
+	}
 }
@@ -0,0 +1,188 @@
+package audio
+
+import (
+	"math"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+// a DX style envelope: four rates and four levels, all 0-99
+// on a trigger it moves to L1 at R1, then L2 at R2, then L3 at R3 where it holds until
+// the gate is released and it moves to L4 at R4.  A fresh envelope starts from L4 like the DX7.
+//
+// like the DX7 the envelope runs in the log domain: levels are about 0.75dB apart
+// and a falling segment is a straight line in dB, which is an exponential decay in amplitude.
+// Rising segments jump up to an audible level first, which gives them the DX's fast attack shape
+//
+// if LOOP_END is after LOOP_START, finishing the LOOP_END stage while the gate is held jumps
+// back to the LOOP_START stage instead of moving on.  With LOOP_FOREVER the release is
+// ignored and it keeps looping
+
+const (
+	rlStages  = 4
+	rlRelease = rlStages - 1 // the stage heading for L4
+	rlHold    = rlStages     // sitting on L3 waiting for the release
+	rlDone    = rlStages + 1
+
+	// levels are 0-99 held in Q24 so the per-sample increments of the slow rates don't vanish
+	rlLevelShift = 24
+	rlMaxLevel   = 99 << rlLevelShift
+
+	// rising segments start from here if they're below it, about -44dB
+	rlAttackJump = 40 << rlLevelShift
+
+	// amplitude table resolution, 16 steps per level
+	rlTableShift = 4
+)
+
+var rlAmplitude = makeRateLevelAmplitudes()
+
+func makeRateLevelAmplitudes() []fp.Fp32 {
+	table := make([]fp.Fp32, 99<<rlTableShift+1)
+	for i := range table {
+		if i == 0 {
+			// level 0 is silence, not just very quiet
+			continue
+		}
+		level := float64(i) / float64(1<<rlTableShift)
+		table[i] = fp.Float2Fp32(math.Pow(10, (level-99)*0.75/20.0))
+	}
+	return table
+}
+
+// per-sample level increment for a rate, following the DX7's rate curve: the 0-99 rate is
+// squeezed to 0-63 and the increment doubles every four steps.  Rate 99 sweeps the full range
+// in about 6ms and rate 0 takes several minutes
+func rlIncrement(rate byte) int32 {
+	if rate > 99 {
+		rate = 99
+	}
+	qrate := uint(rate) * 41 >> 6
+	return int32((27 * (4 + qrate&3)) << (qrate >> 2))
+}
+
+type rateLevelEnvelope struct {
+	group     patch.ParamId
+	rates     [rlStages]*patch.ByteParam
+	levels    [rlStages]*patch.ByteParam
+	loopStart *patch.ByteParam
+	loopEnd   *patch.ByteParam
+	loopMode  *patch.ByteParam
+	rateScale *patch.Fp32Param
+
+	stage     int // 0-2 on the way to L1-L3, then rlHold, rlRelease and rlDone
+	level     int64
+	timeScale fp.Fp32
+	triggered bool
+}
+
+func RateLevelEnvelope(group patch.ParamId) *rateLevelEnvelope {
+	return &rateLevelEnvelope{group: group, stage: rlDone, timeScale: 1 << 16}
+}
+
+func (e *rateLevelEnvelope) applyPatch(p *patch.Patch) {
+	rates := []patch.ParamId{patch.ENV_R1, patch.ENV_R2, patch.ENV_R3, patch.ENV_R4}
+	levels := []patch.ParamId{patch.ENV_L1, patch.ENV_L2, patch.ENV_L3, patch.ENV_L4}
+	for i := 0; i < rlStages; i++ {
+		e.rates[i] = p.ByteParam(rates[i] | e.group)
+		e.levels[i] = p.ByteParam(levels[i] | e.group)
+	}
+	e.loopStart = p.ByteParam(patch.ENV_LOOP_START | e.group)
+	e.loopEnd = p.ByteParam(patch.ENV_LOOP_END | e.group)
+	e.loopMode = p.ByteParam(patch.ENV_LOOP_MODE | e.group)
+	e.rateScale = p.Fp32Param(patch.ENV_RATE_SCALE | e.group)
+}
+
+func (e *rateLevelEnvelope) Trigger(note byte) {
+	if !e.triggered {
+		e.level = e.targetLevel(rlRelease)
+		e.triggered = true
+	}
+	e.stage = 0
+	e.timeScale = keyTimeScale(note, e.rateScale.Fp32())
+}
+
+// the DX doesn't have a retrigger switch, a legato note just carries on
+func (e *rateLevelEnvelope) Retrigger(note byte) {
+}
+
+func (e *rateLevelEnvelope) Release() {
+	if e.looping() == patch.LOOP_FOREVER {
+		return
+	}
+	e.stage = rlRelease
+}
+
+// the loop mode in effect, it takes loop points as well as a mode to loop.  A gated
+// loop ends when the release moves us out of it, Release leaves a forever loop alone
+func (e *rateLevelEnvelope) looping() byte {
+	if e.loopEnd.Byte() <= e.loopStart.Byte() {
+		return patch.LOOP_ONE_SHOT
+	}
+	return e.loopMode.Byte()
+}
+
+func (e *rateLevelEnvelope) targetLevel(stage int) int64 {
+	l := int64(e.levels[stage].Byte())
+	if l > 99 {
+		l = 99
+	}
+	return l << rlLevelShift
+}
+
+func (e *rateLevelEnvelope) Scale(s fp.Fp32) fp.Fp32 {
+	if e.stage < rlStages {
+		// one of the moving stages
+		target := e.targetLevel(e.stage)
+		inc := e.increment(e.stage)
+
+		if target > e.level {
+			if e.level < rlAttackJump && target > rlAttackJump {
+				e.level = rlAttackJump
+			}
+			e.level += inc
+			if e.level >= target {
+				e.level = target
+				e.nextStage()
+			}
+		} else {
+			e.level -= inc
+			if e.level <= target {
+				e.level = target
+				e.nextStage()
+			}
+		}
+	}
+
+	return s.Mul(rlAmplitude[e.level>>(rlLevelShift-rlTableShift)])
+}
+
+// rate scaling shortens the segment times for high notes, so it speeds up the increment
+func (e *rateLevelEnvelope) increment(stage int) int64 {
+	inc := rlIncrement(e.rates[stage].Byte())
+	scaled := (int64(inc) << 16) / int64(e.timeScale)
+	if scaled > rlMaxLevel {
+		scaled = rlMaxLevel
+	}
+	if scaled < 1 {
+		scaled = 1
+	}
+	return scaled
+}
+
+func (e *rateLevelEnvelope) nextStage() {
+	loopStart := int(e.loopStart.Byte())
+	loopEnd := int(e.loopEnd.Byte())
+
+	switch {
+	case e.stage < rlRelease && e.stage == loopEnd && e.looping() != patch.LOOP_ONE_SHOT:
+		e.stage = loopStart
+	case e.stage == rlRelease-1:
+		e.stage = rlHold
+	case e.stage == rlRelease:
+		e.stage = rlDone
+	default:
+		e.stage++
+	}
+}
@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/rakyll/portmidi"
+)
+
+// a recording of what's been played, timed on the sample clock from when it started
+type recording struct {
+	rec    *midi.Recorder
+	params *midi.Feedback // records param changes from elsewhere, if we're doing that
+	start  int64
+	rate   int64
+}
+
+func (r *recording) since(sample int64) time.Duration {
+	return time.Duration((sample - r.start) * int64(time.Second) / r.rate)
+}
+
+func (r *recording) record(at int64, ev portmidi.Event) {
+	r.rec.Record(r.since(at), byte(ev.Status), byte(ev.Data1), byte(ev.Data2), ev.SysEx)
+}
+
+func (e *Engine) currentRecording() *recording {
+	r, _ := e.recording.Load().(*recording)
+	return r
+}
+
+// StartRecording records every midi event the engine plays, until StopRecording.
+// With params the patch's changes from anywhere but midi (the UI, automap, a patch load)
+// are recorded too, as the controllers or NRPNs midi out would send them.  The
+// recording starts with the whole patch so playing it back sets everything up
+func (e *Engine) StartRecording(params bool) {
+	r := &recording{
+		start: atomic.LoadInt64(&e.clock),
+		rate:  int64(e.samplingRate),
+	}
+	r.rec = midi.NewRecorder(func() time.Duration {
+		return r.since(atomic.LoadInt64(&e.clock))
+	})
+	if params {
+		r.params = midi.NewFeedback(r.rec, e.tracks[0].patch)
+		r.params.SendAll()
+	}
+	e.StopRecording()
+	e.recording.Store(r)
+}
+
+// StopRecording returns what's been recorded as a midi file, or nil if we weren't recording
+func (e *Engine) StopRecording() *midi.SMF {
+	r := e.currentRecording()
+	if r == nil {
+		return nil
+	}
+	e.recording.Store((*recording)(nil))
+	if r.params != nil {
+		r.params.Close()
+	}
+	smf := r.rec.SMF()
+	r.rec.Close()
+	if n := r.rec.Dropped(); n > 0 {
+		fmt.Printf("the recording fell behind and dropped %d events\n", n)
+	}
+	return smf
+}
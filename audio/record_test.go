@@ -0,0 +1,72 @@
+package audio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+func TestRecording(t *testing.T) {
+	e := NewOfflineEngine()
+	buf := make([]fp.Fp32, BUFFER_LEN)
+	e.Render(buf)
+
+	e.StartRecording(true)
+	start := e.clock
+	e.Queue(start+SAMPLING_RATE/10, portmidi.Event{Status: 0x90, Data1: 60, Data2: 100})
+	e.Queue(start+SAMPLING_RATE/5, portmidi.Event{Status: 0x80, Data1: 60})
+	for i := 0; i < SAMPLING_RATE/4/BUFFER_LEN; i++ {
+		e.Render(buf)
+	}
+	// as if from the ui, it's recorded by the params feedback's goroutine so wait for it
+	controllers := func() int {
+		n := 0
+		for _, ev := range e.currentRecording().rec.SMF().Timeline() {
+			if ev.Status&0xF0 == 0xB0 {
+				n++
+			}
+		}
+		return n
+	}
+	before := controllers()
+	e.CurrentPatch().GetParam(patch.PATCH_ALGORITHM).SetFromCC(127)
+	for deadline := time.Now().Add(time.Second); controllers() == before; {
+		if time.Now().After(deadline) {
+			t.Fatal("the param change was never recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	smf := e.StopRecording()
+	if smf == nil {
+		t.Fatal("nothing recorded")
+	}
+	if e.StopRecording() != nil {
+		t.Errorf("still recording after stopping")
+	}
+
+	var notes []time.Duration
+	params := 0
+	for _, ev := range smf.Timeline() {
+		switch ev.Status & 0xF0 {
+		case 0x90, 0x80:
+			notes = append(notes, ev.Time)
+		case 0xB0:
+			params++
+		}
+	}
+	// the note on and off, to within a tick
+	near := func(d, want time.Duration) bool {
+		return d-want < time.Millisecond && want-d < time.Millisecond
+	}
+	if len(notes) != 2 || !near(notes[0], 100*time.Millisecond) || !near(notes[1], 200*time.Millisecond) {
+		t.Errorf("notes recorded at %v", notes)
+	}
+	// every param up front, then the change
+	if params <= len(e.CurrentPatch().Params()) {
+		t.Errorf("recorded %d param controllers", params)
+	}
+}
@@ -0,0 +1,55 @@
+package audio
+
+import (
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+// a smoothedParam follows an fp32 param, ramping to each new value over the
+// patch's PATCH_SMOOTHING time rather than jumping there.  Without it a CC sweep
+// steps the value 128 times and you can hear every step (zipper noise).
+// Every consumer has its own, and Value() must be called once per sample since
+// the ramp advances on each call.  Discrete params (algorithm, bools) aren't smoothed
+type smoothedParam struct {
+	param *patch.Fp32Param
+	time  *patch.Uint16Param
+
+	target    fp.Fp32
+	current   int64 // Q32, so slow ramps over small changes don't round their step to zero
+	step      int64
+	remaining uint32
+	primed    bool
+}
+
+func smoothed(p *patch.Patch, id patch.ParamId) *smoothedParam {
+	return &smoothedParam{
+		param: p.Fp32Param(id),
+		time:  p.Uint16Param(patch.PATCH_SMOOTHING),
+	}
+}
+
+func (s *smoothedParam) Value() fp.Fp32 {
+	target := s.param.Fp32()
+	if !s.primed {
+		// start out where the param is rather than ramping up from zero
+		s.target = target
+		s.current = int64(target) << 16
+		s.primed = true
+	}
+
+	if target != s.target {
+		s.target = target
+		s.remaining = msToSamples(s.time.Uint16(), 1<<16)
+		s.step = ((int64(target) << 16) - s.current) / int64(s.remaining)
+	}
+
+	if s.remaining > 0 {
+		s.remaining--
+		if s.remaining == 0 {
+			s.current = int64(s.target) << 16
+		} else {
+			s.current += s.step
+		}
+	}
+	return fp.Fp32(s.current >> 16)
+}
@@ -0,0 +1,43 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+func TestSmoothedParamRamps(t *testing.T) {
+	p := testPatch()
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+	p.Uint16Param(patch.PATCH_SMOOTHING).Set(10)
+	mix := p.Fp32Param(patch.PATCH_MIX)
+	mix.Set(0)
+
+	s := smoothed(p, patch.PATCH_MIX)
+	if v := s.Value(); v != 0 {
+		t.Fatalf("expected to start at the param value, got %d", v)
+	}
+
+	target := fp.Float2Fp32(1.0)
+	mix.Set(target)
+	// 10ms at 44.1kHz
+	steps := 441
+	prev := fp.Fp32(0)
+	for i := 1; i < steps; i++ {
+		v := s.Value()
+		if v <= prev || v >= target {
+			t.Fatalf("sample %d: expected a rising ramp below the target, got %d after %d", i, v, prev)
+		}
+		prev = v
+	}
+	if v := s.Value(); v != target {
+		t.Fatalf("expected to land on the target after the smoothing time, got %d", v)
+	}
+	if v := s.Value(); v != target {
+		t.Fatalf("expected to stay on the target, got %d", v)
+	}
+}
@@ -0,0 +1,41 @@
+package audio
+
+import (
+	"sync/atomic"
+
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/ianmcmahon/fmsynth/tuning"
+)
+
+// a track is a patch along with the tuning its notes are played in and
+// the midi channels it listens to.  There's only one track right now, but voices
+// look things up through their track so they won't care once there's one per channel
+type track struct {
+	patch    *patch.Patch
+	tuning   atomic.Value // *tuning.Tuning, swapped from outside the audio thread
+	channels uint32       // midi.Channels, atomic for the same reason
+}
+
+func newTrack(p *patch.Patch) *track {
+	t := &track{patch: p}
+	t.setTuning(tuning.Equal(tuning.A4_FREQ))
+	t.setChannels(midi.OMNI)
+	return t
+}
+
+func (t *track) receives(channel byte) bool {
+	return midi.Channels(atomic.LoadUint32(&t.channels)).Has(channel)
+}
+
+func (t *track) setChannels(c midi.Channels) {
+	atomic.StoreUint32(&t.channels, uint32(c))
+}
+
+func (t *track) currentTuning() *tuning.Tuning {
+	return t.tuning.Load().(*tuning.Tuning)
+}
+
+func (t *track) setTuning(tun *tuning.Tuning) {
+	t.tuning.Store(tun)
+}
@@ -1,19 +1,27 @@
 package audio
 
 import (
-	"fmt"
-	"math"
-
 	"github.com/ianmcmahon/fmsynth/fp"
 	"github.com/ianmcmahon/fmsynth/patch"
 )
 
 type Voice struct {
 	id      patch.ParamId
+	track   *track
 	notesOn []byte
+	channel byte // that the notes came in on
 
 	alg algorithm
 	vca envelope
+
+	// expression from the channel, see mpe.go
+	bend     fp.Fp32 // a ratio
+	pressure fp.Fp32 // 0-1
+	timbre   fp.Fp32 // -1-1, centered
+
+	pressureLevel *patch.Fp32Param
+	pressureIndex *patch.Fp32Param
+	timbreIndex   *patch.Fp32Param
 }
 
 func (v *Voice) CurNote() byte {
@@ -24,12 +32,13 @@ func (v *Voice) CurNote() byte {
 }
 
 func (engine *Engine) NewSimpleVoice(id byte) *Voice {
-	vId := patch.ParamId(id) << 8
+	vId := patch.ParamId(id) << 12
 	v := &Voice{
 		id:      vId,
 		notesOn: make([]byte, 0),
 		alg:     newFourOpAlgorithm(vId),
-		vca:     AdsrEnvelope(patch.GRP_VCA),
+		vca:     EnvelopeSelector(AdsrEnvelope(patch.GRP_VCA), RateLevelEnvelope(patch.GRP_VCA)),
+		bend:    1 << 16,
 	}
 
 	return v
@@ -38,23 +47,33 @@ func (engine *Engine) NewSimpleVoice(id byte) *Voice {
 func (v *Voice) applyPatch(p *patch.Patch) {
 	v.alg.applyPatch(p)
 	v.vca.applyPatch(p)
+	v.pressureLevel = p.Fp32Param(patch.PATCH_PRESSURE_LEVEL)
+	v.pressureIndex = p.Fp32Param(patch.PATCH_PRESSURE_INDEX)
+	v.timbreIndex = p.Fp32Param(patch.PATCH_TIMBRE_INDEX)
 }
 
 func (v *Voice) Render(out []fp.Fp32) {
+	v.alg.modulate(v.bend, v.pressureIndex.Fp32().Mul(v.pressure)+v.timbreIndex.Fp32().Mul(v.timbre))
 	v.alg.Render(out)
+
+	// with no pressure the level comes down by the depth, full pressure is full level
+	level := 1<<16 - v.pressureLevel.Fp32().Mul(1<<16-v.pressure)
 	for i, s := range out {
 		out[i] = v.vca.Scale(s)
+		if level != 1<<16 {
+			out[i] = out[i].Mul(level)
+		}
 	}
 }
 
-func (v *Voice) trigger(pitch fp.Fp32, velocity byte) {
-	v.alg.Trigger(pitch, velocity)
-	v.vca.Trigger()
+func (v *Voice) trigger(note byte, pitch fp.Fp32, velocity byte) {
+	v.alg.Trigger(note, pitch, velocity)
+	v.vca.Trigger(note)
 }
 
-func (v *Voice) retrigger(pitch fp.Fp32) {
-	v.alg.Retrigger(pitch)
-	v.vca.Retrigger()
+func (v *Voice) retrigger(note byte, pitch fp.Fp32) {
+	v.alg.Retrigger(note, pitch)
+	v.vca.Retrigger(note)
 }
 
 func (v *Voice) release() {
@@ -73,8 +92,13 @@ func (v *Voice) NoteOn(note, velocity byte) {
 		velocity = 127
 	}
 
+	pitch := v.track.currentTuning().Pitch(note)
+	if pitch == 0 {
+		// unmapped in the current tuning
+		return
+	}
+
 	on := false
-	fmt.Printf("%d: note on: %d: %v\n", v.id, note, v.notesOn)
 	for _, n := range v.notesOn {
 		if n == note {
 			on = true
@@ -85,7 +109,7 @@ func (v *Voice) NoteOn(note, velocity byte) {
 		v.notesOn = append(v.notesOn, note)
 	}
 
-	v.trigger(note2freq(note), velocity)
+	v.trigger(note, pitch, velocity)
 }
 
 func (v *Voice) NoteOff(note byte) {
@@ -97,12 +121,9 @@ func (v *Voice) NoteOff(note byte) {
 	}
 
 	if len(v.notesOn) > 0 {
-		v.retrigger(note2freq(v.notesOn[len(v.notesOn)-1]))
+		last := v.notesOn[len(v.notesOn)-1]
+		v.retrigger(last, v.track.currentTuning().Pitch(last))
 	} else {
 		v.release()
 	}
 }
-
-func note2freq(note byte) fp.Fp32 {
-	return fp.Float2Fp32(math.Pow(2, (float64(note)-69.0)/12.0) * 440.0)
-}
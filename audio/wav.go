@@ -0,0 +1,80 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// WAVWriter writes mono 16 bit samples to a wav file, filling in the sizes
+// in the header when it's closed
+type WAVWriter struct {
+	w       io.WriteSeeker
+	rate    int
+	samples uint32
+	buf     []byte
+	err     error
+}
+
+const wavHeaderLen = 44
+
+func NewWAVWriter(w io.WriteSeeker, rate int) (*WAVWriter, error) {
+	ww := &WAVWriter{w: w, rate: rate}
+	if _, err := w.Write(ww.header()); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+func (ww *WAVWriter) header() []byte {
+	const channels, bits = 1, 16
+	dataLen := ww.samples * channels * bits / 8
+
+	h := make([]byte, wavHeaderLen)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataLen)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], uint32(ww.rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(ww.rate)*channels*bits/8)
+	binary.LittleEndian.PutUint16(h[32:], channels*bits/8)
+	binary.LittleEndian.PutUint16(h[34:], bits)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataLen)
+	return h
+}
+
+func (ww *WAVWriter) Write(samples []fp.Fp32) error {
+	if ww.err != nil {
+		return ww.err
+	}
+	if cap(ww.buf) < len(samples)*2 {
+		ww.buf = make([]byte, len(samples)*2)
+	}
+	b := ww.buf[:len(samples)*2]
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(s.To16bit()))
+	}
+	if _, ww.err = ww.w.Write(b); ww.err == nil {
+		ww.samples += uint32(len(samples))
+	}
+	return ww.err
+}
+
+// Close rewrites the header with the final length, it doesn't close the underlying writer
+func (ww *WAVWriter) Close() error {
+	if ww.err != nil {
+		return ww.err
+	}
+	if _, err := ww.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ww.w.Write(ww.header()); err != nil {
+		return err
+	}
+	_, err := ww.w.Seek(0, io.SeekEnd)
+	return err
+}
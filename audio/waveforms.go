@@ -0,0 +1,119 @@
+package audio
+
+import (
+	"math"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// operator waveforms, the first eight follow the TX81Z's W1-W8
+// the 'squashed' variants are a sign preserving sin², which is
+// the closest simple shape to the narrow lobes of W2
+const (
+	WAVE_SINE           = iota // W1
+	WAVE_SQUASHED_SINE         // W2
+	WAVE_HALF_SINE             // W3, positive lobe then silence
+	WAVE_HALF_SQUASHED         // W4
+	WAVE_PULSE_SINE            // W5, a full sine at double speed in the first half of the cycle
+	WAVE_PULSE_SQUASHED        // W6
+	WAVE_CAMEL_SINE            // W7, two positive lobes in the first half
+	WAVE_CAMEL_SQUASHED        // W8
+	WAVE_ABS_SINE              // OPL style rectified sine
+	WAVE_QUARTER_SINE          // OPL style rising quarter, silence, repeated
+	WAVE_SAW                   // band limited
+	WAVE_SQUARE                // band limited
+	NUM_WAVEFORMS
+)
+
+// the band limited tables get this many harmonics, which keeps them
+// below nyquist for fundamentals up to about 1kHz
+const bandLimitHarmonics = 20
+
+var waveTables = makeWaveTables(SAMPLING_RATE)
+
+func makeWaveTables(tableLength int) [][]fp.Fp32 {
+	tables := make([][]fp.Fp32, NUM_WAVEFORMS)
+
+	sin := func(p float64) float64 { return math.Sin(2 * math.Pi * p) }
+	squashed := func(p float64) float64 {
+		s := sin(p)
+		return s * math.Abs(s)
+	}
+	firstHalf := func(f func(float64) float64) func(float64) float64 {
+		return func(p float64) float64 {
+			if p >= 0.5 {
+				return 0
+			}
+			return f(p)
+		}
+	}
+	doubled := func(f func(float64) float64) func(float64) float64 {
+		return func(p float64) float64 { return f(2 * p) }
+	}
+	abs := func(f func(float64) float64) func(float64) float64 {
+		return func(p float64) float64 { return math.Abs(f(p)) }
+	}
+
+	tables[WAVE_SINE] = sineTable
+	tables[WAVE_SQUASHED_SINE] = makeWaveTable(tableLength, squashed)
+	tables[WAVE_HALF_SINE] = makeWaveTable(tableLength, firstHalf(sin))
+	tables[WAVE_HALF_SQUASHED] = makeWaveTable(tableLength, firstHalf(squashed))
+	tables[WAVE_PULSE_SINE] = makeWaveTable(tableLength, firstHalf(doubled(sin)))
+	tables[WAVE_PULSE_SQUASHED] = makeWaveTable(tableLength, firstHalf(doubled(squashed)))
+	tables[WAVE_CAMEL_SINE] = makeWaveTable(tableLength, firstHalf(abs(doubled(sin))))
+	tables[WAVE_CAMEL_SQUASHED] = makeWaveTable(tableLength, firstHalf(abs(doubled(squashed))))
+	tables[WAVE_ABS_SINE] = makeWaveTable(tableLength, abs(sin))
+	tables[WAVE_QUARTER_SINE] = makeWaveTable(tableLength, func(p float64) float64 {
+		if math.Mod(p, 0.5) >= 0.25 {
+			return 0
+		}
+		return math.Abs(sin(p))
+	})
+	tables[WAVE_SAW] = makeBandLimitedTable(tableLength, func(n int) float64 {
+		// every harmonic, falling off at 1/n
+		return 1.0 / float64(n)
+	})
+	tables[WAVE_SQUARE] = makeBandLimitedTable(tableLength, func(n int) float64 {
+		// odd harmonics only
+		if n%2 == 0 {
+			return 0
+		}
+		return 1.0 / float64(n)
+	})
+
+	return tables
+}
+
+func makeWaveTable(tableLength int, wave func(phase float64) float64) []fp.Fp32 {
+	table := make([]fp.Fp32, tableLength)
+	for i := range table {
+		table[i] = fp.Float2Fp32(wave(float64(i) / float64(tableLength)))
+	}
+	return table
+}
+
+// additive synthesis of the given harmonic amplitudes, with lanczos sigma
+// factors to tame the gibbs ripple, normalized so the peak is full scale
+func makeBandLimitedTable(tableLength int, amplitude func(harmonic int) float64) []fp.Fp32 {
+	wave := make([]float64, tableLength)
+	peak := 0.0
+	for i := range wave {
+		phase := 2 * math.Pi * float64(i) / float64(tableLength)
+		for n := 1; n <= bandLimitHarmonics; n++ {
+			a := amplitude(n)
+			if a == 0 {
+				continue
+			}
+			x := math.Pi * float64(n) / float64(bandLimitHarmonics+1)
+			sigma := math.Sin(x) / x
+			wave[i] += a * sigma * math.Sin(float64(n)*phase)
+		}
+		peak = math.Max(peak, math.Abs(wave[i]))
+	}
+
+	table := make([]fp.Fp32, tableLength)
+	for i, v := range wave {
+		table[i] = fp.Float2Fp32(v / peak)
+	}
+	return table
+}
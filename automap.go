@@ -2,61 +2,265 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/patch"
 	"github.com/rakyll/portmidi"
 )
 
+/*
+	Driver for the Novation ReMOTE SL in automap mode.
+
+	The SL's third port talks to the host: once it's sent the online message the SL
+	hands its controls over to us and we own the LCDs.  The left hand controls edit
+	the current param page:
+
+	  encoders       nudge the page's params, they're relative
+	  sliders        set them absolutely
+	  upper buttons  toggle bools, cycle through enums and reset everything else to its default
+	  lower buttons  jump to pages 1-8
+	  page up/down   previous and next page
+
+	The left LCD shows the params' labels over their values, the right one the page
+	name and the names of the pages the lower buttons select.  Each LCD row is 72
+	characters, eight cells of nine lined up with the controls below it.
+*/
+
 var (
 	automapOnline  = []byte{0xF0, 0x00, 0x20, 0x29, 0x03, 0x03, 0x11, 0x04, 0x03, 0x00, 0x01, 0x01, 0xF7}
 	automapOffline = []byte{0xF0, 0x00, 0x20, 0x29, 0x03, 0x03, 0x11, 0x04, 0x03, 0x00, 0x01, 0x00, 0xF7}
 	automapWrite   = []byte{0xF0, 0x00, 0x20, 0x29, 0x03, 0x03, 0x11, 0x04, 0x7F, 0x00, 0x02, 0x01}
 )
 
+const (
+	automapHostID = 37
+
+	// the controllers the SL sends in automap mode, eight of each
+	slEncoders     = 0x08
+	slSliders      = 0x10
+	slUpperButtons = 0x18
+	slLowerButtons = 0x20
+	slPageUp       = 0x58
+	slPageDown     = 0x59
+
+	// LCD rows: the left display is rows 0 and 1, the right 2 and 3
+	slLabelRow     = 0
+	slValueRow     = 1
+	slPageRow      = 2
+	slPageNamesRow = 3
+
+	slCellWidth = 9
+	slRowWidth  = 8 * slCellWidth
+)
+
+// the parts of a portmidi output stream the driver uses
+type automapOutput interface {
+	WriteSysExBytes(when portmidi.Timestamp, msg []byte) error
+}
+
 type automapper struct {
-	midi       *midiPort
-	automap    *midiPort
-	outStream  *portmidi.Stream
-	eventsChan <-chan portmidi.Event
+	patch *patch.Patch
+	pages *patch.PageSelector
+
+	out  automapOutput
+	page int
+
+	reconnected chan struct{}
+	done        chan struct{}
+	stopped     chan struct{}
 }
 
-func Automapper(midi, automap *midiPort) *automapper {
-	a := &automapper{
-		midi:    midi,
-		automap: automap,
-	}
-	go a.Start()
+// Automapper takes over an SL and starts following the current page of p
+// events and out are the SL's automap port, which carries everything
+func Automapper(events <-chan portmidi.Event, out automapOutput, p *patch.Patch, pages *patch.PageSelector) *automapper {
+	a := newAutomapper(out, p, pages)
+	a.online()
+	go a.run(events, p.Subscribe(), pages.Changes())
 	return a
 }
 
+func newAutomapper(out automapOutput, p *patch.Patch, pages *patch.PageSelector) *automapper {
+	return &automapper{
+		patch:       p,
+		pages:       pages,
+		out:         out,
+		page:        pages.Page(),
+		reconnected: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Reconnected takes the SL over again after it's been unplugged and come back
+func (a *automapper) Reconnected() {
+	select {
+	case a.reconnected <- struct{}{}:
+	default:
+	}
+}
+
+// Close blanks the LCDs and hands the SL back to its own templates
+func (a *automapper) Close() {
+	close(a.done)
+	<-a.stopped
+}
+
 func writeScreen(row, pos byte, msg string, hostID byte) []byte {
-	b := append(automapWrite, []byte{pos, row, 0x04}...)
+	b := make([]byte, 0, len(automapWrite)+len(msg)+4)
+	b = append(b, automapWrite...)
+	b = append(b, pos, row, 0x04)
 	b[8] = hostID
 	b = append(b, []byte(msg)...)
 	b = append(b, 0xF7)
-
-	fmt.Printf("%#v\n", b)
 	return b
 }
 
-func (a *automapper) Start() {
-	in, err := portmidi.NewInputStream(a.automap.in, 1024)
-	if err != nil {
-		panic(err)
+func (a *automapper) online() {
+	a.send(automapOnline)
+	a.showPage(a.page)
+}
+
+func (a *automapper) offline() {
+	for row := byte(slLabelRow); row <= slPageNamesRow; row++ {
+		a.writeRow(row, "")
 	}
-	a.eventsChan = in.Listen()
+	a.send(automapOffline)
+}
 
-	a.outStream, err = portmidi.NewOutputStream(a.automap.out, 1024, 0)
-	if err != nil {
-		panic(err)
+func (a *automapper) run(events <-chan portmidi.Event, updates *patch.Subscription, pageChanges <-chan int) {
+	defer close(a.stopped)
+	for {
+		select {
+		case ev := <-events:
+			a.handleEvent(ev)
+		case id := <-updates.C:
+			a.showValue(id)
+		case n := <-pageChanges:
+			a.showPage(n)
+		case <-a.reconnected:
+			a.online()
+		case <-a.done:
+			updates.Unsubscribe()
+			a.offline()
+			return
+		}
 	}
-	a.outStream.WriteSysExBytes(portmidi.Time(), automapOnline)
+}
 
-	a.outStream.WriteSysExBytes(portmidi.Time(), writeScreen(0, 0, "param 0", 37))
-	a.outStream.WriteSysExBytes(portmidi.Time(), writeScreen(1, 0, "param 1", 37))
-	a.outStream.WriteSysExBytes(portmidi.Time(), writeScreen(2, 3, "param 2", 37))
+func (a *automapper) handleEvent(ev portmidi.Event) {
+	if ev.Status&0xF0 != 0xB0 {
+		return
+	}
+	num, val := byte(ev.Data1), byte(ev.Data2)
 
-	for event := range a.eventsChan {
-		fmt.Printf("automap event: %#v\n", event)
+	switch {
+	case num >= slEncoders && num < slEncoders+8:
+		if id, ok := a.paramAt(int(num - slEncoders)); ok {
+			a.patch.Step(id, encoderDelta(val))
+		}
+	case num >= slSliders && num < slSliders+8:
+		if id, ok := a.paramAt(int(num - slSliders)); ok {
+			a.patch.GetParam(id).SetFromCC(val)
+		}
+	case num >= slUpperButtons && num < slUpperButtons+8:
+		if id, ok := a.paramAt(int(num - slUpperButtons)); ok && val > 0 {
+			a.press(a.patch.GetParam(id))
+		}
+	case num >= slLowerButtons && num < slLowerButtons+8:
+		if n := int(num - slLowerButtons); val > 0 && n < len(patch.Pages) {
+			a.pages.Select(n)
+		}
+	case num == slPageUp && val > 0:
+		a.pages.Next()
+	case num == slPageDown && val > 0:
+		a.pages.Prev()
 	}
+}
+
+// the encoders send how far they've turned, 1-63 clockwise and 127 down to 65 anticlockwise
+func encoderDelta(v byte) int {
+	if v < 64 {
+		return int(v)
+	}
+	return int(v) - 128
+}
+
+func (a *automapper) press(prm patch.Param) {
+	switch prm := prm.(type) {
+	case *patch.BoolParam:
+		prm.Set(!prm.Bool())
+	case *patch.ByteParam:
+		if float64(prm.Byte()) >= prm.Meta().Max() {
+			prm.Set(byte(prm.Meta().Min()))
+		} else {
+			prm.Set(prm.Byte() + 1)
+		}
+	case *patch.Uint16Param:
+		prm.Set(uint16(prm.Meta().Default()))
+	case *patch.Fp32Param:
+		prm.Set(fp.Float2Fp32(prm.Meta().Default()))
+	}
+}
 
+func (a *automapper) paramAt(i int) (patch.ParamId, bool) {
+	params := patch.Pages[a.page].Params
+	if i >= len(params) {
+		return 0, false
+	}
+	return params[i], true
+}
+
+func (a *automapper) showPage(n int) {
+	a.page = n
+	page := patch.Pages[n]
+
+	labels := make([]string, len(page.Params))
+	values := make([]string, len(page.Params))
+	for i, id := range page.Params {
+		prm := a.patch.GetParam(id)
+		labels[i] = prm.Label()
+		values[i] = prm.Format()
+	}
+	a.writeRow(slLabelRow, cells(labels))
+	a.writeRow(slValueRow, cells(values))
+
+	a.writeRow(slPageRow, fmt.Sprintf("PAGE %d/%d  %s", n+1, len(patch.Pages), page.Name))
+	names := make([]string, 0, len(patch.Pages))
+	for _, pg := range patch.Pages {
+		names = append(names, pg.Name)
+	}
+	a.writeRow(slPageNamesRow, cells(names))
+}
+
+// rewrites one value cell if the param is on the page
+func (a *automapper) showValue(id patch.ParamId) {
+	for i, pid := range patch.Pages[a.page].Params {
+		if pid == id {
+			a.send(writeScreen(slValueRow, byte(i*slCellWidth), cell(a.patch.GetParam(id).Format()), automapHostID))
+		}
+	}
+}
+
+func (a *automapper) writeRow(row byte, text string) {
+	a.send(writeScreen(row, 0, fmt.Sprintf("%-*.*s", slRowWidth, slRowWidth, text), automapHostID))
+}
+
+func (a *automapper) send(msg []byte) {
+	if err := a.out.WriteSysExBytes(portmidi.Time(), msg); err != nil {
+		fmt.Printf("error writing to automap: %v\n", err)
+	}
+}
+
+// pads or trims s to fill a cell, leaving a space to separate it from the next
+func cell(s string) string {
+	return fmt.Sprintf("%-*.*s", slCellWidth, slCellWidth-1, s)
+}
+
+func cells(s []string) string {
+	var b strings.Builder
+	for i := 0; i < 8 && i < len(s); i++ {
+		b.WriteString(cell(s[i]))
+	}
+	return b.String()
 }
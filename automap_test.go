@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+type sysexRecorder struct {
+	sent [][]byte
+}
+
+func (r *sysexRecorder) WriteSysExBytes(when portmidi.Timestamp, msg []byte) error {
+	r.sent = append(r.sent, msg)
+	return nil
+}
+
+// the text of each row written, keyed by row
+func (r *sysexRecorder) screen() map[byte]string {
+	rows := make(map[byte]string)
+	for _, msg := range r.sent {
+		if len(msg) > len(automapWrite)+3 && string(msg[:8]) == string(automapWrite[:8]) {
+			pos, row := int(msg[len(automapWrite)]), msg[len(automapWrite)+1]
+			text := string(msg[len(automapWrite)+3 : len(msg)-1])
+			line := []byte(rows[row] + strings.Repeat(" ", slRowWidth-len(rows[row])))
+			copy(line[pos:], text)
+			rows[row] = string(line)
+		}
+	}
+	return rows
+}
+
+func TestWriteScreen(t *testing.T) {
+	msg := writeScreen(1, 9, "hi", automapHostID)
+	want := []byte{0xF0, 0x00, 0x20, 0x29, 0x03, 0x03, 0x11, 0x04, automapHostID, 0x00, 0x02, 0x01, 9, 1, 0x04, 'h', 'i', 0xF7}
+	if string(msg) != string(want) {
+		t.Errorf("expected %x, got %x", want, msg)
+	}
+	// the template isn't touched
+	if automapWrite[8] != 0x7F {
+		t.Error("writeScreen modified the message template")
+	}
+}
+
+func TestAutomapPage(t *testing.T) {
+	p := patch.InitialPatch()
+	pages := &patch.PageSelector{}
+	out := &sysexRecorder{}
+	a := newAutomapper(out, p, pages)
+	a.online()
+
+	screen := out.screen()
+	if !strings.HasPrefix(screen[slLabelRow], "ALG      A        B1") {
+		t.Errorf("unexpected labels %q", screen[slLabelRow])
+	}
+	if !strings.HasPrefix(screen[slPageRow], "PAGE 1/") || len(screen[slPageRow]) != slRowWidth {
+		t.Errorf("unexpected page row %q", screen[slPageRow])
+	}
+
+	// the fifth encoder is the VCA attack on the first page, turned 5 clicks then back 2
+	a.handleEvent(portmidi.Event{Status: 0xB0, Data1: slEncoders + 4, Data2: 5})
+	a.handleEvent(portmidi.Event{Status: 0xB0, Data1: slEncoders + 4, Data2: 126})
+	attack := p.Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA)
+	if attack.Uint16() != 3 {
+		t.Errorf("expected attack of 3ms, got %d", attack.Uint16())
+	}
+	a.showValue(attack.ID())
+	if cell := out.screen()[slValueRow][4*slCellWidth : 5*slCellWidth]; cell != "3 ms     " {
+		t.Errorf("expected the attack cell to show 3 ms, got %q", cell)
+	}
+
+	// a lower button picks a page, and the buttons above the encoders act on it
+	changes := pages.Changes()
+	a.handleEvent(portmidi.Event{Status: 0xB0, Data1: slLowerButtons + 2, Data2: 127})
+	select {
+	case n := <-changes:
+		a.showPage(n)
+	case <-time.After(time.Second):
+		t.Fatal("no page change")
+	}
+	gated := p.BoolParam(patch.ENV_GATED | patch.GRP_A)
+	a.handleEvent(portmidi.Event{Status: 0xB0, Data1: slUpperButtons + 4, Data2: 127})
+	a.handleEvent(portmidi.Event{Status: 0xB0, Data1: slUpperButtons + 4, Data2: 0})
+	if gated.Bool() {
+		t.Error("expected the button to toggle the gate off")
+	}
+	if !strings.Contains(out.screen()[slPageRow], patch.Pages[2].Name) {
+		t.Errorf("expected page row to name %s, got %q", patch.Pages[2].Name, out.screen()[slPageRow])
+	}
+}
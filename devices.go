@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/rakyll/portmidi"
+)
+
+/*
+	midiDevices keeps the midi ports we've been asked for open.
+
+	portmidi only discovers devices when it's initialized, and reinitializing it closes
+	every stream, so a rescan is all or nothing: every port is closed, portmidi restarts,
+	and every port that can be found is opened again.  Each rescan interval that happens
+	if any port we've been asked for isn't open, whether it's failed, been unplugged or
+	was never there to begin with, so one that's plugged in later is picked up.
+
+	While a port stays away the others blink each rescan, and note offs sent while
+	they're closed are lost, so every input is sent all notes off after a rescan.  Some
+	platforms don't report an unplugged device at all, so a port that's gone looks open.
+	rescanAll rescans every interval regardless to bring those back, at the cost of the
+	blink when nothing's wrong.
+
+	Inputs are read here rather than with Stream.Listen, whose goroutine can't be stopped,
+	and forwarded to a channel that stays the same across reopens.  Outputs are a
+	stable writer that drops messages while the device is away.
+*/
+
+const midiPollInterval = 2 * time.Millisecond
+
+type midiPort struct {
+	name string
+	in   portmidi.DeviceID
+	out  portmidi.DeviceID
+}
+
+func midiPorts() map[string]*midiPort {
+	m := make(map[string]*midiPort, 0)
+	for i := 0; i < portmidi.CountDevices(); i++ {
+		info := portmidi.Info(portmidi.DeviceID(i))
+
+		if _, ok := m[info.Name]; !ok {
+			m[info.Name] = &midiPort{name: info.Name, in: -1, out: -1}
+		}
+		if info.IsInputAvailable {
+			m[info.Name].in = portmidi.DeviceID(i)
+		}
+		if info.IsOutputAvailable {
+			m[info.Name].out = portmidi.DeviceID(i)
+		}
+	}
+
+	return m
+}
+
+func listMidiDevices() {
+	ports := midiPorts()
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defIn, defOut := portmidi.DefaultInputDeviceID(), portmidi.DefaultOutputDeviceID()
+	for _, name := range names {
+		p := ports[name]
+		var dirs []string
+		if p.in >= 0 {
+			dir := "in"
+			if p.in == defIn {
+				dir += " (default)"
+			}
+			dirs = append(dirs, dir)
+		}
+		if p.out >= 0 {
+			dir := "out"
+			if p.out == defOut {
+				dir += " (default)"
+			}
+			dirs = append(dirs, dir)
+		}
+		fmt.Printf("%-40s %s\n", name, strings.Join(dirs, ", "))
+	}
+}
+
+type inputPort struct {
+	name string // empty for the default input
+	sink chan<- portmidi.Event
+
+	stream  *portmidi.Stream
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// outputPort is a midi.Writer and automapOutput that survives its device going away
+type outputPort struct {
+	name      string // empty for the default output
+	onConnect func()
+
+	mu     sync.Mutex
+	stream *portmidi.Stream
+	failed bool
+}
+
+func (o *outputPort) WriteShort(status, data1, data2 int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stream == nil {
+		return nil
+	}
+	err := o.stream.WriteShort(status, data1, data2)
+	if err != nil {
+		o.failed = true
+	}
+	return err
+}
+
+func (o *outputPort) WriteSysExBytes(when portmidi.Timestamp, msg []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stream == nil {
+		return nil
+	}
+	err := o.stream.WriteSysExBytes(when, msg)
+	if err != nil {
+		o.failed = true
+	}
+	return err
+}
+
+type midiDevices struct {
+	mu      sync.Mutex
+	inputs  []*inputPort
+	outputs []*outputPort
+	failed  int32 // set when an input's read fails, atomic since the readers can't take mu
+
+	// rescan even when every port's open, for platforms that don't report unplugging
+	rescanAll bool
+
+	stop chan struct{}
+}
+
+func newMidiDevices() *midiDevices {
+	return &midiDevices{stop: make(chan struct{})}
+}
+
+// addInput forwards a device's events to sink once the devices are started
+// name "" is the default input
+func (d *midiDevices) addInput(name string, sink chan<- portmidi.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inputs = append(d.inputs, &inputPort{name: name, sink: sink})
+}
+
+// addOutput returns a writer for a device that's connected once the devices are started
+// name "" is the default output.  onConnect is called each time the device is opened,
+// to bring it up to date
+func (d *midiDevices) addOutput(name string, onConnect func()) *outputPort {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := &outputPort{name: name, onConnect: onConnect}
+	d.outputs = append(d.outputs, out)
+	return out
+}
+
+// start opens every port it can find, and if rescan isn't 0 keeps looking for the rest
+func (d *midiDevices) start(rescan time.Duration) {
+	d.mu.Lock()
+	for _, in := range d.inputs {
+		d.openInput(in)
+	}
+	for _, out := range d.outputs {
+		d.openOutput(out)
+	}
+	d.mu.Unlock()
+
+	if rescan > 0 {
+		go d.rescanEvery(rescan)
+	}
+}
+
+func (d *midiDevices) rescanEvery(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if d.rescanAll || d.needsRescan() {
+				d.rescan()
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *midiDevices) needsRescan() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if atomic.LoadInt32(&d.failed) != 0 {
+		return true
+	}
+	for _, in := range d.inputs {
+		if in.stream == nil {
+			return true
+		}
+	}
+	for _, out := range d.outputs {
+		out.mu.Lock()
+		missing := out.stream == nil || out.failed
+		out.mu.Unlock()
+		if missing {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *midiDevices) rescan() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closeAll()
+	portmidi.Terminate()
+	portmidi.Initialize()
+	atomic.StoreInt32(&d.failed, 0)
+
+	for _, in := range d.inputs {
+		d.openInput(in)
+	}
+	for _, out := range d.outputs {
+		d.openOutput(out)
+	}
+
+	// whatever was released while the inputs were closed has to be released now
+	for _, in := range d.inputs {
+		allNotesOff(in.sink)
+	}
+}
+
+// sends all notes off on every channel, without waiting on a full sink
+func allNotesOff(sink chan<- portmidi.Event) {
+	now := portmidi.Time()
+	for ch := int64(0); ch < 16; ch++ {
+		select {
+		case sink <- portmidi.Event{Timestamp: now, Status: 0xB0 | ch, Data1: midi.CC_ALL_NOTES_OFF}:
+		default:
+			return
+		}
+	}
+}
+
+func (d *midiDevices) close() {
+	close(d.stop)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeAll()
+}
+
+func (d *midiDevices) closeAll() {
+	for _, in := range d.inputs {
+		if in.stream != nil {
+			close(in.done)
+			<-in.stopped
+			in.stream.Close()
+			in.stream = nil
+		}
+	}
+	for _, out := range d.outputs {
+		out.mu.Lock()
+		if out.stream != nil {
+			out.stream.Close()
+			out.stream = nil
+		}
+		out.failed = false
+		out.mu.Unlock()
+	}
+}
+
+func (d *midiDevices) openInput(in *inputPort) {
+	id := portmidi.DefaultInputDeviceID()
+	if in.name != "" {
+		id = -1
+		if p, ok := midiPorts()[in.name]; ok {
+			id = p.in
+		}
+	}
+	if id < 0 {
+		fmt.Printf("midi input %q not found\n", in.name)
+		return
+	}
+
+	stream, err := portmidi.NewInputStream(id, 1024)
+	if err != nil {
+		fmt.Printf("error opening midi input %q: %v\n", in.name, err)
+		return
+	}
+	in.stream = stream
+	in.done = make(chan struct{})
+	in.stopped = make(chan struct{})
+	go d.read(in, stream, in.done, in.stopped)
+}
+
+func (d *midiDevices) read(in *inputPort, stream *portmidi.Stream, done, stopped chan struct{}) {
+	defer close(stopped)
+	tick := time.NewTicker(midiPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-done:
+			return
+		}
+
+		events, err := stream.Read(1024)
+		if err != nil {
+			fmt.Printf("error reading midi input %q: %v\n", in.name, err)
+			atomic.StoreInt32(&d.failed, 1)
+			<-done
+			return
+		}
+		for _, ev := range events {
+			select {
+			case in.sink <- ev:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (d *midiDevices) openOutput(out *outputPort) {
+	id := portmidi.DefaultOutputDeviceID()
+	if out.name != "" {
+		id = -1
+		if p, ok := midiPorts()[out.name]; ok {
+			id = p.out
+		}
+	}
+	if id < 0 {
+		fmt.Printf("midi output %q not found\n", out.name)
+		return
+	}
+
+	stream, err := portmidi.NewOutputStream(id, 1024, 0)
+	if err != nil {
+		fmt.Printf("error opening midi output %q: %v\n", out.name, err)
+		return
+	}
+	out.mu.Lock()
+	out.stream = stream
+	out.failed = false
+	out.mu.Unlock()
+
+	if out.onConnect != nil {
+		out.onConnect()
+	}
+}
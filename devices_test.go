@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/rakyll/portmidi"
+)
+
+func TestRescanForMissingPorts(t *testing.T) {
+	// with nothing asked for there's nothing to look for
+	if newMidiDevices().needsRescan() {
+		t.Errorf("rescanning with no ports")
+	}
+
+	d := newMidiDevices()
+	sink := make(chan portmidi.Event, 16)
+	d.addInput("not plugged in", sink)
+	d.addOutput("nor this", nil)
+	d.start(0)
+	defer d.close()
+
+	// ports that weren't there at startup may be plugged in later
+	if !d.needsRescan() {
+		t.Errorf("not rescanning for ports that haven't been found")
+	}
+
+	d.rescan()
+	for ch := int64(0); ch < 16; ch++ {
+		ev := <-sink
+		if ev.Status != 0xB0|ch || ev.Data1 != midi.CC_ALL_NOTES_OFF {
+			t.Fatalf("expected all notes off on channel %d after a rescan, got %+v", ch+1, ev)
+		}
+	}
+}
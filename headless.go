@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// screenSaver makes an offscreen UI's show func, which keeps a png of the screen in
+// path.  It's written alongside and renamed over, so a reader never sees half a file
+func screenSaver(path string) func(*image.RGBA) {
+	return func(img *image.RGBA) {
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".screen-*.png")
+		if err != nil {
+			fmt.Printf("error writing screen: %v\n", err)
+			return
+		}
+		err = png.Encode(tmp, img)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			fmt.Printf("error writing screen: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScreenSaver(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "screen.png")
+	save := screenSaver(path)
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 2, color.White)
+	save(img)
+	save(img)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	saved, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := saved.At(1, 2).RGBA(); r != 0xFFFF {
+		t.Errorf("saved screen is wrong at 1,2")
+	}
+
+	// nothing's left behind from writing it
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the directory", len(files))
+	}
+}
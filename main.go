@@ -1,79 +1,273 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gordonklaus/portaudio"
 	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/ianmcmahon/fmsynth/osc"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/ianmcmahon/fmsynth/tuning"
 	"github.com/ianmcmahon/fmsynth/ui"
+	"github.com/ianmcmahon/fmsynth/web"
 	"github.com/rakyll/portmidi"
 	wde "github.com/skelterjohn/go.wde"
-	_ "github.com/skelterjohn/go.wde/cocoa"
 )
 
-type midiPort struct {
-	name string
-	in   portmidi.DeviceID
-	out  portmidi.DeviceID
+// a flag that can be repeated, or given a comma separated list
+type nameList []string
+
+func (l *nameList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *nameList) Set(v string) error {
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return nil
 }
 
-func midiPorts() map[string]*midiPort {
-	m := make(map[string]*midiPort, 0)
-	for i := 0; i < portmidi.CountDevices(); i++ {
-		info := portmidi.Info(portmidi.DeviceID(i))
+var (
+	sclFile = flag.String("scl", "", "scala scale file to tune to")
+	kbmFile = flag.String("kbm", "", "scala keyboard mapping for the scale")
+	refA4   = flag.Float64("a4", 0, "reference pitch in Hz (default 440, or the keyboard mapping's reference)")
+	profile = flag.String("profile", "", "controller profile to load, and to save midi learned mappings to")
+	slName  = flag.String("automap", "", "name of a ReMOTE SL to drive in automap mode, e.g. \"ReMOTE ZeRO SL\"")
+
+	listMidi  = flag.Bool("list-midi", false, "list the midi devices and exit")
+	midiOut   = flag.String("out", "", "midi output to echo param changes to, by name, \"default\" for the system's default output")
+	rescan    = flag.Duration("rescan", 2*time.Second, "how often to look for midi devices that are missing or unplugged, 0 for never")
+	rescanAll = flag.Bool("rescan-all", false, "rescan every interval even when every device is open, for systems that don't report a device being unplugged")
+	channels  = flag.String("channels", "omni", "midi channels to play from: omni, a channel like 1, or a list like 1,3,10-12")
+	mpe       = flag.Int("mpe", 0, "member channels in an MPE lower zone, for controllers that don't set it up themselves")
+	midiIns   nameList
+
+	record       = flag.String("record", "", "midi file to save everything played to when the synth exits")
+	recordParams = flag.Bool("record-params", false, "with -record, record param changes made from the UI as controllers too")
+
+	oscAddr  = flag.String("osc", "", "address to listen for OSC on, e.g. 127.0.0.1:9000")
+	patchDir = flag.String("patches", "patches", "directory remote control loads and saves patches in")
+	httpAddr = flag.String("http", "", "address to serve the json and websocket API on, e.g. 127.0.0.1:8080")
 
-		if _, ok := m[info.Name]; !ok {
-			m[info.Name] = &midiPort{name: info.Name}
+	headless   = flag.Bool("headless", !haveWindows, "run without a window, for machines that don't have a window system")
+	screenFile = flag.String("screen", "", "with -headless, keep a png of the UI in this file")
+)
+
+func init() {
+	flag.Var(&midiIns, "in", "midi input to play from, by name, repeat it or separate names with commas to merge several (default the system's default input)")
+}
+
+func loadTuning() (*tuning.Tuning, error) {
+	if *sclFile == "" {
+		if *kbmFile != "" {
+			return nil, fmt.Errorf("-kbm needs a scale to map, use -scl")
 		}
-		if info.IsInputAvailable {
-			m[info.Name].in = portmidi.DeviceID(i)
+		ref := *refA4
+		if ref <= 0 {
+			ref = tuning.A4_FREQ
 		}
-		if info.IsOutputAvailable {
-			m[info.Name].out = portmidi.DeviceID(i)
+		return tuning.Equal(ref), nil
+	}
+
+	scale, err := tuning.LoadScale(*sclFile)
+	if err != nil {
+		return nil, err
+	}
+	var kbm *tuning.KeyboardMap
+	if *kbmFile != "" {
+		if kbm, err = tuning.LoadKeyboardMap(*kbmFile); err != nil {
+			return nil, err
 		}
 	}
+	return tuning.New(scale, kbm, *refA4), nil
+}
+
+// applies a controller profile if there is one yet, and saves the mappings back whenever one is learned
+func useProfile(p *patch.Patch, path string) {
+	pr, err := patch.LoadProfile(path)
+	switch {
+	case err == nil:
+		p.ApplyProfile(pr)
+	case os.IsNotExist(err):
+		// it'll be created by the first learn
+	default:
+		fmt.Printf("error loading controller profile: %v\n", err)
+	}
 
-	return m
+	// learning happens on the render loop, so the saving is done here.  If a few
+	// mappings pile up the save after the last one still has them all
+	learned := make(chan patch.Mapping, 16)
+	p.OnLearn(func(m patch.Mapping) {
+		select {
+		case learned <- m:
+		default:
+		}
+	})
+	go func() {
+		for m := range learned {
+			fmt.Printf("learned cc %d on channel %d for %x\n", m.CC, m.Channel, m.Param)
+			if err := p.Profile().Save(path); err != nil {
+				fmt.Printf("error saving controller profile: %v\n", err)
+			}
+		}
+	}()
 }
 
 func main() {
+	flag.Parse()
+
+	tun, err := loadTuning()
+	if err != nil {
+		fmt.Printf("error loading tuning: %v\n", err)
+		os.Exit(1)
+	}
+
+	recv, err := midi.ParseChannels(*channels)
+	if err != nil {
+		fmt.Printf("error in -channels: %v\n", err)
+		os.Exit(1)
+	}
+
+	setup := func(engine *audio.Engine) {
+		engine.SetTuning(0, tun)
+		engine.SetChannels(0, recv)
+		if *mpe > 0 {
+			engine.SetMPE(*mpe, 0)
+		}
+		if *profile != "" {
+			useProfile(engine.CurrentPatch(), *profile)
+		}
+	}
+
+	if flag.Arg(0) == "play" {
+		if err := play(flag.Args()[1:], setup); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	portaudio.Initialize()
 	defer portaudio.Terminate()
 
 	portmidi.Initialize()
 	defer portmidi.Terminate()
 
-	/*
-		ports := midiPorts()
-		Automapper(ports["ReMOTE ZeRO SL Port 1"], ports["ReMOTE ZeRO SL Port 3"])
+	if *listMidi {
+		listMidiDevices()
+		return
+	}
+
+	devices := newMidiDevices()
+	defer devices.close()
+
+	events := make(chan portmidi.Event, 1024)
+	if len(midiIns) == 0 && portmidi.DefaultInputDeviceID() >= 0 {
+		midiIns = nameList{""}
+	}
+	for _, name := range midiIns {
+		devices.addInput(name, events)
+	}
+	if len(midiIns) == 0 {
+		fmt.Printf("no midi input, use -list-midi to see the devices\n")
+	}
+
+	engine := audio.NewEngine(events)
+	setup(engine)
 
-		for {
+	// echoing is opt in, the default output is often a synth that would play along
+	if *midiOut != "" {
+		name := *midiOut
+		if name == "default" {
+			name = "" // which the devices take as the system's default
 		}
+		var out *outputPort
+		// a controller that's come back needs everything sent again, which SetMidiOut does
+		out = devices.addOutput(name, func() { engine.SetMidiOut(out) })
+	}
 
-		os.Exit(1)
-	*/
+	pages := &patch.PageSelector{}
 
-	var ch <-chan portmidi.Event
+	var automap *automapper
+	if *slName != "" {
+		// the SL's third port is the automap one, its first is ordinary midi which we leave alone
+		port := *slName + " Port 3"
+		slEvents := make(chan portmidi.Event, 1024)
+		devices.addInput(port, slEvents)
+		slOut := devices.addOutput(port, func() {
+			if automap != nil {
+				automap.Reconnected()
+			}
+		})
+		automap = Automapper(slEvents, slOut, engine.CurrentPatch(), pages)
+		defer automap.Close()
+	}
 
-	device := portmidi.DefaultInputDeviceID()
-	in, err := portmidi.NewInputStream(device, 1024)
-	if err != nil {
-		fmt.Printf("error opening midi: %v\n", err)
-	} else {
-		defer in.Close()
+	devices.rescanAll = *rescanAll
+	devices.start(*rescan)
+
+	if *oscAddr != "" {
+		server, err := osc.NewServer(*oscAddr, engine.CurrentPatch(), *patchDir, events)
+		if err != nil {
+			fmt.Printf("error starting osc: %v\n", err)
+		} else {
+			defer server.Close()
+			go server.Serve()
+		}
+	}
 
-		in.SetChannelMask(1)
+	if *httpAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, web.NewServer(engine, *patchDir, events)); err != nil {
+				fmt.Printf("error serving http: %v\n", err)
+			}
+		}()
+	}
 
-		ch = in.Listen()
+	if *record != "" {
+		engine.StartRecording(*recordParams)
 	}
 
-	engine := audio.NewEngine(ch)
+	// an interrupt or a kill shuts down the same way closing the window does
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	// right now the ui needs a pointer to the engine to get at the patch
 	// eventually the ui will be aware of the "tracks" which will have a current patch
-	go ui.Start(engine)
+	if *headless || !haveWindows {
+		if *screenFile != "" {
+			go ui.Offscreen(engine, pages, screenSaver(*screenFile))
+		}
+		fmt.Printf("running headless, ctrl-c to stop\n")
+		sig := <-signals
+		fmt.Printf("%s, stopping\n", sig)
+	} else {
+		go ui.Start(engine, pages)
+		go func() {
+			sig := <-signals
+			fmt.Printf("%s, stopping\n", sig)
+			wde.Stop()
+		}()
+		wde.Run()
+	}
+	signal.Stop(signals)
 
-	wde.Run()
+	if smf := engine.StopRecording(); smf != nil {
+		if err := smf.Save(*record); err != nil {
+			fmt.Printf("error saving recording: %v\n", err)
+		}
+	}
 
 	engine.Stop()
 	fmt.Printf("exiting\n")
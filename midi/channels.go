@@ -0,0 +1,76 @@
+package midi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Channels is the set of midi channels something receives on, bit n is channel n
+// (0-15 on the wire, shown as 1-16)
+type Channels uint16
+
+const OMNI Channels = 0xFFFF
+
+func Channel(n byte) Channels {
+	return 1 << (n & 0x0F)
+}
+
+func (c Channels) Has(n byte) bool {
+	return c&Channel(n) != 0
+}
+
+func (c Channels) String() string {
+	if c == OMNI {
+		return "omni"
+	}
+	var chans []string
+	for n := byte(0); n < 16; n++ {
+		if c.Has(n) {
+			chans = append(chans, strconv.Itoa(int(n)+1))
+		}
+	}
+	return strings.Join(chans, ",")
+}
+
+// ParseChannels reads "omni", a single channel like "1", or a list like "1,3,10-12"
+// channels are numbered 1-16 like they are on the front of a synth
+func ParseChannels(s string) (Channels, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "omni") || strings.EqualFold(s, "all") {
+		return OMNI, nil
+	}
+
+	var c Channels
+	for _, part := range strings.Split(s, ",") {
+		from, to := strings.TrimSpace(part), ""
+		if i := strings.Index(from, "-"); i >= 0 {
+			from, to = strings.TrimSpace(from[:i]), strings.TrimSpace(from[i+1:])
+		} else {
+			to = from
+		}
+		lo, err := parseChannel(from)
+		if err != nil {
+			return 0, err
+		}
+		hi, err := parseChannel(to)
+		if err != nil {
+			return 0, err
+		}
+		if hi < lo {
+			return 0, fmt.Errorf("channel range %q runs backwards", part)
+		}
+		for n := lo; n <= hi; n++ {
+			c |= Channel(n)
+		}
+	}
+	return c, nil
+}
+
+func parseChannel(s string) (byte, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 16 {
+		return 0, fmt.Errorf("%q isn't a midi channel, they're 1-16", s)
+	}
+	return byte(n - 1), nil
+}
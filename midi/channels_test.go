@@ -0,0 +1,25 @@
+package midi
+
+import "testing"
+
+func TestParseChannels(t *testing.T) {
+	for s, want := range map[string]Channels{
+		"omni":      OMNI,
+		"1":         Channel(0),
+		"16":        Channel(15),
+		"1,3,10-12": Channel(0) | Channel(2) | Channel(9) | Channel(10) | Channel(11),
+	} {
+		c, err := ParseChannels(s)
+		if err != nil {
+			t.Errorf("parsing %q: %v", s, err)
+		} else if c != want {
+			t.Errorf("parsing %q got %s, want %s", s, c, want)
+		}
+	}
+
+	for _, s := range []string{"0", "17", "x", "5-2", ""} {
+		if _, err := ParseChannels(s); err == nil {
+			t.Errorf("expected %q not to parse", s)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package midi
+
+// the controller numbers with special meaning for high resolution control
+const (
+	CC_MSB_FIRST = 0  // controllers 0-31 are the MSB of a 14 bit pair
+	CC_LSB_FIRST = 32 // and 32-63 the matching LSB
+	CC_LSB_LAST  = 63
+
+	CC_DATA_ENTRY     = 6
+	CC_DATA_ENTRY_LSB = 38
+	CC_DATA_INCREMENT = 96
+	CC_DATA_DECREMENT = 97
+	CC_NRPN_LSB       = 98
+	CC_NRPN_MSB       = 99
+	CC_RPN_LSB        = 100
+	CC_RPN_MSB        = 101
+
+	RPN_NULL = 0x3FFF // deselects the current parameter, NRPN or RPN
+
+	RPN_PITCH_BEND_SENSITIVITY = 0 // semitones in the MSB and cents in the LSB
+	RPN_MPE_CONFIGURATION      = 6 // sent on a zone's master channel, the MSB is how many member channels it has
+
+	CC_MPE_TIMBRE = 74 // the third dimension of an MPE controller, per note on member channels
+
+	CC_ALL_NOTES_OFF = 123 // releases every note held on the channel
+)
+
+type ControlKind byte
+
+const (
+	ControlChange   ControlKind = iota // a plain 7 bit controller
+	ControlChange14                    // a 14 bit MSB/LSB controller pair, Number is the MSB controller
+	NRPN
+	RPN
+)
+
+// a decoded controller message
+// Value is 7 bits for ControlChange and 14 bits for everything else.
+// Data increment and decrement have a Delta of +/-1 and no Value
+type Control struct {
+	Kind   ControlKind
+	Number uint16
+	Value  uint16
+	Delta  int
+}
+
+// ControlDecoder turns a channel's stream of cc messages into 7 bit, 14 bit and
+// (N)RPN controls.  There should be one per channel since the running state
+// (the selected parameter and the pending MSBs) is per channel in the spec
+//
+// an MSB on its own is scaled up to 14 bits by repeating its bits in the LSB,
+// so a 7 bit controller still reaches both ends of the range.  When the LSB follows
+// straight after it refines the value and the control is delivered again.  An LSB
+// that doesn't follow its MSB is an ordinary 7 bit controller of its own
+type ControlDecoder struct {
+	msb         byte // the value of the last cc, if it was an MSB waiting for its LSB
+	pendingMSB  byte // which MSB that was
+	havePending bool
+
+	param    uint16
+	selected bool
+	isRPN    bool
+	dataMSB  byte
+}
+
+// Decode takes a controller number and value and returns the control they make, if any
+// selecting an (N)RPN doesn't produce anything until its data arrives
+func (d *ControlDecoder) Decode(num, val byte) (Control, bool) {
+	num &= 0x7F
+	val &= 0x7F
+
+	// only the very next cc can be an MSB's LSB
+	pending, havePending := d.pendingMSB, d.havePending
+	d.havePending = false
+
+	switch num {
+	case CC_NRPN_MSB:
+		d.select14(false, uint16(val)<<7|d.param&0x7F)
+		return Control{}, false
+	case CC_NRPN_LSB:
+		d.select14(false, d.param&^0x7F|uint16(val))
+		return Control{}, false
+	case CC_RPN_MSB:
+		d.select14(true, uint16(val)<<7|d.param&0x7F)
+		return Control{}, false
+	case CC_RPN_LSB:
+		d.select14(true, d.param&^0x7F|uint16(val))
+		return Control{}, false
+	}
+
+	if d.selected {
+		switch num {
+		case CC_DATA_ENTRY:
+			d.dataMSB = val
+			return d.parameterControl(expand14(val), 0), true
+		case CC_DATA_ENTRY_LSB:
+			return d.parameterControl(uint16(d.dataMSB)<<7|uint16(val), 0), true
+		case CC_DATA_INCREMENT:
+			return d.parameterControl(0, 1), true
+		case CC_DATA_DECREMENT:
+			return d.parameterControl(0, -1), true
+		}
+	}
+
+	switch {
+	case num < CC_LSB_FIRST:
+		d.msb, d.pendingMSB, d.havePending = val, num, true
+		return Control{Kind: ControlChange14, Number: uint16(num), Value: expand14(val)}, true
+	case num <= CC_LSB_LAST && havePending && pending == num-CC_LSB_FIRST:
+		return Control{Kind: ControlChange14, Number: uint16(pending), Value: uint16(d.msb)<<7 | uint16(val)}, true
+	}
+	return Control{Kind: ControlChange, Number: uint16(num), Value: uint16(val)}, true
+}
+
+// 127/127 is the null parameter for both NRPN and RPN
+func (d *ControlDecoder) select14(rpn bool, param uint16) {
+	d.isRPN = rpn
+	d.param = param
+	d.selected = param != RPN_NULL
+	d.dataMSB = 0
+}
+
+func (d *ControlDecoder) parameterControl(value uint16, delta int) Control {
+	kind := NRPN
+	if d.isRPN {
+		kind = RPN
+	}
+	return Control{Kind: kind, Number: d.param, Value: value, Delta: delta}
+}
+
+// scales a 7 bit value to 14 bits by repeating it in the low bits, 0x7F becomes 0x3FFF
+func expand14(v byte) uint16 {
+	return uint16(v)<<7 | uint16(v)
+}
@@ -0,0 +1,66 @@
+package midi
+
+import "testing"
+
+func TestControlPairs(t *testing.T) {
+	var d ControlDecoder
+
+	// an MSB alone spans the full 14 bits
+	expectControl(t, &d, 7, 127, Control{Kind: ControlChange14, Number: 7, Value: 0x3FFF})
+	expectControl(t, &d, 7, 0, Control{Kind: ControlChange14, Number: 7, Value: 0})
+	expectControl(t, &d, 7, 0x40, Control{Kind: ControlChange14, Number: 7, Value: 0x2040})
+	// and the LSB refines it
+	expectControl(t, &d, 39, 0x01, Control{Kind: ControlChange14, Number: 7, Value: 0x2001})
+
+	// an LSB controller that's never had its MSB is just a controller
+	expectControl(t, &d, 40, 5, Control{Kind: ControlChange, Number: 40, Value: 5})
+	expectControl(t, &d, 64, 127, Control{Kind: ControlChange, Number: 64, Value: 127})
+
+	// nor is one that doesn't come straight after its MSB
+	expectControl(t, &d, 7, 0x40, Control{Kind: ControlChange14, Number: 7, Value: 0x2040})
+	expectControl(t, &d, 39, 0x01, Control{Kind: ControlChange14, Number: 7, Value: 0x2001})
+	expectControl(t, &d, 39, 0x02, Control{Kind: ControlChange, Number: 39, Value: 2})
+	expectControl(t, &d, 7, 0x40, Control{Kind: ControlChange14, Number: 7, Value: 0x2040})
+	expectControl(t, &d, 64, 0, Control{Kind: ControlChange, Number: 64, Value: 0})
+	expectControl(t, &d, 39, 0x03, Control{Kind: ControlChange, Number: 39, Value: 3})
+}
+
+func TestNRPN(t *testing.T) {
+	var d ControlDecoder
+
+	// data entry before anything is selected is an ordinary controller
+	expectControl(t, &d, CC_DATA_ENTRY, 10, Control{Kind: ControlChange14, Number: 6, Value: expand14(10)})
+
+	expectNothing(t, &d, CC_NRPN_MSB, 0x02)
+	expectNothing(t, &d, CC_NRPN_LSB, 0x2A)
+	expectControl(t, &d, CC_DATA_ENTRY, 0x7F, Control{Kind: NRPN, Number: 0x12A, Value: 0x3FFF})
+	expectControl(t, &d, CC_DATA_ENTRY_LSB, 0x00, Control{Kind: NRPN, Number: 0x12A, Value: 0x3F80})
+	expectControl(t, &d, CC_DATA_DECREMENT, 0, Control{Kind: NRPN, Number: 0x12A, Delta: -1})
+
+	expectNothing(t, &d, CC_RPN_MSB, 0)
+	expectNothing(t, &d, CC_RPN_LSB, 0)
+	expectControl(t, &d, CC_DATA_ENTRY, 12, Control{Kind: RPN, Number: 0, Value: expand14(12)})
+
+	// the null parameter deselects
+	expectNothing(t, &d, CC_RPN_MSB, 0x7F)
+	expectNothing(t, &d, CC_RPN_LSB, 0x7F)
+	expectControl(t, &d, CC_DATA_ENTRY, 1, Control{Kind: ControlChange14, Number: 6, Value: expand14(1)})
+}
+
+func expectControl(t *testing.T, d *ControlDecoder, num, val byte, want Control) {
+	t.Helper()
+	got, ok := d.Decode(num, val)
+	if !ok {
+		t.Fatalf("cc %d %d: expected %+v, got nothing", num, val, want)
+	}
+	if got != want {
+		t.Errorf("cc %d %d: expected %+v, got %+v", num, val, want, got)
+	}
+}
+
+func expectNothing(t *testing.T, d *ControlDecoder, num, val byte) {
+	t.Helper()
+	if got, ok := d.Decode(num, val); ok {
+		t.Errorf("cc %d %d: expected nothing, got %+v", num, val, got)
+	}
+}
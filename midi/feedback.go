@@ -0,0 +1,169 @@
+package midi
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+const (
+	statusCC = 0xB0
+)
+
+// anything that can send short midi messages, a portmidi output stream for instance
+type Writer interface {
+	WriteShort(status, data1, data2 int64) error
+}
+
+// Feedback echoes a patch's param changes to a midi output so motorized faders,
+// LED rings and DAW automation follow along with the UI and patch loads.
+//
+// A param mapped to a controller is sent as that controller, on the mapping's channel
+// or on Channel for mappings that listen on any channel.  Other params are sent as NRPNs,
+// numbered by their param id like the input side expects.
+//
+// Changes that came in over midi aren't sent back, the controller already shows them
+// and echoing a snapped value would fight with an encoder that's still turning.  It's
+// the value midi left a param at that isn't echoed, so a change from anywhere else
+// still goes out even if it lands before the feedback has caught up
+type Feedback struct {
+	// the channel for params mapped on any channel and for NRPNs
+	Channel byte
+	// send params mapped to controllers 0-31 as MSB/LSB pairs
+	HighRes bool
+	// send unmapped params as NRPNs, otherwise they're left alone
+	NRPN bool
+
+	out   Writer
+	patch *patch.Patch
+	sub   *patch.Subscription
+
+	mu sync.Mutex // serializes writes
+
+	// the value midi set each param to, as a 14 bit controller plus one, so 0 is none.
+	// Filled in for every param up front so the render loop only touches atomics
+	received map[patch.ParamId]*atomic.Uint32
+}
+
+// a param's received value while midi is setting it
+const receiving = ^uint32(0)
+
+// NewFeedback starts echoing p's changes to out until Close
+func NewFeedback(out Writer, p *patch.Patch) *Feedback {
+	f := &Feedback{
+		NRPN:     true,
+		out:      out,
+		patch:    p,
+		sub:      p.Subscribe(),
+		received: make(map[patch.ParamId]*atomic.Uint32),
+	}
+	for _, prm := range p.Params() {
+		f.received[prm.ID()] = new(atomic.Uint32)
+	}
+	go f.run()
+	return f
+}
+
+func (f *Feedback) Close() {
+	f.sub.Unsubscribe()
+}
+
+// Receiving and Received go either side of midi setting a param, so the change it
+// makes isn't echoed.  They're called on the render loop and don't lock
+func (f *Feedback) Receiving(prm patch.Param) {
+	if v := f.received[prm.ID()]; v != nil {
+		v.Store(receiving)
+	}
+}
+
+func (f *Feedback) Received(prm patch.Param) {
+	if v := f.received[prm.ID()]; v != nil {
+		v.Store(uint32(prm.ValAsCC14()) + 1)
+	}
+}
+
+// takes the value midi left a param at, if it was midi that changed it last
+// the render loop is between Receiving and Received for a moment at most, so that's waited out
+func (f *Feedback) takeReceived(id patch.ParamId) (uint16, bool) {
+	v := f.received[id]
+	if v == nil {
+		return 0, false
+	}
+	for {
+		got := v.Load()
+		if got == receiving {
+			runtime.Gosched()
+			continue
+		}
+		if v.CompareAndSwap(got, 0) {
+			return uint16(got - 1), got != 0
+		}
+	}
+}
+
+// SendAll sends every param, after a patch load or when a controller connects
+func (f *Feedback) SendAll() {
+	for _, prm := range f.patch.Params() {
+		f.send(prm)
+	}
+}
+
+func (f *Feedback) run() {
+	for id := range f.sub.C {
+		prm := f.patch.GetParam(id)
+		if prm == nil {
+			continue
+		}
+
+		v, fromMidi := f.takeReceived(id)
+		if fromMidi && prm.ValAsCC14() == v {
+			continue
+		}
+		f.send(prm)
+	}
+}
+
+func (f *Feedback) send(prm patch.Param) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	if m, ok := f.patch.MappingFor(prm.ID()); ok {
+		channel := m.Channel
+		if channel == patch.ANY_CHANNEL {
+			channel = f.Channel
+		}
+		if f.HighRes && m.CC < CC_LSB_FIRST {
+			v := prm.ValAsCC14()
+			err = f.writeCC(channel, m.CC, byte(v>>7))
+			if err == nil {
+				err = f.writeCC(channel, m.CC+CC_LSB_FIRST, byte(v&0x7F))
+			}
+		} else {
+			err = f.writeCC(channel, m.CC, prm.ValAsCC())
+		}
+	} else if f.NRPN {
+		msb, lsb := prm.ID().NRPN()
+		v := prm.ValAsCC14()
+		for _, cc := range [][2]byte{
+			{CC_NRPN_MSB, msb},
+			{CC_NRPN_LSB, lsb},
+			{CC_DATA_ENTRY, byte(v >> 7)},
+			{CC_DATA_ENTRY_LSB, byte(v & 0x7F)},
+		} {
+			if err = f.writeCC(f.Channel, cc[0], cc[1]); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("error sending %x to midi out: %v\n", prm.ID(), err)
+	}
+}
+
+func (f *Feedback) writeCC(channel, num, val byte) error {
+	return f.out.WriteShort(int64(statusCC|channel&0x0F), int64(num), int64(val))
+}
@@ -0,0 +1,127 @@
+package midi
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/patch"
+)
+
+type shortMessage struct {
+	status, data1, data2 int64
+}
+
+type recordingWriter struct {
+	sync.Mutex
+	sent []shortMessage
+}
+
+func (w *recordingWriter) WriteShort(status, data1, data2 int64) error {
+	w.Lock()
+	w.sent = append(w.sent, shortMessage{status, data1, data2})
+	w.Unlock()
+	return nil
+}
+
+// waits for the feedback goroutine to send n messages and takes them, along with
+// anything else it sent first
+func (w *recordingWriter) take(t *testing.T, n int) []shortMessage {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.Lock()
+		if len(w.sent) >= n {
+			sent := w.sent
+			w.sent = nil
+			w.Unlock()
+			return sent
+		}
+		w.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("waited for %d messages, got %v", n, w.sent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	p := patch.InitialPatch()
+	w := &recordingWriter{}
+	f := NewFeedback(w, p)
+	defer f.Close()
+	f.Channel = 2
+
+	// attack is on cc 0x14 for any channel, so it goes out on the feedback channel
+	attack := p.Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA)
+	attack.Set(4000)
+	expectSent(t, w.take(t, 1), shortMessage{0xB2, 0x14, 127})
+
+	// detune has no controller, it goes out as an NRPN
+	detune := p.Fp32Param(patch.OPR_DETUNE | patch.GRP_A)
+	detune.SetFromCC14(0x2001)
+	msb, lsb := detune.ID().NRPN()
+	expectSent(t, w.take(t, 4),
+		shortMessage{0xB2, CC_NRPN_MSB, int64(msb)},
+		shortMessage{0xB2, CC_NRPN_LSB, int64(lsb)},
+		shortMessage{0xB2, CC_DATA_ENTRY, 0x40},
+		shortMessage{0xB2, CC_DATA_ENTRY_LSB, 0x01},
+	)
+
+	// a change that came in over midi isn't echoed, which the next change shows since
+	// an echo would have gone out ahead of it
+	var d ControlDecoder
+	receive := func(cc, val byte) {
+		ctl, _ := d.Decode(cc, val)
+		prm := p.ControlledParam(0, byte(ctl.Number))
+		f.Receiving(prm)
+		prm.SetFromCC14(ctl.Value)
+		f.Received(prm)
+	}
+	receive(0x15, 100)
+	attack.Set(0)
+	expectSent(t, w.take(t, 1), shortMessage{0xB2, 0x14, 0})
+
+	// but a change to the same param from elsewhere is, however soon it follows
+	decay := p.Uint16Param(patch.ENV_DECAY | patch.GRP_VCA)
+	receive(0x15, 90)
+	decay.Set(0)
+	expectSent(t, w.take(t, 1), shortMessage{0xB2, 0x15, 0})
+
+	// midi learn maps a controller without leaving the param it used to move unable to echo.
+	// NRPNs are off so arming detune, which would send it, doesn't get in the way
+	f.NRPN = false
+	p.Learn(detune.ID())
+	receive(0x15, 64)
+	decay.Set(4000)
+	expectSent(t, w.take(t, 1), shortMessage{0xB2, 0x15, 127})
+}
+
+func TestFeedbackSendAll(t *testing.T) {
+	p := patch.InitialPatch()
+	w := &recordingWriter{}
+	f := NewFeedback(w, p)
+	defer f.Close()
+	f.HighRes = true
+
+	mapped := len(p.Profile().Mappings)
+	want := mapped*2 + (len(p.Params())-mapped)*4
+	f.SendAll()
+	sent := w.take(t, want)
+	// alg on cc 3 as a 14 bit pair, and four messages for each of the rest
+	if len(sent) != want {
+		t.Fatalf("expected %d messages, got %d", want, len(sent))
+	}
+}
+
+func expectSent(t *testing.T, got []shortMessage, want ...shortMessage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, sent %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("message %d: expected %v, sent %v", i, want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package midi
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordDivision = 960
+	recordTempo    = defaultTempo
+
+	// events waiting to be added to the recording.  Recording is usually done on the
+	// render loop, which can't wait, so past this many events are dropped
+	recordQueue = 4096
+)
+
+// Recorder collects midi events as they're played, to be saved as a midi file.
+// It's also a Writer, so a Feedback can record param changes into it as controllers
+//
+// Record never blocks, events are queued to the recorder's goroutine which keeps
+// them, so call Close when the recording's finished with
+type Recorder struct {
+	now func() time.Duration // for events written through WriteShort
+
+	queue   chan TimedEvent
+	flush   chan chan []TimedEvent
+	done    chan struct{}
+	dropped int64 // atomic
+}
+
+// NewRecorder makes a recorder, with now telling it when things written to it happened
+func NewRecorder(now func() time.Duration) *Recorder {
+	r := &Recorder{
+		now:   now,
+		queue: make(chan TimedEvent, recordQueue),
+		flush: make(chan chan []TimedEvent),
+		done:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Record adds an event at a time from the start of the recording.  A sysex message is
+// kept rather than copied, it mustn't be changed afterward
+func (r *Recorder) Record(at time.Duration, status, data1, data2 byte, sysex []byte) {
+	ev := TimedEvent{Time: at, TrackEvent: TrackEvent{Status: status, Data1: data1, Data2: data2}}
+	if status == statusSysEx {
+		ev.Data = sysex
+	}
+	select {
+	case r.queue <- ev:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+func (r *Recorder) WriteShort(status, data1, data2 int64) error {
+	r.Record(r.now(), byte(status), byte(data1), byte(data2), nil)
+	return nil
+}
+
+// Dropped is how many events didn't make it into the recording because it fell behind
+func (r *Recorder) Dropped() int {
+	return int(atomic.LoadInt64(&r.dropped))
+}
+
+func (r *Recorder) Close() {
+	close(r.done)
+}
+
+func (r *Recorder) run() {
+	var events []TimedEvent
+	for {
+		select {
+		case ev := <-r.queue:
+			events = append(events, ev)
+		case reply := <-r.flush:
+			// take whatever was recorded before the flush was asked for
+			for drained := false; !drained; {
+				select {
+				case ev := <-r.queue:
+					events = append(events, ev)
+				default:
+					drained = true
+				}
+			}
+			reply <- append([]TimedEvent(nil), events...)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// SMF makes a format 0 file of what's been recorded, at 120bpm
+func (r *Recorder) SMF() *SMF {
+	reply := make(chan []TimedEvent)
+	var events []TimedEvent
+	select {
+	case r.flush <- reply:
+		events = <-reply
+	case <-r.done:
+	}
+
+	// events recorded from different goroutines can come in a little out of order
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time < events[j].Time
+	})
+
+	track := Track{{Status: statusMeta, Meta: META_TEMPO, Data: []byte{recordTempo >> 16, recordTempo >> 8 & 0xFF, recordTempo & 0xFF}}}
+	for _, ev := range events {
+		ev.Tick = uint32(int64(ev.Time) * recordDivision / int64(recordTempo*time.Microsecond))
+		track = append(track, ev.TrackEvent)
+	}
+	return &SMF{Format: 0, Division: recordDivision, Tracks: []Track{track}}
+}
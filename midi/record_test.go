@@ -0,0 +1,65 @@
+package midi
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	var now time.Duration
+	r := NewRecorder(func() time.Duration { return now })
+	defer r.Close()
+	r.Record(0, 0x90, 60, 100, nil)
+	now = 250 * time.Millisecond
+	r.WriteShort(0xB0, 7, 64)
+	r.Record(time.Second, 0x80, 60, 0, nil)
+	r.Record(500*time.Millisecond, 0xC0, 3, 0, nil)
+	r.Record(2*time.Second, statusSysEx, 0, 0, []byte{0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7})
+
+	var b bytes.Buffer
+	if err := r.SMF().Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	smf, err := ReadSMF(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		at     time.Duration
+		status byte
+	}{
+		{0, 0x90}, {250 * time.Millisecond, 0xB0}, {500 * time.Millisecond, 0xC0},
+		{time.Second, 0x80}, {2 * time.Second, statusSysEx},
+	}
+	var got []TimedEvent
+	for _, ev := range smf.Timeline() {
+		if ev.Status != statusMeta {
+			got = append(got, ev)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read back %d events, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Status != w.status || got[i].Time != w.at {
+			t.Errorf("event %d is %x at %s, want %x at %s", i, got[i].Status, got[i].Time, w.status, w.at)
+		}
+	}
+	if got[2].Data1 != 3 || !bytes.Equal(got[4].Data, []byte{0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7}) {
+		t.Errorf("data didn't survive: %+v", got)
+	}
+}
+
+func TestRecordDropsWhenFull(t *testing.T) {
+	// without its goroutine nothing takes from the queue, so it fills
+	r := &Recorder{queue: make(chan TimedEvent, recordQueue)}
+
+	for i := 0; i < recordQueue+10; i++ {
+		r.Record(0, 0x90, 60, 100, nil)
+	}
+	if r.Dropped() != 10 {
+		t.Errorf("dropped %d events, want 10", r.Dropped())
+	}
+}
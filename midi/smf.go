@@ -0,0 +1,378 @@
+package midi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+	Standard MIDI Files, formats 0 and 1.
+
+	A file is read into its tracks of events, each at an absolute tick.  Timeline
+	merges the tracks and works out when every event happens from the tempo map,
+	which is what a player wants.
+*/
+
+const (
+	META_TEMPO        = 0x51
+	META_END_OF_TRACK = 0x2F
+	META_TRACK_NAME   = 0x03
+
+	statusProgramChange   = 0xC0
+	statusChannelPressure = 0xD0
+	statusSysEx           = 0xF0
+	statusSysExEscape     = 0xF7
+	statusMeta            = 0xFF
+
+	defaultTempo = 500000 // µs per quarter note, 120bpm
+)
+
+type SMF struct {
+	Format int
+	// ticks per quarter note, or if the top bit is set SMPTE frames per second
+	// (negated, in the top byte) and ticks per frame
+	Division uint16
+	Tracks   []Track
+}
+
+type Track []TrackEvent
+
+// TrackEvent is a channel message, a sysex (Status 0xF0, with Data the whole message
+// from F0 to F7) or a meta event (Status 0xFF, with its type in Meta)
+type TrackEvent struct {
+	Tick   uint32 // from the start of the track
+	Status byte
+	Data1  byte
+	Data2  byte
+	Meta   byte
+	Data   []byte
+}
+
+func (ev TrackEvent) IsChannelMessage() bool {
+	return ev.Status >= 0x80 && ev.Status < statusSysEx
+}
+
+// a track event and when it happens
+type TimedEvent struct {
+	Time  time.Duration
+	Track int
+	TrackEvent
+}
+
+func LoadSMF(path string) (*SMF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSMF(bufio.NewReader(f))
+}
+
+func ReadSMF(r io.Reader) (*SMF, error) {
+	id, data, err := readChunk(r)
+	if err != nil {
+		return nil, err
+	}
+	if id != "MThd" || len(data) < 6 {
+		return nil, fmt.Errorf("not a midi file")
+	}
+	smf := &SMF{
+		Format:   int(binary.BigEndian.Uint16(data[0:])),
+		Division: binary.BigEndian.Uint16(data[4:]),
+	}
+	if smf.Format > 1 {
+		return nil, fmt.Errorf("format %d midi files aren't supported", smf.Format)
+	}
+	if smf.Division == 0 {
+		return nil, fmt.Errorf("midi file has a division of 0")
+	}
+
+	ntrks := int(binary.BigEndian.Uint16(data[2:]))
+	for len(smf.Tracks) < ntrks {
+		id, data, err := readChunk(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id != "MTrk" {
+			// unknown chunks are to be skipped
+			continue
+		}
+		track, err := parseTrack(data)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", len(smf.Tracks), err)
+		}
+		smf.Tracks = append(smf.Tracks, track)
+	}
+	return smf, nil
+}
+
+func readChunk(r io.Reader) (string, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[4:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, fmt.Errorf("truncated %s chunk", hdr[:4])
+	}
+	return string(hdr[:4]), data, nil
+}
+
+func parseTrack(data []byte) (Track, error) {
+	var track Track
+	var tick uint32
+	var running byte
+	p := 0
+
+	vlq := func() (uint32, error) {
+		var v uint32
+		for i := 0; i < 4; i++ {
+			if p >= len(data) {
+				return 0, fmt.Errorf("truncated")
+			}
+			b := data[p]
+			p++
+			v = v<<7 | uint32(b&0x7F)
+			if b&0x80 == 0 {
+				return v, nil
+			}
+		}
+		return 0, fmt.Errorf("variable length number is too long")
+	}
+	bytes := func(n uint32) ([]byte, error) {
+		if uint32(len(data)-p) < n {
+			return nil, fmt.Errorf("truncated")
+		}
+		b := data[p : p+int(n)]
+		p += int(n)
+		return b, nil
+	}
+
+	for p < len(data) {
+		delta, err := vlq()
+		if err != nil {
+			return nil, err
+		}
+		tick += delta
+		if p >= len(data) {
+			return nil, fmt.Errorf("truncated")
+		}
+
+		ev := TrackEvent{Tick: tick, Status: data[p]}
+		switch {
+		case ev.Status == statusMeta:
+			p++
+			if p >= len(data) {
+				return nil, fmt.Errorf("truncated")
+			}
+			ev.Meta = data[p]
+			p++
+			n, err := vlq()
+			if err != nil {
+				return nil, err
+			}
+			if ev.Data, err = bytes(n); err != nil {
+				return nil, err
+			}
+			if ev.Meta == META_END_OF_TRACK {
+				return append(track, ev), nil
+			}
+			running = 0
+		case ev.Status == statusSysEx || ev.Status == statusSysExEscape:
+			p++
+			n, err := vlq()
+			if err != nil {
+				return nil, err
+			}
+			b, err := bytes(n)
+			if err != nil {
+				return nil, err
+			}
+			// an escape is sent as is, a sysex gets back the F0 the file leaves out
+			if ev.Status == statusSysEx {
+				ev.Data = append([]byte{statusSysEx}, b...)
+			} else {
+				ev.Data = b
+			}
+			ev.Status = statusSysEx
+			running = 0
+		default:
+			if ev.Status&0x80 != 0 {
+				running = ev.Status
+				p++
+			} else if running == 0 {
+				return nil, fmt.Errorf("data byte %x with no running status", ev.Status)
+			}
+			ev.Status = running
+			n := uint32(2)
+			if s := running & 0xF0; s == statusProgramChange || s == statusChannelPressure {
+				n = 1
+			}
+			b, err := bytes(n)
+			if err != nil {
+				return nil, err
+			}
+			ev.Data1 = b[0]
+			if n == 2 {
+				ev.Data2 = b[1]
+			}
+		}
+		track = append(track, ev)
+	}
+	return track, nil
+}
+
+// Timeline merges the tracks into one list in time order, following tempo changes
+// in any track.  Events at the same tick stay in track order
+func (f *SMF) Timeline() []TimedEvent {
+	var events []TimedEvent
+	for i, track := range f.Tracks {
+		for _, ev := range track {
+			events = append(events, TimedEvent{Track: i, TrackEvent: ev})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Tick != events[j].Tick {
+			return events[i].Tick < events[j].Tick
+		}
+		return events[i].Track < events[j].Track
+	})
+
+	var at time.Duration
+	var lastTick uint32
+	tempo := uint32(defaultTempo)
+	for i := range events {
+		ev := &events[i]
+		at += f.ticksToDuration(ev.Tick-lastTick, tempo)
+		lastTick = ev.Tick
+		ev.Time = at
+
+		if ev.Status == statusMeta && ev.Meta == META_TEMPO && len(ev.Data) == 3 {
+			tempo = uint32(ev.Data[0])<<16 | uint32(ev.Data[1])<<8 | uint32(ev.Data[2])
+		}
+	}
+	return events
+}
+
+func (f *SMF) ticksToDuration(ticks, tempo uint32) time.Duration {
+	if f.Division&0x8000 != 0 {
+		// SMPTE timing ignores the tempo, 29 means 29.97 drop frame
+		fps := float64(-int8(f.Division >> 8))
+		if fps == 29 {
+			fps = 29.97
+		}
+		perFrame := float64(f.Division & 0xFF)
+		return time.Duration(float64(ticks) / (fps * perFrame) * float64(time.Second))
+	}
+	return time.Duration(uint64(ticks) * uint64(tempo) * uint64(time.Microsecond) / uint64(f.Division))
+}
+
+func (f *SMF) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := f.Write(w); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Write writes the file without running status, ending each track if it isn't already
+func (f *SMF) Write(w io.Writer) error {
+	hdr := make([]byte, 6)
+	binary.BigEndian.PutUint16(hdr[0:], uint16(f.Format))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(f.Tracks)))
+	binary.BigEndian.PutUint16(hdr[4:], f.Division)
+	if err := writeChunk(w, "MThd", hdr); err != nil {
+		return err
+	}
+
+	for _, track := range f.Tracks {
+		var b []byte
+		var last uint32
+		ended := false
+		for _, ev := range track {
+			if ended {
+				break
+			}
+			b = appendVLQ(b, ev.Tick-last)
+			last = ev.Tick
+			switch {
+			case ev.Status == statusMeta:
+				b = append(b, statusMeta, ev.Meta)
+				b = appendVLQ(b, uint32(len(ev.Data)))
+				b = append(b, ev.Data...)
+				ended = ev.Meta == META_END_OF_TRACK
+			case ev.Status == statusSysEx:
+				// a whole message is written without its F0, anything else as an escape
+				if len(ev.Data) > 0 && ev.Data[0] == statusSysEx {
+					b = append(b, statusSysEx)
+					b = appendVLQ(b, uint32(len(ev.Data)-1))
+					b = append(b, ev.Data[1:]...)
+				} else {
+					b = append(b, statusSysExEscape)
+					b = appendVLQ(b, uint32(len(ev.Data)))
+					b = append(b, ev.Data...)
+				}
+			default:
+				b = append(b, ev.Status, ev.Data1)
+				if s := ev.Status & 0xF0; s != statusProgramChange && s != statusChannelPressure {
+					b = append(b, ev.Data2)
+				}
+			}
+		}
+		if !ended {
+			b = append(b, 0, statusMeta, META_END_OF_TRACK, 0)
+		}
+		if err := writeChunk(w, "MTrk", b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeChunk(w io.Writer, id string, data []byte) error {
+	hdr := make([]byte, 8)
+	copy(hdr, id)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func appendVLQ(b []byte, v uint32) []byte {
+	var tmp [5]byte
+	n := 0
+	for {
+		tmp[n] = byte(v & 0x7F)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if i > 0 {
+			tmp[i] |= 0x80
+		}
+		b = append(b, tmp[i])
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package midi
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func chunk(id string, data ...byte) []byte {
+	n := len(data)
+	return append([]byte{id[0], id[1], id[2], id[3], byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+func TestReadSMF(t *testing.T) {
+	var file []byte
+	// format 1, two tracks, 96 ticks per quarter
+	file = append(file, chunk("MThd", 0, 1, 0, 2, 0, 96)...)
+	// the conductor track halves the tempo to 60bpm after one beat
+	file = append(file, chunk("MTrk",
+		0x00, 0xFF, META_TEMPO, 3, 0x07, 0xA1, 0x20,
+		0x60, 0xFF, META_TEMPO, 3, 0x0F, 0x42, 0x40,
+		0x00, 0xFF, META_END_OF_TRACK, 0,
+	)...)
+	// an unknown chunk in between is skipped
+	file = append(file, chunk("XFIH", 1, 2, 3)...)
+	file = append(file, chunk("MTrk",
+		0x00, 0x91, 60, 100,
+		0x81, 0x40, 64, 100, // running status, 192 ticks later
+		0x00, 0xC1, 5, // program change has one data byte
+		0x60, 0xF0, 3, 0x7E, 0x00, 0xF7,
+		0x00, 0xFF, META_END_OF_TRACK, 0,
+	)...)
+
+	smf, err := ReadSMF(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smf.Format != 1 || smf.Division != 96 || len(smf.Tracks) != 2 {
+		t.Fatalf("read format %d division %d with %d tracks", smf.Format, smf.Division, len(smf.Tracks))
+	}
+
+	var notes []TimedEvent
+	var sysex TimedEvent
+	for _, ev := range smf.Timeline() {
+		switch {
+		case ev.Status == 0x91:
+			notes = append(notes, ev)
+		case ev.Status == statusSysEx:
+			sysex = ev
+		}
+	}
+	if len(notes) != 2 || notes[1].Data1 != 64 || notes[1].Data2 != 100 {
+		t.Fatalf("notes are %+v", notes)
+	}
+	// one beat at 120bpm, then one at 60
+	if notes[1].Time != 1500*time.Millisecond {
+		t.Errorf("second note at %s, want 1.5s", notes[1].Time)
+	}
+	if sysex.Time != 2500*time.Millisecond || !bytes.Equal(sysex.Data, []byte{0xF0, 0x7E, 0x00, 0xF7}) {
+		t.Errorf("sysex at %s is % x", sysex.Time, sysex.Data)
+	}
+}
+
+func TestReadSMFErrors(t *testing.T) {
+	for name, file := range map[string][]byte{
+		"not midi": []byte("RIFF0000WAVE"),
+		"format 2": chunk("MThd", 0, 2, 0, 1, 0, 96),
+		"truncated": append(chunk("MThd", 0, 0, 0, 1, 0, 96),
+			chunk("MTrk", 0x00, 0x90, 60)...),
+		"no running status": append(chunk("MThd", 0, 0, 0, 1, 0, 96),
+			chunk("MTrk", 0x00, 60, 100)...),
+	} {
+		if _, err := ReadSMF(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package osc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// a message's arguments are int32, float32, float64, int64, string, []byte or bool
+type Message struct {
+	Address string
+	Args    []interface{}
+}
+
+const bundleTag = "#bundle"
+
+// Decode reads a packet, which is a message or a bundle of them.  Bundles are
+// flattened and their time tags ignored, everything happens when it arrives
+func Decode(b []byte) ([]Message, error) {
+	if len(b) == 0 || len(b)%4 != 0 {
+		return nil, fmt.Errorf("an osc packet is a multiple of 4 bytes")
+	}
+	if b[0] == '#' {
+		return decodeBundle(b)
+	}
+	m, err := decodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	return []Message{m}, nil
+}
+
+func decodeBundle(b []byte) ([]Message, error) {
+	tag, b, err := readString(b)
+	if err != nil {
+		return nil, err
+	}
+	if tag != bundleTag || len(b) < 8 {
+		return nil, fmt.Errorf("bad bundle")
+	}
+	b = b[8:] // the time tag
+
+	var msgs []Message
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated bundle")
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return nil, fmt.Errorf("truncated bundle")
+		}
+		inner, err := Decode(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, inner...)
+		b = b[n:]
+	}
+	return msgs, nil
+}
+
+func decodeMessage(b []byte) (Message, error) {
+	var m Message
+	var err error
+	if m.Address, b, err = readString(b); err != nil {
+		return m, err
+	}
+	if len(m.Address) == 0 || m.Address[0] != '/' {
+		return m, fmt.Errorf("bad address %q", m.Address)
+	}
+	if len(b) == 0 {
+		// old implementations leave out the type tags when there are no arguments
+		return m, nil
+	}
+
+	var tags string
+	if tags, b, err = readString(b); err != nil {
+		return m, err
+	}
+	if len(tags) == 0 || tags[0] != ',' {
+		return m, fmt.Errorf("bad type tags %q", tags)
+	}
+
+	for _, tag := range tags[1:] {
+		var arg interface{}
+		switch tag {
+		case 'i', 'f':
+			if len(b) < 4 {
+				return m, fmt.Errorf("truncated argument")
+			}
+			v := binary.BigEndian.Uint32(b)
+			if tag == 'i' {
+				arg = int32(v)
+			} else {
+				arg = math.Float32frombits(v)
+			}
+			b = b[4:]
+		case 'h', 'd':
+			if len(b) < 8 {
+				return m, fmt.Errorf("truncated argument")
+			}
+			v := binary.BigEndian.Uint64(b)
+			if tag == 'h' {
+				arg = int64(v)
+			} else {
+				arg = math.Float64frombits(v)
+			}
+			b = b[8:]
+		case 's', 'S':
+			if arg, b, err = readString(b); err != nil {
+				return m, err
+			}
+		case 'b':
+			if len(b) < 4 {
+				return m, fmt.Errorf("truncated argument")
+			}
+			n := int(binary.BigEndian.Uint32(b))
+			b = b[4:]
+			if len(b) < pad(n) {
+				return m, fmt.Errorf("truncated blob")
+			}
+			arg = append([]byte(nil), b[:n]...)
+			b = b[pad(n):]
+		case 'T':
+			arg = true
+		case 'F':
+			arg = false
+		case 'N', 'I':
+			continue
+		default:
+			return m, fmt.Errorf("unsupported argument type %q", tag)
+		}
+		m.Args = append(m.Args, arg)
+	}
+	return m, nil
+}
+
+// reads a null terminated string padded to 4 bytes
+func readString(b []byte) (string, []byte, error) {
+	n := bytes.IndexByte(b, 0)
+	if n < 0 || len(b) < pad(n+1) {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+	return string(b[:n]), b[pad(n+1):], nil
+}
+
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (m Message) Encode() ([]byte, error) {
+	var b []byte
+	b = appendString(b, m.Address)
+
+	tags := []byte{','}
+	var args []byte
+	for _, arg := range m.Args {
+		switch v := arg.(type) {
+		case int32:
+			tags = append(tags, 'i')
+			args = binary.BigEndian.AppendUint32(args, uint32(v))
+		case int:
+			tags = append(tags, 'i')
+			args = binary.BigEndian.AppendUint32(args, uint32(int32(v)))
+		case float32:
+			tags = append(tags, 'f')
+			args = binary.BigEndian.AppendUint32(args, math.Float32bits(v))
+		case int64:
+			tags = append(tags, 'h')
+			args = binary.BigEndian.AppendUint64(args, uint64(v))
+		case float64:
+			tags = append(tags, 'd')
+			args = binary.BigEndian.AppendUint64(args, math.Float64bits(v))
+		case string:
+			tags = append(tags, 's')
+			args = appendString(args, v)
+		case []byte:
+			tags = append(tags, 'b')
+			args = binary.BigEndian.AppendUint32(args, uint32(len(v)))
+			args = append(args, v...)
+			args = append(args, make([]byte, pad(len(v))-len(v))...)
+		case bool:
+			if v {
+				tags = append(tags, 'T')
+			} else {
+				tags = append(tags, 'F')
+			}
+		default:
+			return nil, fmt.Errorf("can't send a %T over osc", arg)
+		}
+	}
+	b = appendString(b, string(tags))
+	return append(b, args...), nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, s...)
+	return append(b, make([]byte, pad(len(s)+1)-len(s))...)
+}
+
+// Float reads a numeric or boolean argument as a float64
+func Float(arg interface{}) (float64, bool) {
+	switch v := arg.(type) {
+	case int32:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,50 @@
+package osc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := Message{Address: "/patch/env/vca/attack", Args: []interface{}{
+		int32(-3), float32(0.5), "hello", []byte{1, 2, 3}, true, false, int64(1) << 40, 2.25,
+	}}
+	b, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%4 != 0 {
+		t.Fatalf("encoded to %d bytes, not a multiple of 4", len(b))
+	}
+	msgs, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !reflect.DeepEqual(msgs[0], m) {
+		t.Errorf("decoded %+v, want %+v", msgs, m)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	one, _ := Message{Address: "/a", Args: []interface{}{int32(1)}}.Encode()
+	two, _ := Message{Address: "/b"}.Encode()
+
+	b := appendString(nil, bundleTag)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 1) // immediately
+	for _, m := range [][]byte{one, two} {
+		b = append(b, 0, 0, 0, byte(len(m)))
+		b = append(b, m...)
+	}
+
+	msgs, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Address != "/a" || msgs[1].Address != "/b" {
+		t.Errorf("decoded %+v", msgs)
+	}
+
+	if _, err := Decode(b[:len(b)-4]); err == nil {
+		t.Errorf("expected a truncated bundle to fail")
+	}
+}
@@ -0,0 +1,232 @@
+package osc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+/*
+	An OSC server for controlling the synth over UDP.
+
+	  /patch/...           a param, see patch/paths.go.  With a number it's set, in the
+	                       param's own units, and without one the value is sent back
+	  /patch/dump          sends back every param
+	  /patch/subscribe     sends the sender every param change from now on
+	  /patch/unsubscribe
+	  /patch/load  s       loads a patch from the patch directory, by name without the .json
+	  /patch/save  s       saves the patch there
+	  /patch/learn s       arms a param by path for midi learn, the next controller to
+	                       move is mapped to it.  Without a path it's disarmed
+	  /note/on  i i [i]    note, velocity and channel 1-16 (default 1)
+	  /note/off i [i]      note and channel
+
+	Params are set the same way midi sets them, so the UI and midi out follow along.
+	Notes go in with the midi, so they're played, filtered and recorded like it too.
+	There's no authentication, so patch names are bare names confined to the patch
+	directory, and it's best to listen on localhost unless the network is trusted.
+*/
+
+type Server struct {
+	conn   *net.UDPConn
+	patch  *patch.Patch
+	dir    string // where patches are loaded and saved
+	events chan<- portmidi.Event
+	sub    *patch.Subscription
+
+	mu          sync.Mutex
+	subscribers map[string]*net.UDPAddr
+}
+
+// NewServer listens on addr, like "127.0.0.1:9000", setting p's params, sending notes
+// to events and keeping patches in dir
+func NewServer(addr string, p *patch.Patch, dir string, events chan<- portmidi.Event) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:        conn,
+		patch:       p,
+		dir:         dir,
+		events:      events,
+		sub:         p.Subscribe(),
+		subscribers: make(map[string]*net.UDPAddr),
+	}
+	go s.notify()
+	return s, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Serve handles packets until Close
+func (s *Server) Serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("osc: %v\n", err)
+			}
+			return
+		}
+		msgs, err := Decode(buf[:n])
+		if err != nil {
+			fmt.Printf("osc: bad packet from %s: %v\n", from, err)
+			continue
+		}
+		for _, m := range msgs {
+			if err := s.handle(m, from); err != nil {
+				fmt.Printf("osc: %s: %v\n", m.Address, err)
+			}
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	s.sub.Unsubscribe()
+	return s.conn.Close()
+}
+
+func (s *Server) handle(m Message, from *net.UDPAddr) error {
+	switch m.Address {
+	case "/patch/dump":
+		for _, prm := range s.patch.Params() {
+			s.sendParam(prm, from)
+		}
+		return nil
+	case "/patch/subscribe":
+		s.mu.Lock()
+		s.subscribers[from.String()] = from
+		s.mu.Unlock()
+		return nil
+	case "/patch/unsubscribe":
+		s.mu.Lock()
+		delete(s.subscribers, from.String())
+		s.mu.Unlock()
+		return nil
+	case "/patch/load", "/patch/save":
+		name, ok := stringArg(m, 0)
+		if !ok {
+			return fmt.Errorf("needs a patch name")
+		}
+		if m.Address == "/patch/load" {
+			return s.patch.LoadNamed(s.dir, name)
+		}
+		return s.patch.SaveNamed(s.dir, name)
+	case "/patch/learn":
+		if len(m.Args) == 0 {
+			s.patch.CancelLearn()
+			return nil
+		}
+		path, ok := stringArg(m, 0)
+		if !ok {
+			return fmt.Errorf("needs a param path")
+		}
+		prm, ok := s.patch.ParamByPath(path)
+		if !ok {
+			return fmt.Errorf("no such param %s", path)
+		}
+		s.patch.Learn(prm.ID())
+		return nil
+	case "/note/on", "/note/off":
+		return s.note(m)
+	}
+
+	prm, ok := s.patch.ParamByPath(m.Address)
+	if !ok {
+		return fmt.Errorf("no such param")
+	}
+	if len(m.Args) == 0 {
+		s.sendParam(prm, from)
+		return nil
+	}
+	v, ok := Float(m.Args[0])
+	if !ok {
+		return fmt.Errorf("needs a number")
+	}
+	patch.SetFloat(prm, v)
+	return nil
+}
+
+func (s *Server) note(m Message) error {
+	status := byte(0x90)
+	need := 2
+	if m.Address == "/note/off" {
+		status, need = 0x80, 1
+	}
+	if len(m.Args) < need {
+		return fmt.Errorf("needs %d arguments", need)
+	}
+	args := make([]int, 0, 3)
+	for _, arg := range m.Args {
+		v, ok := Float(arg)
+		if !ok {
+			return fmt.Errorf("needs numbers")
+		}
+		args = append(args, int(v))
+	}
+
+	note, vel, channel := args[0], 0, 1
+	if need == 2 {
+		vel = args[1]
+	}
+	if len(args) > need {
+		channel = args[need]
+	}
+	if note < 0 || note > 127 || vel < 0 || vel > 127 || channel < 1 || channel > 16 {
+		return fmt.Errorf("out of range")
+	}
+
+	s.events <- portmidi.Event{
+		Timestamp: portmidi.Time(),
+		Status:    int64(status | byte(channel-1)),
+		Data1:     int64(note),
+		Data2:     int64(vel),
+	}
+	return nil
+}
+
+func (s *Server) sendParam(prm patch.Param, to *net.UDPAddr) {
+	b, err := Message{Address: prm.ID().Path(), Args: []interface{}{float32(patch.Float(prm))}}.Encode()
+	if err != nil {
+		fmt.Printf("osc: %v\n", err)
+		return
+	}
+	if _, err := s.conn.WriteToUDP(b, to); err != nil {
+		fmt.Printf("osc: sending to %s: %v\n", to, err)
+	}
+}
+
+// sends param changes to the subscribers
+func (s *Server) notify() {
+	for id := range s.sub.C {
+		prm := s.patch.GetParam(id)
+		if prm == nil {
+			continue
+		}
+		s.mu.Lock()
+		for _, to := range s.subscribers {
+			s.sendParam(prm, to)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func stringArg(m Message, i int) (string, bool) {
+	if i >= len(m.Args) {
+		return "", false
+	}
+	str, ok := m.Args[i].(string)
+	return str, ok
+}
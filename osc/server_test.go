@@ -0,0 +1,125 @@
+package osc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+func TestServer(t *testing.T) {
+	p := patch.InitialPatch()
+	events := make(chan portmidi.Event, 10)
+	dir := t.TempDir()
+	s, err := NewServer("127.0.0.1:0", p, filepath.Join(dir, "patches"), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	client, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(m Message) {
+		b, err := m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() Message {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := Decode(buf[:n])
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("bad reply: %v", err)
+		}
+		return msgs[0]
+	}
+
+	// setting a param, then asking for it back
+	updates := p.Subscribe()
+	defer updates.Unsubscribe()
+	send(Message{Address: "/patch/env/vca/attack", Args: []interface{}{float32(250)}})
+	select {
+	case id := <-updates.C:
+		if id != patch.ENV_ATTACK|patch.GRP_VCA {
+			t.Errorf("update for %x", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("setting a param didn't announce it")
+	}
+	send(Message{Address: "/patch/env/vca/attack"})
+	if reply := receive(); reply.Address != "/patch/env/vca/attack" || reply.Args[0] != float32(250) {
+		t.Errorf("query replied %+v", reply)
+	}
+
+	send(Message{Address: "/note/on", Args: []interface{}{int32(60), int32(100), int32(2)}})
+	select {
+	case ev := <-events:
+		if ev.Status != 0x91 || ev.Data1 != 60 || ev.Data2 != 100 {
+			t.Errorf("note on is %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no note")
+	}
+
+	// packets are handled in order, so once a query's answered everything before it is done
+	sync := func() {
+		send(Message{Address: "/patch/mix"})
+		if reply := receive(); reply.Address != "/patch/mix" {
+			t.Fatalf("expected the mix back, got %+v", reply)
+		}
+	}
+
+	// patches are kept in the patch directory, by name
+	send(Message{Address: "/patch/save", Args: []interface{}{"bass"}})
+	send(Message{Address: "/patch/save", Args: []interface{}{"../escaped"}})
+	sync()
+	if _, err := os.Stat(filepath.Join(dir, "patches", "bass.json")); err != nil {
+		t.Errorf("saving: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.json")); err == nil {
+		t.Errorf("saved outside the patch directory")
+	}
+
+	// midi learn can be armed remotely, and disarmed without a path
+	attack := patch.ENV_ATTACK | patch.GRP_VCA
+	send(Message{Address: "/patch/learn", Args: []interface{}{"/patch/env/vca/attack"}})
+	sync()
+	if id, ok := p.Learning(); !ok || id != attack {
+		t.Errorf("learning %x %v, want attack", id, ok)
+	}
+	send(Message{Address: "/patch/learn"})
+	sync()
+	if _, ok := p.Learning(); ok {
+		t.Errorf("still learning after disarming")
+	}
+	send(Message{Address: "/patch/learn", Args: []interface{}{"/patch/env/vca/attack"}})
+	sync()
+	p.HandleChannelCC(0, 0x40, 64)
+	if id, ok := p.MappedParam(0, 0x40); !ok || id != attack {
+		t.Errorf("the controller that moved next mapped to %x %v, want attack", id, ok)
+	}
+
+	// subscribers hear about changes made anywhere
+	send(Message{Address: "/patch/subscribe"})
+	sync()
+	p.Uint16Param(patch.ENV_RELEASE | patch.GRP_VCA).Set(1000)
+	if reply := receive(); reply.Address != "/patch/env/vca/release" || reply.Args[0] != float32(1000) {
+		t.Errorf("subscription sent %+v", reply)
+	}
+}
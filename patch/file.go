@@ -0,0 +1,136 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+// Float is a param's value in the same units as its Meta's range
+func Float(prm Param) float64 {
+	switch prm := prm.(type) {
+	case *ByteParam:
+		return float64(prm.Byte())
+	case *BoolParam:
+		if prm.Bool() {
+			return 1
+		}
+		return 0
+	case *Uint16Param:
+		return float64(prm.Uint16())
+	case *Fp32Param:
+		return float64(prm.Fp32()) / float64(1<<16)
+	}
+	return 0
+}
+
+// SetFloat sets a param from a value in its Meta's units, clamped to its range
+func SetFloat(prm Param, v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	v = math.Max(prm.Meta().Min(), math.Min(prm.Meta().Max(), v))
+	switch prm := prm.(type) {
+	case *ByteParam:
+		prm.Set(byte(math.Round(v)))
+	case *BoolParam:
+		prm.Set(v >= 0.5)
+	case *Uint16Param:
+		prm.Set(uint16(math.Round(v)))
+	case *Fp32Param:
+		prm.Set(fp.Float2Fp32(v))
+	}
+}
+
+// Values is every param's value by its path, which is how patches are saved
+func (p *Patch) Values() map[string]float64 {
+	values := make(map[string]float64, len(p.params))
+	for path, prm := range p.byPath {
+		values[path] = Float(prm)
+	}
+	return values
+}
+
+// SetValues sets the params given by path, leaving the rest alone.  Params that
+// don't exist are skipped and reported in the error once the others are set
+func (p *Patch) SetValues(values map[string]float64) error {
+	var unknown []string
+	for path, v := range values {
+		if prm, ok := p.byPath[path]; ok {
+			SetFloat(prm, v)
+		} else {
+			unknown = append(unknown, path)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown params %v", unknown)
+	}
+	return nil
+}
+
+// Save writes the patch to a json file
+func (p *Patch) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p.Values()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load sets the params from a file written by Save.  Everything that changes is
+// announced to subscribers like any other change, so the UI and midi out follow
+func (p *Patch) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var values map[string]float64
+	if err := json.NewDecoder(f).Decode(&values); err != nil {
+		return err
+	}
+	return p.SetValues(values)
+}
+
+// NamedFile is where a patch called name lives in dir.  Names come from remote control,
+// so they're a bare file name without the .json, and anything that could reach outside
+// dir is refused
+func NamedFile(dir, name string) (string, error) {
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`+string(filepath.Separator)+"\x00") {
+		return "", fmt.Errorf("bad patch name %q, it should be a bare file name", name)
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// SaveNamed saves the patch as name in dir, making dir if it isn't there yet
+func (p *Patch) SaveNamed(dir, name string) error {
+	path, err := NamedFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return p.Save(path)
+}
+
+// LoadNamed loads the patch saved as name in dir
+func (p *Patch) LoadNamed(dir, name string) error {
+	path, err := NamedFile(dir, name)
+	if err != nil {
+		return err
+	}
+	return p.Load(path)
+}
@@ -0,0 +1,78 @@
+package patch
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestParamPaths(t *testing.T) {
+	p := InitialPatch()
+	assertEqual(t, (ENV_ATTACK | GRP_VCA).Path(), "/patch/env/vca/attack", "")
+	assertEqual(t, (OPR_RATIO | GRP_B2).Path(), "/patch/opr/b2/ratio", "")
+	assertEqual(t, PATCH_ALGORITHM.Path(), "/patch/algorithm", "")
+
+	// every param has a name of its own
+	for _, prm := range p.Params() {
+		path := prm.ID().Path()
+		if found, ok := p.ParamByPath(path); !ok || found != prm {
+			t.Errorf("%x's path %s finds %v", prm.ID(), path, found)
+		}
+		if path == fmt.Sprintf("/patch/%04x", uint16(prm.ID())) {
+			t.Errorf("%x has no name, its path is %s", prm.ID(), path)
+		}
+	}
+}
+
+func TestPatchSaveLoad(t *testing.T) {
+	p := InitialPatch()
+	SetFloat(p.GetParam(ENV_ATTACK|GRP_VCA), 123.4)
+	SetFloat(p.GetParam(PATCH_MIX), 0.25)
+	SetFloat(p.GetParam(ENV_GATED|GRP_A), 1)
+	SetFloat(p.GetParam(PATCH_ALGORITHM), 99) // clamped
+
+	path := filepath.Join(t.TempDir(), "patch.json")
+	if err := p.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := InitialPatch()
+	if err := fresh.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, fresh.Uint16Param(ENV_ATTACK|GRP_VCA).Uint16(), uint16(123), "")
+	assertEqual(t, Float(fresh.GetParam(PATCH_MIX)), 0.25, "")
+	assertEqual(t, fresh.BoolParam(ENV_GATED|GRP_A).Bool(), true, "")
+	assertEqual(t, fresh.ByteParam(PATCH_ALGORITHM).Byte(), byte(len(AlgorithmNames)-1), "")
+
+	if err := fresh.SetValues(map[string]float64{"/patch/nope": 1}); err == nil {
+		t.Errorf("expected an error for an unknown param")
+	}
+}
+
+func TestNamedPatches(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "patches")
+	for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`, "/etc/passwd", "..hidden"} {
+		if _, err := NamedFile(dir, name); err == nil {
+			t.Errorf("%q was allowed", name)
+		}
+	}
+	path, err := NamedFile(dir, "bass")
+	if err != nil || path != filepath.Join(dir, "bass.json") {
+		t.Errorf("bass is %q, %v", path, err)
+	}
+
+	p := InitialPatch()
+	SetFloat(p.GetParam(PATCH_MIX), 0.75)
+	if err := p.SaveNamed(dir, "bass"); err != nil {
+		t.Fatal(err)
+	}
+	fresh := InitialPatch()
+	if err := fresh.LoadNamed(dir, "bass"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, Float(fresh.GetParam(PATCH_MIX)), 0.75, "")
+	if err := fresh.SaveNamed(dir, "../escape"); err == nil {
+		t.Errorf("saved outside the patch directory")
+	}
+}
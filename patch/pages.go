@@ -0,0 +1,97 @@
+package patch
+
+import "sync"
+
+// a page is eight params that belong together, edited with a row of eight knobs
+// on the screen or on a hardware controller
+type Page struct {
+	Name   string
+	Params []ParamId
+}
+
+var Pages = []Page{
+	{"MAIN", []ParamId{
+		PATCH_ALGORITHM, OPR_RATIO | GRP_A, OPR_RATIO | GRP_B1, OPR_RATIO | GRP_C,
+		ENV_ATTACK | GRP_VCA, ENV_DECAY | GRP_VCA, ENV_SUSTAIN | GRP_VCA, ENV_RELEASE | GRP_VCA,
+	}},
+	{"VOICE", []ParamId{
+		PATCH_FEEDBACK, PATCH_MIX, ENV_INDEX | GRP_A, ENV_INDEX | GRP_B,
+		OPR_RATIO | GRP_B2, PATCH_ENV_MODE, PATCH_SMOOTHING, ENV_RATE_SCALE | GRP_VCA,
+	}},
+	{"ENV A", []ParamId{
+		ENV_ATTACK | GRP_A, ENV_DECAY | GRP_A, ENV_ENDLEVEL | GRP_A, ENV_INDEX | GRP_A,
+		ENV_GATED | GRP_A, ENV_RETRIGGER | GRP_A, ENV_ATTACK_CURVE | GRP_A, ENV_DECAY_CURVE | GRP_A,
+	}},
+	{"ENV B", []ParamId{
+		ENV_ATTACK | GRP_B, ENV_DECAY | GRP_B, ENV_ENDLEVEL | GRP_B, ENV_INDEX | GRP_B,
+		ENV_GATED | GRP_B, ENV_RETRIGGER | GRP_B, ENV_ATTACK_CURVE | GRP_B, ENV_DECAY_CURVE | GRP_B,
+	}},
+	{"WAVES", []ParamId{
+		OPR_WAVEFORM | GRP_A, OPR_WAVEFORM | GRP_B1, OPR_WAVEFORM | GRP_B2, OPR_WAVEFORM | GRP_C,
+		OPR_DETUNE | GRP_A, OPR_DETUNE | GRP_B1, OPR_DETUNE | GRP_B2, OPR_DETUNE | GRP_C,
+	}},
+	{"FIXED", []ParamId{
+		OPR_FIXED | GRP_A, OPR_FIXED | GRP_B1, OPR_FIXED | GRP_B2, OPR_FIXED | GRP_C,
+		OPR_FREQ | GRP_A, OPR_FREQ | GRP_B1, OPR_FREQ | GRP_B2, OPR_FREQ | GRP_C,
+	}},
+	{"DX VCA", []ParamId{
+		ENV_R1 | GRP_VCA, ENV_R2 | GRP_VCA, ENV_R3 | GRP_VCA, ENV_R4 | GRP_VCA,
+		ENV_L1 | GRP_VCA, ENV_L2 | GRP_VCA, ENV_L3 | GRP_VCA, ENV_L4 | GRP_VCA,
+	}},
+	// the expression depths next to what they're modulating
+	{"MPE", []ParamId{
+		PATCH_BEND_RANGE, PATCH_PRESSURE_LEVEL, PATCH_PRESSURE_INDEX, PATCH_TIMBRE_INDEX,
+		ENV_INDEX | GRP_A, ENV_INDEX | GRP_B, PATCH_FEEDBACK, PATCH_MIX,
+	}},
+}
+
+// PageSelector is the page being edited, shared by the screen and any hardware
+// controllers so they all follow each other
+type PageSelector struct {
+	mu        sync.Mutex
+	page      int
+	listeners []chan int
+}
+
+func (s *PageSelector) Page() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.page
+}
+
+// Select shows page n, wrapping around at either end
+func (s *PageSelector) Select(n int) {
+	n %= len(Pages)
+	if n < 0 {
+		n += len(Pages)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.page = n
+	for _, l := range s.listeners {
+		// only the latest page matters to a listener that's behind
+		select {
+		case <-l:
+		default:
+		}
+		l <- n
+	}
+}
+
+func (s *PageSelector) Next() {
+	s.Select(s.Page() + 1)
+}
+
+func (s *PageSelector) Prev() {
+	s.Select(s.Page() - 1)
+}
+
+// Changes delivers the page number each time it changes
+func (s *PageSelector) Changes() <-chan int {
+	l := make(chan int, 1)
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+	return l
+}
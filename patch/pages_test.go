@@ -0,0 +1,39 @@
+package patch
+
+import "testing"
+
+func TestPages(t *testing.T) {
+	p := InitialPatch()
+	for _, page := range Pages {
+		if len(page.Params) != 8 {
+			t.Errorf("page %s has %d params", page.Name, len(page.Params))
+		}
+		// the labels are all a screen or an LCD has to tell the knobs apart
+		labels := make(map[string]bool)
+		for _, id := range page.Params {
+			prm := p.GetParam(id)
+			if prm == nil {
+				t.Errorf("page %s has unknown param %x", page.Name, id)
+				continue
+			}
+			if labels[prm.Label()] {
+				t.Errorf("page %s has %q more than once", page.Name, prm.Label())
+			}
+			labels[prm.Label()] = true
+		}
+	}
+
+	s := &PageSelector{}
+	changes := s.Changes()
+	s.Prev()
+	s.Next()
+	s.Next()
+	assertEqual(t, s.Page(), 1, "")
+	// a listener that's behind only sees the latest page
+	assertEqual(t, <-changes, 1, "")
+	select {
+	case n := <-changes:
+		t.Errorf("unexpected stale page %d", n)
+	default:
+	}
+}
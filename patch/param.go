@@ -1,9 +1,16 @@
 package patch
 
-import "github.com/ianmcmahon/fmsynth/fp"
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
 
-type ParamId uint8
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+type ParamId uint16
 
+// the low two bits are the group, the next two the type, and the remaining bits index the param within its type
 // these constants are combined together to get the unique param id for a particular param,
 // for instance envelope B's decay is ENV_DECAY|GRP_B, and operator B2's feedback would be OPR_FEEDBACK|GRP_B2
 // note that each operator has a feedback param, but in the digitone scheme only one operator
@@ -25,20 +32,119 @@ const (
 	PATCH_ALGORITHM ParamId = 0x0<<4 | PATCH_TYPE
 	PATCH_FEEDBACK  ParamId = 0x1<<4 | PATCH_TYPE
 	PATCH_MIX       ParamId = 0x2<<4 | PATCH_TYPE
+	PATCH_ENV_MODE  ParamId = 0x3<<4 | PATCH_TYPE
+	PATCH_SMOOTHING ParamId = 0x4<<4 | PATCH_TYPE // ms for continuous params to ramp to a new value
+	// per note expression from MPE controllers, or per channel from anything else
+	PATCH_BEND_RANGE     ParamId = 0x5<<4 | PATCH_TYPE // semitones a member channel's full bend reaches
+	PATCH_PRESSURE_LEVEL ParamId = 0x6<<4 | PATCH_TYPE // how much of the level pressure controls
+	PATCH_PRESSURE_INDEX ParamId = 0x7<<4 | PATCH_TYPE // index added at full pressure
+	PATCH_TIMBRE_INDEX   ParamId = 0x8<<4 | PATCH_TYPE // index added at full timbre (CC74), taken away at its lowest
+
+	OPR_RATIO     ParamId = 0x0<<4 | OPR_TYPE
+	OPR_FEEDBACK  ParamId = 0x1<<4 | OPR_TYPE
+	OPR_WAVEFORM  ParamId = 0x2<<4 | OPR_TYPE
+	OPR_FIXED     ParamId = 0x3<<4 | OPR_TYPE
+	OPR_FREQ      ParamId = 0x4<<4 | OPR_TYPE
+	OPR_DETUNE    ParamId = 0x5<<4 | OPR_TYPE
+	OPR_LS_BREAK  ParamId = 0x6<<4 | OPR_TYPE // keyboard level scaling breakpoint note
+	OPR_LS_LDEPTH ParamId = 0x7<<4 | OPR_TYPE
+	OPR_LS_RDEPTH ParamId = 0x8<<4 | OPR_TYPE
+	OPR_LS_LCURVE ParamId = 0x9<<4 | OPR_TYPE
+	OPR_LS_RCURVE ParamId = 0xA<<4 | OPR_TYPE
+
+	ENV_ATTACK        ParamId = 0x0<<4 | ENV_TYPE
+	ENV_DECAY         ParamId = 0x1<<4 | ENV_TYPE
+	ENV_ENDLEVEL      ParamId = 0x2<<4 | ENV_TYPE
+	ENV_INDEX         ParamId = 0x3<<4 | ENV_TYPE
+	ENV_GATED         ParamId = 0x4<<4 | ENV_TYPE
+	ENV_RETRIGGER     ParamId = 0x5<<4 | ENV_TYPE
+	ENV_SUSTAIN       ParamId = 0x6<<4 | ENV_TYPE
+	ENV_RELEASE       ParamId = 0x7<<4 | ENV_TYPE
+	ENV_RATE_SCALE    ParamId = 0x8<<4 | ENV_TYPE
+	ENV_ATTACK_CURVE  ParamId = 0x9<<4 | ENV_TYPE
+	ENV_DECAY_CURVE   ParamId = 0xA<<4 | ENV_TYPE
+	ENV_RELEASE_CURVE ParamId = 0xB<<4 | ENV_TYPE
+	// DX style rates and levels, 0-99
+	ENV_R1         ParamId = 0xC<<4 | ENV_TYPE
+	ENV_R2         ParamId = 0xD<<4 | ENV_TYPE
+	ENV_R3         ParamId = 0xE<<4 | ENV_TYPE
+	ENV_R4         ParamId = 0xF<<4 | ENV_TYPE
+	ENV_L1         ParamId = 0x10<<4 | ENV_TYPE
+	ENV_L2         ParamId = 0x11<<4 | ENV_TYPE
+	ENV_L3         ParamId = 0x12<<4 | ENV_TYPE
+	ENV_L4         ParamId = 0x13<<4 | ENV_TYPE
+	ENV_LOOP_START ParamId = 0x14<<4 | ENV_TYPE
+	ENV_LOOP_END   ParamId = 0x15<<4 | ENV_TYPE
+	ENV_LOOP_MODE  ParamId = 0x16<<4 | ENV_TYPE
+)
+
+// keyboard level scaling curves, in the order the DX7 lists them
+// the negative curves turn the operator down away from the breakpoint,
+// the positive ones turn it up
+const (
+	CURVE_NEG_LIN byte = iota
+	CURVE_NEG_EXP
+	CURVE_POS_EXP
+	CURVE_POS_LIN
+)
+
+// envelope implementations selectable with PATCH_ENV_MODE
+const (
+	ENV_MODE_CLASSIC    byte = iota // attack/decay/end for the algorithm, ADSR for the VCA
+	ENV_MODE_RATE_LEVEL             // DX style four rates and levels for all of them
+)
 
-	OPR_RATIO    ParamId = 0x0<<4 | OPR_TYPE
-	OPR_FEEDBACK ParamId = 0x1<<4 | OPR_TYPE
-
-	ENV_ATTACK    ParamId = 0x0<<4 | ENV_TYPE
-	ENV_DECAY     ParamId = 0x1<<4 | ENV_TYPE
-	ENV_ENDLEVEL  ParamId = 0x2<<4 | ENV_TYPE
-	ENV_INDEX     ParamId = 0x3<<4 | ENV_TYPE
-	ENV_GATED     ParamId = 0x4<<4 | ENV_TYPE
-	ENV_RETRIGGER ParamId = 0x5<<4 | ENV_TYPE
-	ENV_SUSTAIN   ParamId = 0x6<<4 | ENV_TYPE
-	ENV_RELEASE   ParamId = 0x7<<4 | ENV_TYPE
+// envelope loop modes, for both envelope types
+// the rate/level envelope also needs its loop points set to loop
+const (
+	LOOP_ONE_SHOT byte = iota // run straight through
+	LOOP_GATED                // cycle attack and decay while the note is held
+	LOOP_FOREVER              // keep cycling after the note is released
+)
+
+// display names for the enumerated params
+var (
+	AlgorithmNames = []string{"1", "2", "3"}
+	WaveformNames  = []string{
+		"SINE", "SQ SINE", "HALF", "HALF SQ", "PULSE", "PULSE SQ",
+		"CAMEL", "CAMEL SQ", "ABS", "QUARTER", "SAW", "SQUARE",
+	}
+	CurveNames    = []string{"-LIN", "-EXP", "+EXP", "+LIN"}
+	EnvModeNames  = []string{"CLASSIC", "DX"}
+	LoopModeNames = []string{"OFF", "GATED", "FOREVER"}
+)
+
+// what a param's value measures, for display
+type Unit byte
+
+const (
+	UNIT_NONE Unit = iota
+	UNIT_HZ
+	UNIT_MS
+	UNIT_PERCENT // a 0-1 value shown as 0-100%
+	UNIT_RATIO
+	UNIT_SEMITONES
+	UNIT_CENTS
 )
 
+func (u Unit) String() string {
+	switch u {
+	case UNIT_HZ:
+		return "Hz"
+	case UNIT_MS:
+		return "ms"
+	case UNIT_PERCENT:
+		return "%"
+	case UNIT_RATIO:
+		return "ratio"
+	case UNIT_SEMITONES:
+		return "st"
+	case UNIT_CENTS:
+		return "ct"
+	}
+	return ""
+}
+
 type Meta struct {
 	patch *Patch
 	label string
@@ -46,7 +152,113 @@ type Meta struct {
 	// font/color overrides?
 	cc byte
 
-	// domain/range info and conversion from cc val
+	// range and display info, in the param's own units whatever its storage type
+	min, max float64
+	def      float64
+	step     float64 // the change one cc step makes, 0 if it isn't uniform
+	unit     Unit
+	format   func(float64) string
+}
+
+func (m Meta) Min() float64 {
+	return m.min
+}
+
+func (m Meta) Max() float64 {
+	return m.max
+}
+
+func (m Meta) Default() float64 {
+	return m.def
+}
+
+func (m Meta) Step() float64 {
+	return m.step
+}
+
+func (m Meta) Unit() Unit {
+	return m.unit
+}
+
+// Format renders a value of this param for display, "120 ms", "1.50" or "SAW"
+func (m Meta) Format(v float64) string {
+	if m.format != nil {
+		return m.format(v)
+	}
+	return formatUnit(m.unit, m.step, v)
+}
+
+func formatUnit(unit Unit, step float64, v float64) string {
+	switch unit {
+	case UNIT_HZ:
+		if v >= 1000 {
+			return fmt.Sprintf("%.2f kHz", v/1000)
+		}
+		return fmt.Sprintf("%.1f Hz", v)
+	case UNIT_MS:
+		if v >= 1000 {
+			return fmt.Sprintf("%.2f s", v/1000)
+		}
+		return fmt.Sprintf("%.0f ms", v)
+	case UNIT_PERCENT:
+		return fmt.Sprintf("%.0f%%", v*100)
+	case UNIT_RATIO:
+		return fmt.Sprintf("%.2f", v)
+	case UNIT_SEMITONES:
+		return fmt.Sprintf("%+.2f st", v)
+	case UNIT_CENTS:
+		return fmt.Sprintf("%+.0f ct", v)
+	}
+	if step >= 1 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// formats enumerated values with their names
+func namesFormat(names []string) func(float64) string {
+	return func(v float64) string {
+		i := int(v)
+		if i < 0 || i >= len(names) {
+			return fmt.Sprintf("%d", i)
+		}
+		return names[i]
+	}
+}
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// midi note numbers as note names, middle C (60) is C4
+func noteFormat(v float64) string {
+	n := int(v)
+	return fmt.Sprintf("%s%d", noteNames[n%12], n/12-1)
+}
+
+// the top of a 14 bit controller's travel, from an MSB/LSB cc pair or NRPN data entry
+const CC14_MAX = 1<<14 - 1
+
+// scales a 14 bit controller value onto min-max, like byteRange does for 7 bits
+func range14(v uint16, min, max uint32) uint32 {
+	return min + (uint32(v)*(max+1-min))>>14
+}
+
+// the inverse of range14, the lowest controller value that maps to v
+func rangeToCC14(v, min, max uint32) uint16 {
+	if v <= min {
+		return 0
+	}
+	span := max + 1 - min
+	cc := ((v-min)<<14 + span - 1) / span
+	if cc > CC14_MAX {
+		return CC14_MAX
+	}
+	return uint16(cc)
+}
+
+// NRPN numbers are param ids, which fit in the 14 bits NRPN gives us
+// this splits the id into the values a controller sends on cc 99 and 98
+func (id ParamId) NRPN() (msb, lsb byte) {
+	return byte(id>>7) & 0x7F, byte(id) & 0x7F
 }
 
 // a param wraps an fp32 or midi cc val etc
@@ -57,166 +269,362 @@ type Meta struct {
 type Param interface {
 	ID() ParamId
 	Label() string
+	Meta() Meta
 	Value() interface{}
+	Format() string
 	SetFromCC(byte)
 	ValAsCC() byte
+	SetFromCC14(uint16)
+	ValAsCC14() uint16
 }
 
-type byteparam struct {
-	id   ParamId
-	val  byte
-	meta Meta
+// the concrete param types store their values in 32 bits and access them with sync/atomic
+// the audio thread reads them every sample with the typed getters (Byte, Fp32 etc)
+// while the midi and ui goroutines Set them, so there's no locking and no boxing in the render loop
+// Set clamps to the param's range, so nothing downstream sees an out of range value
+
+type ByteParam struct {
+	id     ParamId
+	val    uint32
+	meta   Meta
+	fromCC func(byte) byte
 }
 
-func (p *byteparam) ID() ParamId {
+func (p *ByteParam) ID() ParamId {
 	return p.id
 }
 
-func (p *byteparam) Label() string {
+func (p *ByteParam) Label() string {
 	return p.meta.label
 }
 
-func (p *byteparam) Value() interface{} {
-	return p.val
+func (p *ByteParam) Meta() Meta {
+	return p.meta
+}
+
+func (p *ByteParam) Byte() byte {
+	return byte(atomic.LoadUint32(&p.val))
+}
+
+func (p *ByteParam) Value() interface{} {
+	return p.Byte()
+}
+
+func (p *ByteParam) Format() string {
+	return p.meta.Format(float64(p.Byte()))
 }
 
-func (p *byteparam) Set(v byte) {
-	p.val = v
+func (p *ByteParam) Set(v byte) {
+	if min := byte(p.meta.min); v < min {
+		v = min
+	}
+	if max := byte(p.meta.max); v > max {
+		v = max
+	}
+	atomic.StoreUint32(&p.val, uint32(v))
 	p.meta.patch.update(p.id)
 }
 
-func (p *byteparam) SetFromCC(v byte) {
-	p.Set(v)
+func (p *ByteParam) SetFromCC(v byte) {
+	p.Set(p.fromCC(v))
 }
 
-func (p *byteparam) ValAsCC() byte {
-	return p.val
+func (p *ByteParam) ValAsCC() byte {
+	return byteToCC(p.Byte(), byte(p.meta.min), byte(p.meta.max))
 }
 
-func NewByteParam(id ParamId, defaultValue byte, meta Meta) *byteparam {
-	return &byteparam{
-		id:   id,
-		val:  defaultValue,
-		meta: meta,
+func (p *ByteParam) SetFromCC14(v uint16) {
+	p.Set(byte(range14(v, uint32(p.meta.min), uint32(p.meta.max))))
+}
+
+func (p *ByteParam) ValAsCC14() uint16 {
+	return rangeToCC14(uint32(p.Byte()), uint32(p.meta.min), uint32(p.meta.max))
+}
+
+// a zero range in meta means the full 0-127
+func NewByteParam(id ParamId, defaultValue byte, meta Meta) *ByteParam {
+	if meta.min == 0 && meta.max == 0 {
+		meta.max = 127
+	}
+	if meta.step == 0 {
+		meta.step = 1
+	}
+	meta.def = float64(defaultValue)
+	return &ByteParam{
+		id:     id,
+		val:    uint32(defaultValue),
+		meta:   meta,
+		fromCC: byteRange(byte(meta.min), byte(meta.max)),
 	}
 }
 
-type boolparam struct {
+type BoolParam struct {
 	id   ParamId
-	val  bool
+	val  uint32
 	meta Meta
 }
 
-func (p *boolparam) ID() ParamId {
+func (p *BoolParam) ID() ParamId {
 	return p.id
 }
 
-func (p *boolparam) Label() string {
+func (p *BoolParam) Label() string {
 	return p.meta.label
 }
 
-func (p *boolparam) Value() interface{} {
-	return p.val
+func (p *BoolParam) Meta() Meta {
+	return p.meta
+}
+
+func (p *BoolParam) Bool() bool {
+	return atomic.LoadUint32(&p.val) != 0
+}
+
+func (p *BoolParam) Value() interface{} {
+	return p.Bool()
+}
+
+func (p *BoolParam) Format() string {
+	return p.meta.Format(float64(atomic.LoadUint32(&p.val)))
 }
 
-func (p *boolparam) Set(v bool) {
-	p.val = v
+func (p *BoolParam) Set(v bool) {
+	var u uint32
+	if v {
+		u = 1
+	}
+	atomic.StoreUint32(&p.val, u)
 	p.meta.patch.update(p.id)
 }
 
-func (p *boolparam) ValAsCC() byte {
-	if p.val {
+func (p *BoolParam) ValAsCC() byte {
+	if p.Bool() {
 		return 127
 	}
 	return 0
 }
 
-func (p *boolparam) SetFromCC(v byte) {
+func (p *BoolParam) SetFromCC(v byte) {
 	p.Set(v >= 64)
 }
 
-func NewBoolParam(id ParamId, defaultValue bool, meta Meta) *boolparam {
-	return &boolparam{
+func (p *BoolParam) ValAsCC14() uint16 {
+	if p.Bool() {
+		return CC14_MAX
+	}
+	return 0
+}
+
+func (p *BoolParam) SetFromCC14(v uint16) {
+	p.Set(v >= CC14_MAX/2+1)
+}
+
+func NewBoolParam(id ParamId, defaultValue bool, meta Meta) *BoolParam {
+	meta.min, meta.max, meta.step = 0, 1, 1
+	if meta.format == nil {
+		meta.format = namesFormat([]string{"OFF", "ON"})
+	}
+	p := &BoolParam{
 		id:   id,
-		val:  defaultValue,
 		meta: meta,
 	}
+	if defaultValue {
+		p.val = 1
+		p.meta.def = 1
+	}
+	return p
 }
 
-type uint16param struct {
-	id   ParamId
-	val  uint16
-	meta Meta
+type Uint16Param struct {
+	id     ParamId
+	val    uint32
+	meta   Meta
+	fromCC func(byte) uint16
 }
 
-func (p *uint16param) ID() ParamId {
+func (p *Uint16Param) ID() ParamId {
 	return p.id
 }
 
-func (p *uint16param) Label() string {
+func (p *Uint16Param) Label() string {
 	return p.meta.label
 }
 
-func (p *uint16param) Value() interface{} {
-	return p.val
+func (p *Uint16Param) Meta() Meta {
+	return p.meta
+}
+
+func (p *Uint16Param) Uint16() uint16 {
+	return uint16(atomic.LoadUint32(&p.val))
+}
+
+func (p *Uint16Param) Value() interface{} {
+	return p.Uint16()
+}
+
+func (p *Uint16Param) Format() string {
+	return p.meta.Format(float64(p.Uint16()))
 }
 
-func (p *uint16param) Set(v uint16) {
-	p.val = v
+func (p *Uint16Param) Set(v uint16) {
+	if min := uint16(p.meta.min); v < min {
+		v = min
+	}
+	if max := uint16(p.meta.max); v > max {
+		v = max
+	}
+	atomic.StoreUint32(&p.val, uint32(v))
 	p.meta.patch.update(p.id)
 }
 
-func (p *uint16param) SetFromCC(v byte) {
-	p.Set(uint16(v) << 9)
+func (p *Uint16Param) SetFromCC(v byte) {
+	p.Set(p.fromCC(v))
 }
 
-func (p *uint16param) ValAsCC() byte {
-	return byte(p.val >> 9)
+func (p *Uint16Param) ValAsCC() byte {
+	return uint16ToCC(p.Uint16(), uint16(p.meta.min), uint16(p.meta.max))
 }
 
-func NewUint16Param(id ParamId, defaultValue uint16, meta Meta) *uint16param {
-	return &uint16param{
-		id:   id,
-		val:  defaultValue,
-		meta: meta,
+func (p *Uint16Param) SetFromCC14(v uint16) {
+	p.Set(uint16(range14(v, uint32(p.meta.min), uint32(p.meta.max))))
+}
+
+func (p *Uint16Param) ValAsCC14() uint16 {
+	return rangeToCC14(uint32(p.Uint16()), uint32(p.meta.min), uint32(p.meta.max))
+}
+
+// a zero range in meta means the full 0-65535
+func NewUint16Param(id ParamId, defaultValue uint16, meta Meta) *Uint16Param {
+	if meta.min == 0 && meta.max == 0 {
+		meta.max = math.MaxUint16
+	}
+	meta.step = (meta.max + 1 - meta.min) / 128
+	meta.def = float64(defaultValue)
+	return &Uint16Param{
+		id:     id,
+		val:    uint32(defaultValue),
+		meta:   meta,
+		fromCC: uint16Range(uint16(meta.min), uint16(meta.max)),
 	}
 }
 
-type fp32param struct {
-	id   ParamId
-	val  fp.Fp32
-	meta Meta
+type Fp32Param struct {
+	id      ParamId
+	val     int32
+	meta    Meta
+	mapping fp32Mapping
+}
+
+// converts between controller positions and fp32 param values
+// a position runs from 0 at the bottom of the controller's travel to 1 at the top,
+// so the same mapping serves 7 bit and 14 bit controllers
+type fp32Mapping struct {
+	fromPos func(float64) fp.Fp32
+	toPos   func(fp.Fp32) float64
+
+	min, max, step float64
+}
+
+func (m fp32Mapping) fromCC(v byte) fp.Fp32 {
+	return m.fromPos(float64(v) / 127.0)
+}
+
+func (m fp32Mapping) toCC(v fp.Fp32) byte {
+	return ccClamp(math.Round(m.toPos(v) * 127.0))
+}
+
+func (m fp32Mapping) fromCC14(v uint16) fp.Fp32 {
+	return m.fromPos(float64(v) / CC14_MAX)
+}
+
+func (m fp32Mapping) toCC14(v fp.Fp32) uint16 {
+	pos := math.Round(m.toPos(v) * CC14_MAX)
+	if pos < 0 {
+		return 0
+	}
+	if pos > CC14_MAX {
+		return CC14_MAX
+	}
+	return uint16(pos)
 }
 
-func (p *fp32param) ID() ParamId {
+// the default mapping centers cc 64 on zero with a span of +/- 0.25
+var defaultFp32Mapping = fp32Mapping{
+	fromPos: func(pos float64) fp.Fp32 {
+		return fp.Float2Fp32((pos*127.0 - 64) / 256.0)
+	},
+	toPos: func(v fp.Fp32) float64 {
+		return (float64(v)/float64(1<<8) + 64) / 127.0
+	},
+	min:  -0.25,
+	max:  63.0 / 256.0,
+	step: 1.0 / 256.0,
+}
+
+func (p *Fp32Param) ID() ParamId {
 	return p.id
 }
 
-func (p *fp32param) Label() string {
+func (p *Fp32Param) Label() string {
 	return p.meta.label
 }
 
-func (p *fp32param) Value() interface{} {
-	return p.val
+func (p *Fp32Param) Meta() Meta {
+	return p.meta
+}
+
+func (p *Fp32Param) Fp32() fp.Fp32 {
+	return fp.Fp32(atomic.LoadInt32(&p.val))
+}
+
+func (p *Fp32Param) Value() interface{} {
+	return p.Fp32()
+}
+
+func (p *Fp32Param) Format() string {
+	return p.meta.Format(float64(p.Fp32()) / float64(1<<16))
 }
 
-func (p *fp32param) Set(v fp.Fp32) {
-	p.val = v
+func (p *Fp32Param) Set(v fp.Fp32) {
+	if min := fp.Float2Fp32(p.meta.min); v < min {
+		v = min
+	}
+	if max := fp.Float2Fp32(p.meta.max); v > max {
+		v = max
+	}
+	atomic.StoreInt32(&p.val, int32(v))
 	p.meta.patch.update(p.id)
 }
 
-func (p *fp32param) SetFromCC(v byte) {
-	p.Set((fp.Fp32(v) - 64) << 8)
+func (p *Fp32Param) SetFromCC(v byte) {
+	p.Set(p.mapping.fromCC(v))
+}
+
+func (p *Fp32Param) ValAsCC() byte {
+	return p.mapping.toCC(p.Fp32())
+}
+
+func (p *Fp32Param) SetFromCC14(v uint16) {
+	p.Set(p.mapping.fromCC14(v))
+}
+
+func (p *Fp32Param) ValAsCC14() uint16 {
+	return p.mapping.toCC14(p.Fp32())
 }
 
-func (p *fp32param) ValAsCC() byte {
-	return byte((p.val >> 8) + 64)
+// the range comes from the mapping
+func (p *Fp32Param) setMapping(m fp32Mapping) {
+	p.mapping = m
+	p.meta.min, p.meta.max, p.meta.step = m.min, m.max, m.step
 }
 
-func NewFp32Param(id ParamId, defaultValue float64, meta Meta) *fp32param {
-	return &fp32param{
+func NewFp32Param(id ParamId, defaultValue float64, meta Meta) *Fp32Param {
+	meta.def = defaultValue
+	p := &Fp32Param{
 		id:   id,
-		val:  fp.Float2Fp32(defaultValue),
+		val:  int32(fp.Float2Fp32(defaultValue)),
 		meta: meta,
 	}
+	p.setMapping(defaultFp32Mapping)
+	return p
 }
@@ -3,6 +3,11 @@ package patch
 import (
 	"fmt"
 	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ianmcmahon/fmsynth/fp"
 )
 
 /*
@@ -19,181 +24,435 @@ import (
 
 type Patch struct {
 	params map[ParamId]Param
-	byCC   map[byte]Param
+	byPath map[string]Param // see paths.go
+
+	// controller mappings, see profile.go.  They're read on the render loop, so
+	// they're replaced rather than changed and read without locking
+	byCC     atomic.Pointer[map[ccKey]Param]
+	learning atomic.Uint32 // the armed param's id+1, 0 when nothing's armed
+	onLearn  atomic.Pointer[func(Mapping)]
 
-	modified chan ParamId
+	subsMu      sync.Mutex // serializes changes to subs
+	subs        atomic.Pointer[[]*Subscription]
+	defaultSub  *Subscription
+	defaultOnce sync.Once
 }
 
+// HandleCC sets the param mapped to a controller on any channel
 func (p *Patch) HandleCC(num, val byte) {
-	if prm, ok := p.byCC[num]; ok {
+	p.HandleChannelCC(ANY_CHANNEL, num, val)
+}
+
+// HandleCC14 sets the param mapped to a 14 bit controller pair from its combined value
+// num is the MSB controller, 0-31
+func (p *Patch) HandleCC14(num byte, val uint16) {
+	p.HandleChannelCC14(ANY_CHANNEL, num, val)
+}
+
+// controllers that aren't mapped are ignored quietly, these are called from the
+// engine's render loop and a mod wheel sends a lot of them
+
+func (p *Patch) HandleChannelCC(channel, num, val byte) {
+	if prm := p.ControlledParam(channel, num); prm != nil {
 		prm.SetFromCC(val)
-	} else {
-		fmt.Printf("patch ignoring cc: %x %x\n", num, val)
-		fmt.Printf("%#v\n", p.byCC)
 	}
 }
 
+func (p *Patch) HandleChannelCC14(channel, num byte, val uint16) {
+	if prm := p.ControlledParam(channel, num); prm != nil {
+		prm.SetFromCC14(val)
+	}
+}
+
+// SetNRPN sets a param at full resolution, addressed by an NRPN number which is its ParamId
+func (p *Patch) SetNRPN(num, val uint16) {
+	if prm, ok := p.params[ParamId(num)]; ok {
+		prm.SetFromCC14(val)
+	}
+}
+
+// StepNRPN nudges a param for the data increment and decrement controllers
+func (p *Patch) StepNRPN(num uint16, delta int) {
+	p.Step(ParamId(num), delta)
+}
+
+// Step nudges a param by delta, for relative controllers like encoders
+// integer params move by one per step, the others by one 7 bit cc step
+func (p *Patch) Step(id ParamId, delta int) {
+	switch prm := p.params[id].(type) {
+	case *ByteParam:
+		prm.Set(byte(clampInt(int(prm.Byte())+delta, 0, math.MaxUint8)))
+	case *Uint16Param:
+		prm.Set(uint16(clampInt(int(prm.Uint16())+delta, 0, math.MaxUint16)))
+	case *BoolParam:
+		prm.Set(delta > 0)
+	case *Fp32Param:
+		prm.SetFromCC14(uint16(clampInt(int(prm.ValAsCC14())+delta<<7, 0, CC14_MAX)))
+	}
+}
+
+// the longest envelope segment in ms
+const envMaxTime = 4000
+
 func InitialPatch() *Patch {
 	p := &Patch{
-		params:   make(map[ParamId]Param, 0),
-		byCC:     make(map[byte]Param, 0),
-		modified: make(chan ParamId, 0),
-	}
-
-	p.addByte(PATCH_ALGORITHM, 0, "ALG", 3)
-	p.addFp32(PATCH_FEEDBACK, 0.0, "FEEDBK", 255)
-	p.addFp32(PATCH_MIX, 0.5, "MIX", 255)
-
-	p.addFp32(OPR_RATIO|GRP_A, 1.0, "A", 255)
-	p.addFp32(OPR_RATIO|GRP_B1, 1.0, "B1", 255)
-	p.addFp32(OPR_RATIO|GRP_B2, 1.0, "B2", 255)
-	p.addFp32(OPR_RATIO|GRP_C, 1.0, "C", 255)
-
-	p.addBool(ENV_GATED|GRP_A, true, "GATE", 255)
-	p.addBool(ENV_RETRIGGER|GRP_A, true, "RETRIG", 255)
-	p.addUint16(ENV_ATTACK|GRP_A, 0, "ATTACK", 255)
-	p.addUint16(ENV_DECAY|GRP_A, 0, "DECAY", 255)
-	p.addFp32(ENV_ENDLEVEL|GRP_A, 0.0, "ENDLVL", 255)
-	p.addFp32(ENV_INDEX|GRP_A, 1.0, "INDEX", 255)
-
-	p.addBool(ENV_GATED|GRP_B, true, "GATE", 255)
-	p.addBool(ENV_RETRIGGER|GRP_B, true, "RETRIG", 255)
-	p.addUint16(ENV_ATTACK|GRP_B, 0, "ATTACK", 255)
-	p.addUint16(ENV_DECAY|GRP_B, 0, "DECAY", 255)
-	p.addFp32(ENV_ENDLEVEL|GRP_B, 0.0, "ENDLVL", 255)
-	p.addFp32(ENV_INDEX|GRP_B, 1.0, "INDEX", 255)
+		params: make(map[ParamId]Param, 0),
+		byPath: make(map[string]Param, 0),
+	}
+	byCC := make(map[ccKey]Param, 0)
+	p.byCC.Store(&byCC)
+
+	p.addEnum(PATCH_ALGORITHM, 0, AlgorithmNames, "ALG", 3)
+	p.addFp32(PATCH_FEEDBACK, 0.0, UNIT_PERCENT, "FEEDBK", 255, fp32Range(0.0, 1.0))
+	p.addFp32(PATCH_MIX, 0.5, UNIT_PERCENT, "MIX", 255, fp32Range(0.0, 1.0))
+	p.addEnum(PATCH_ENV_MODE, ENV_MODE_CLASSIC, EnvModeNames, "ENVMODE", 255)
+	p.addUint16(PATCH_SMOOTHING, 20, 0, 500, UNIT_MS, "SMOOTH", 255)
+	p.addUint16(PATCH_BEND_RANGE, 48, 0, 96, UNIT_SEMITONES, "BENDRNG", 255)
+	p.addFp32(PATCH_PRESSURE_LEVEL, 0.0, UNIT_PERCENT, "PRS>LVL", 255, fp32Range(0.0, 1.0))
+	p.addFp32(PATCH_PRESSURE_INDEX, 0.0, UNIT_NONE, "PRS>IDX", 255, fp32Range(-4.0, 4.0))
+	p.addFp32(PATCH_TIMBRE_INDEX, 0.0, UNIT_NONE, "TMB>IDX", 255, fp32Range(-4.0, 4.0))
+
+	p.addFp32(OPR_RATIO|GRP_A, 1.0, UNIT_RATIO, "A", 255, fp32Steps(Ratios))
+	p.addFp32(OPR_RATIO|GRP_B1, 1.0, UNIT_RATIO, "B1", 255, fp32Steps(Ratios))
+	p.addFp32(OPR_RATIO|GRP_B2, 1.0, UNIT_RATIO, "B2", 255, fp32Steps(Ratios))
+	p.addFp32(OPR_RATIO|GRP_C, 1.0, UNIT_RATIO, "C", 255, fp32Steps(Ratios))
+
+	p.addEnum(OPR_WAVEFORM|GRP_A, 0, WaveformNames, "WAVE A", 255)
+	p.addEnum(OPR_WAVEFORM|GRP_B1, 0, WaveformNames, "WAVE B1", 255)
+	p.addEnum(OPR_WAVEFORM|GRP_B2, 0, WaveformNames, "WAVE B2", 255)
+	p.addEnum(OPR_WAVEFORM|GRP_C, 0, WaveformNames, "WAVE C", 255)
+
+	// the operator's in the label like the waveforms, these share pages four at a time
+	operators := map[ParamId]string{GRP_A: "A", GRP_B1: "B1", GRP_B2: "B2", GRP_C: "C"}
+	for _, grp := range []ParamId{GRP_A, GRP_B1, GRP_B2, GRP_C} {
+		op := operators[grp]
+		p.addBool(OPR_FIXED|grp, false, "FIXED "+op, 255)
+		p.addFp32(OPR_FREQ|grp, 100.0, UNIT_HZ, "FREQ "+op, 255, fp32ExpRange(10.0, 10000.0))
+		p.addFp32(OPR_DETUNE|grp, 0.0, UNIT_CENTS, "DET "+op, 255, fp32Range(-100.0, 100.0))
+
+		p.addNote(OPR_LS_BREAK|grp, 60, "BREAK", 255)
+		p.addFp32(OPR_LS_LDEPTH|grp, 0.0, UNIT_PERCENT, "L DEPTH", 255, fp32Range(0.0, 1.0))
+		p.addFp32(OPR_LS_RDEPTH|grp, 0.0, UNIT_PERCENT, "R DEPTH", 255, fp32Range(0.0, 1.0))
+		p.addEnum(OPR_LS_LCURVE|grp, CURVE_NEG_LIN, CurveNames, "L CURVE", 255)
+		p.addEnum(OPR_LS_RCURVE|grp, CURVE_NEG_LIN, CurveNames, "R CURVE", 255)
+	}
+
+	envelopes := map[ParamId]string{GRP_A: "A", GRP_B: "B"}
+	for _, grp := range []ParamId{GRP_A, GRP_B} {
+		p.addBool(ENV_GATED|grp, true, "GATE", 255)
+		p.addBool(ENV_RETRIGGER|grp, true, "RETRIG", 255)
+		p.addUint16(ENV_ATTACK|grp, 0, 0, envMaxTime, UNIT_MS, "ATTACK", 255)
+		p.addUint16(ENV_DECAY|grp, 0, 0, envMaxTime, UNIT_MS, "DECAY", 255)
+		p.addFp32(ENV_ENDLEVEL|grp, 0.0, UNIT_PERCENT, "ENDLVL", 255, fp32Range(0.0, 1.0))
+		p.addFp32(ENV_INDEX|grp, 1.0, UNIT_NONE, "INDEX "+envelopes[grp], 255, fp32Range(0.0, 4.0))
+		p.addFp32(ENV_RATE_SCALE|grp, 0.0, UNIT_PERCENT, "RATESCL", 255, fp32Range(0.0, 1.0))
+		p.addFp32(ENV_ATTACK_CURVE|grp, 0.0, UNIT_NONE, "A CURVE", 255, fp32Range(-1.0, 1.0))
+		p.addFp32(ENV_DECAY_CURVE|grp, 0.0, UNIT_NONE, "D CURVE", 255, fp32Range(-1.0, 1.0))
+	}
 
 	p.addBool(ENV_GATED|GRP_VCA, true, "GATE", 255)
 	p.addBool(ENV_RETRIGGER|GRP_VCA, false, "RETRIG", 255)
-	p.addUint16(ENV_ATTACK|GRP_VCA, 0, "ATTACK", 0x14)
-	p.addUint16(ENV_DECAY|GRP_VCA, 0, "DECAY", 0x15)
-	p.addFp32(ENV_SUSTAIN|GRP_VCA, 1.0, "SUSTN", 0x16)
-	p.addUint16(ENV_RELEASE|GRP_VCA, 0, "RELEASE", 0x17)
+	p.addUint16(ENV_ATTACK|GRP_VCA, 0, 0, envMaxTime, UNIT_MS, "ATTACK", 0x14)
+	p.addUint16(ENV_DECAY|GRP_VCA, 0, 0, envMaxTime, UNIT_MS, "DECAY", 0x15)
+	p.addFp32(ENV_SUSTAIN|GRP_VCA, 1.0, UNIT_PERCENT, "SUSTN", 0x16, fp32Range(0.0, 1.0))
+	p.addUint16(ENV_RELEASE|GRP_VCA, 0, 0, envMaxTime, UNIT_MS, "RELEASE", 0x17)
+	p.addFp32(ENV_RATE_SCALE|GRP_VCA, 0.0, UNIT_PERCENT, "RATESCL", 255, fp32Range(0.0, 1.0))
+	p.addFp32(ENV_ATTACK_CURVE|GRP_VCA, 0.0, UNIT_NONE, "A CURVE", 255, fp32Range(-1.0, 1.0))
+	p.addFp32(ENV_DECAY_CURVE|GRP_VCA, 0.0, UNIT_NONE, "D CURVE", 255, fp32Range(-1.0, 1.0))
+	p.addFp32(ENV_RELEASE_CURVE|GRP_VCA, 0.0, UNIT_NONE, "R CURVE", 255, fp32Range(-1.0, 1.0))
+
+	for _, grp := range []ParamId{GRP_A, GRP_B, GRP_VCA} {
+		p.addByte(ENV_R1|grp, 99, 0, 99, "R1", 255)
+		p.addByte(ENV_R2|grp, 99, 0, 99, "R2", 255)
+		p.addByte(ENV_R3|grp, 99, 0, 99, "R3", 255)
+		p.addByte(ENV_R4|grp, 70, 0, 99, "R4", 255)
+		p.addByte(ENV_L1|grp, 99, 0, 99, "L1", 255)
+		p.addByte(ENV_L2|grp, 99, 0, 99, "L2", 255)
+		p.addByte(ENV_L3|grp, 99, 0, 99, "L3", 255)
+		p.addByte(ENV_L4|grp, 0, 0, 99, "L4", 255)
+		// loop points are stages: 0-2 heading for L1-L3
+		p.addByte(ENV_LOOP_START|grp, 0, 0, 2, "LOOP ST", 255)
+		p.addByte(ENV_LOOP_END|grp, 0, 0, 2, "LOOP END", 255)
+		p.addEnum(ENV_LOOP_MODE|grp, LOOP_ONE_SHOT, LoopModeNames, "LOOP", 255)
+	}
 
 	return p
 }
 
 // marks a parameter as updated, called by Param.Set()
+// this runs on whatever goroutine did the Set, so it only queues the id for each subscriber
 func (p *Patch) update(id ParamId) {
-	p.modified <- id
+	for _, s := range p.subscribers() {
+		s.notify(id)
+	}
 }
 
+// UpdateChannel is a shared subscription for callers that only ever want one
+// use Subscribe for an independent listener
 func (p *Patch) UpdateChannel() <-chan ParamId {
-	return p.modified
+	p.defaultOnce.Do(func() {
+		p.defaultSub = p.Subscribe()
+	})
+	return p.defaultSub.C
+}
+
+// Params returns every param in the patch, in id order
+func (p *Patch) Params() []Param {
+	params := make([]Param, 0, len(p.params))
+	for _, prm := range p.params {
+		params = append(params, prm)
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].ID() < params[j].ID()
+	})
+	return params
 }
 
 func (p *Patch) GetParam(id ParamId) Param {
 	return p.params[id]
 }
 
-func (p *Patch) ByteParam(id ParamId) *byteparam {
-	if v, ok := p.params[id].(*byteparam); ok {
+func (p *Patch) ByteParam(id ParamId) *ByteParam {
+	if v, ok := p.params[id].(*ByteParam); ok {
 		return v
 	}
 	fmt.Printf("%x is a %T, expected byte\n", id, p.params[id])
 	return nil
 }
 
-func (p *Patch) BoolParam(id ParamId) *boolparam {
-	if v, ok := p.params[id].(*boolparam); ok {
+func (p *Patch) BoolParam(id ParamId) *BoolParam {
+	if v, ok := p.params[id].(*BoolParam); ok {
 		return v
 	}
 	fmt.Printf("%x is a %T, expected bool\n", id, p.params[id])
 	return nil
 }
 
-func (p *Patch) Uint16Param(id ParamId) *uint16param {
-	if v, ok := p.params[id].(*uint16param); ok {
+func (p *Patch) Uint16Param(id ParamId) *Uint16Param {
+	if v, ok := p.params[id].(*Uint16Param); ok {
 		return v
 	}
 	fmt.Printf("%x is a %T, expected uint16\n", id, p.params[id])
 	return nil
 }
 
-func (p *Patch) Fp32Param(id ParamId) *fp32param {
-	if v, ok := p.params[id].(*fp32param); ok {
+func (p *Patch) Fp32Param(id ParamId) *Fp32Param {
+	if v, ok := p.params[id].(*Fp32Param); ok {
 		return v
 	}
-	fmt.Printf("%x is a %T, expected fp32param\n", id, p.params[id])
+	fmt.Printf("%x is a %T, expected fp32\n", id, p.params[id])
 	return nil
 }
 
-func (p *Patch) addByte(id ParamId, v byte, label string, ccNum byte) {
-	p.params[id] = NewByteParam(id, v, Meta{
+func (p *Patch) add(prm Param) {
+	p.params[prm.ID()] = prm
+	p.byPath[prm.ID().Path()] = prm
+	if cc := prm.Meta().cc; cc < 128 {
+		(*p.byCC.Load())[ccKey{ANY_CHANNEL, cc}] = prm
+	}
+}
+
+func (p *Patch) addByte(id ParamId, v, min, max byte, label string, ccNum byte) {
+	p.add(NewByteParam(id, v, Meta{
 		patch: p,
 		label: label,
 		cc:    ccNum,
-	})
-	if ccNum < 128 {
-		p.byCC[ccNum] = p.params[id]
-	}
+		min:   float64(min),
+		max:   float64(max),
+	}))
+}
+
+// a byte param choosing one of names
+func (p *Patch) addEnum(id ParamId, v byte, names []string, label string, ccNum byte) {
+	p.add(NewByteParam(id, v, Meta{
+		patch:  p,
+		label:  label,
+		cc:     ccNum,
+		max:    float64(len(names) - 1),
+		format: namesFormat(names),
+	}))
+}
+
+// a byte param holding a midi note number
+func (p *Patch) addNote(id ParamId, v byte, label string, ccNum byte) {
+	p.add(NewByteParam(id, v, Meta{
+		patch:  p,
+		label:  label,
+		cc:     ccNum,
+		max:    127,
+		format: noteFormat,
+	}))
 }
 
 func (p *Patch) addBool(id ParamId, v bool, label string, ccNum byte) {
-	p.params[id] = NewBoolParam(id, v, Meta{
+	p.add(NewBoolParam(id, v, Meta{
 		patch: p,
 		label: label,
 		cc:    ccNum,
-	})
-	if ccNum < 128 {
-		p.byCC[ccNum] = p.params[id]
-	}
+	}))
 }
 
-func (p *Patch) addUint16(id ParamId, v uint16, label string, ccNum byte) {
-	p.params[id] = NewUint16Param(id, v, Meta{
+func (p *Patch) addUint16(id ParamId, v, min, max uint16, unit Unit, label string, ccNum byte) {
+	p.add(NewUint16Param(id, v, Meta{
 		patch: p,
 		label: label,
 		cc:    ccNum,
-	})
-	if ccNum < 128 {
-		p.byCC[ccNum] = p.params[id]
-	}
+		min:   float64(min),
+		max:   float64(max),
+		unit:  unit,
+	}))
 }
 
-func (p *Patch) addFp32(id ParamId, v float64, label string, ccNum byte) {
-	p.params[id] = NewFp32Param(id, v, Meta{
+func (p *Patch) addFp32(id ParamId, v float64, unit Unit, label string, ccNum byte, mapping fp32Mapping) {
+	prm := NewFp32Param(id, v, Meta{
 		patch: p,
 		label: label,
 		cc:    ccNum,
+		unit:  unit,
 	})
-	if ccNum < 128 {
-		p.byCC[ccNum] = p.params[id]
+	prm.setMapping(mapping)
+	p.add(prm)
+}
+
+// the coarse operator ratios, digitone style
+// the ratio params step through these rather than sweeping continuously
+var Ratios = []fp.Fp32{
+	fp.Float2Fp32(0.25), fp.Float2Fp32(0.5), fp.Float2Fp32(0.75), fp.Float2Fp32(1.0),
+	fp.Float2Fp32(1.5), fp.Float2Fp32(2.0), fp.Float2Fp32(2.5), fp.Float2Fp32(3.0),
+	fp.Float2Fp32(3.5), fp.Float2Fp32(4.0), fp.Float2Fp32(5.0), fp.Float2Fp32(6.0),
+	fp.Float2Fp32(7.0), fp.Float2Fp32(8.0), fp.Float2Fp32(9.0), fp.Float2Fp32(10.0),
+	fp.Float2Fp32(11.0), fp.Float2Fp32(12.0), fp.Float2Fp32(13.0), fp.Float2Fp32(14.0),
+	fp.Float2Fp32(15.0), fp.Float2Fp32(16.0),
+}
+
+// divides the controller's travel evenly between the steps, which must be in ascending order
+// values between steps report the cc of the nearest one
+func fp32Steps(steps []fp.Fp32) fp32Mapping {
+	n := len(steps)
+	return fp32Mapping{
+		fromPos: func(pos float64) fp.Fp32 {
+			i := int(pos * float64(n))
+			if i >= n {
+				i = n - 1
+			}
+			return steps[i]
+		},
+		toPos: func(v fp.Fp32) float64 {
+			nearest := 0
+			for i, s := range steps {
+				if abs32(s-v) < abs32(steps[nearest]-v) {
+					nearest = i
+				}
+			}
+			// the middle of the nearest step's slice of the controller's travel
+			return (float64(nearest) + 0.5) / float64(n)
+		},
+		min: float64(steps[0]) / float64(1<<16),
+		max: float64(steps[n-1]) / float64(1<<16),
 	}
 }
 
-func byteRange(min, max byte) func(byte) interface{} {
-	// this converter returns bytes, so range is limited to 0-255 (2x upscaled)
-	if min < 0 {
-		min = 0
+// linear from min at the bottom of the controller to max at the top
+func fp32Range(min, max float64) fp32Mapping {
+	return fp32Mapping{
+		fromPos: func(pos float64) fp.Fp32 {
+			return fp.Float2Fp32(min + (max-min)*pos)
+		},
+		toPos: func(v fp.Fp32) float64 {
+			return (float64(v)/float64(1<<16) - min) / (max - min)
+		},
+		min:  min,
+		max:  max,
+		step: (max - min) / 127.0,
 	}
-	if max > math.MaxUint8 {
-		max = math.MaxUint8
+}
+
+// exponential from min at the bottom of the controller to max at the top, for frequencies and the like
+func fp32ExpRange(min, max float64) fp32Mapping {
+	return fp32Mapping{
+		fromPos: func(pos float64) fp.Fp32 {
+			return fp.Float2Fp32(min * math.Pow(max/min, pos))
+		},
+		toPos: func(v fp.Fp32) float64 {
+			f := float64(v) / float64(1<<16)
+			if f <= 0 {
+				return 0
+			}
+			return math.Log(f/min) / math.Log(max/min)
+		},
+		min: min,
+		max: max,
 	}
+}
+
+func ccClamp(v float64) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 127 {
+		return 127
+	}
+	return byte(v)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func abs32(v fp.Fp32) fp.Fp32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// scales a cc onto min-max, returning bytes so the range is limited to 0-255 (2x upscaled)
+func byteRange(min, max byte) func(byte) byte {
 	// short circuit obvious stuff for performance
 	if min == 0 && max == 127 {
-		return func(b byte) interface{} {
+		return func(b byte) byte {
 			return b
 		}
 	}
 	if min == 0 && max == 255 {
-		return func(b byte) interface{} {
+		return func(b byte) byte {
 			return b << 1
 		}
 	}
 
-	return func(b byte) interface{} {
-		return byte(((uint16(b) * uint16(max+1-min)) >> 7) + uint16(min))
+	return func(b byte) byte {
+		return byte(((uint16(b) * (uint16(max) + 1 - uint16(min))) >> 7) + uint16(min))
 	}
 }
 
-func uint16Range(min, max uint16) func(byte) interface{} {
-	if min == 0 && max == math.MaxUint16 {
-		return func(b byte) interface{} {
-			return uint16(b) << 9
-		}
+// the inverse of byteRange, the lowest cc that maps to v
+func byteToCC(v, min, max byte) byte {
+	if v <= min {
+		return 0
 	}
-	return func(b byte) interface{} {
-		return uint16(((uint32(b) * uint32(max+1-min)) >> 7) + uint32(min))
+	span := uint16(max) + 1 - uint16(min)
+	return ccClamp(float64((uint16(v-min)<<7 + span - 1) / span))
+}
+
+func uint16Range(min, max uint16) func(byte) uint16 {
+	// the ranges are wider than a cc, so cc 127 has to land on max rather than a step short
+	span := uint32(max - min)
+	return func(b byte) uint16 {
+		return min + uint16((uint32(b)*span*2+127)/254)
+	}
+}
+
+// the inverse of uint16Range, the nearest cc to v
+func uint16ToCC(v, min, max uint16) byte {
+	if v <= min || max <= min {
+		return 0
 	}
+	span := uint32(max - min)
+	return ccClamp(float64((uint32(v-min)*254 + span) / (span * 2)))
 }
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"testing"
+
+	"github.com/ianmcmahon/fmsynth/fp"
 )
 
 func TestCCByteRange(t *testing.T) {
@@ -32,16 +34,23 @@ func TestUint16ByteRange(t *testing.T) {
 
 	var cc byte
 	for cc = 0; cc <= 127; cc++ {
-		assertEqual(t, fullRange(cc), uint16(cc)<<9, "")
+		assertEqual(t, uint16ToCC(fullRange(cc), 0, math.MaxUint16), cc, "")
+		assertEqual(t, uint16ToCC(oddRange(cc), 1000, 2000), cc, "")
 	}
 
 	assertEqual(t, fullRange(0), uint16(0), "")
-	assertEqual(t, fullRange(64), uint16(32768), "")
+	assertEqual(t, fullRange(64), uint16(33026), "")
+	assertEqual(t, fullRange(127), uint16(math.MaxUint16), "")
 
 	assertEqual(t, oddRange(0), uint16(1000), "")
-	assertEqual(t, oddRange(60), uint16(1469), "")
-	assertEqual(t, oddRange(90), uint16(1703), "")
-	assertEqual(t, oddRange(127), uint16(1993), "")
+	assertEqual(t, oddRange(60), uint16(1472), "")
+	assertEqual(t, oddRange(90), uint16(1709), "")
+	assertEqual(t, oddRange(127), uint16(2000), "")
+
+	// the envelope times reach the top of their range from a 7 bit knob
+	attack := InitialPatch().Uint16Param(ENV_ATTACK | GRP_VCA)
+	attack.SetFromCC(127)
+	assertEqual(t, attack.Uint16(), uint16(attack.Meta().Max()), "")
 
 }
 
@@ -54,3 +63,132 @@ func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
 	}
 	t.Fatal(message)
 }
+
+func TestRatioSteps(t *testing.T) {
+	p := InitialPatch()
+	ratio := p.Fp32Param(OPR_RATIO | GRP_A)
+	go func() {
+		for range p.UpdateChannel() {
+		}
+	}()
+
+	// every cc value lands on a legal ratio, and reading it back
+	// as a cc lands on the same ratio again
+	var cc byte
+	for cc = 0; cc <= 127; cc++ {
+		ratio.SetFromCC(cc)
+		v := ratio.Value()
+		legal := false
+		for _, r := range Ratios {
+			if r == v {
+				legal = true
+			}
+		}
+		if !legal {
+			t.Fatalf("cc %d set ratio to %v which isn't a legal ratio", cc, v)
+		}
+		ratio.SetFromCC(ratio.ValAsCC())
+		assertEqual(t, ratio.Value(), v, "")
+	}
+
+	ratio.SetFromCC(0)
+	assertEqual(t, ratio.Value(), Ratios[0], "")
+	ratio.SetFromCC(127)
+	assertEqual(t, ratio.Value(), Ratios[len(Ratios)-1], "")
+}
+
+func TestParamRanges(t *testing.T) {
+	p := InitialPatch()
+
+	// the algorithm knob only spans the algorithms there are
+	alg := p.ByteParam(PATCH_ALGORITHM)
+	alg.SetFromCC(127)
+	assertEqual(t, alg.Byte(), byte(len(AlgorithmNames)-1), "")
+	alg.SetFromCC(0)
+	assertEqual(t, alg.Byte(), byte(0), "")
+	alg.Set(100)
+	assertEqual(t, alg.Byte(), byte(len(AlgorithmNames)-1), "")
+
+	// reading a value back as a cc lands on the same value
+	r1 := p.ByteParam(ENV_R1 | GRP_A)
+	for v := byte(0); v <= 99; v++ {
+		r1.Set(v)
+		r1.SetFromCC(r1.ValAsCC())
+		assertEqual(t, r1.Byte(), v, "")
+	}
+	attack := p.Uint16Param(ENV_ATTACK | GRP_VCA)
+	var cc byte
+	for cc = 0; cc <= 127; cc++ {
+		attack.SetFromCC(cc)
+		assertEqual(t, attack.ValAsCC(), cc, "")
+	}
+
+	sustain := p.Fp32Param(ENV_SUSTAIN | GRP_VCA)
+	sustain.Set(3 << 16)
+	assertEqual(t, sustain.Fp32(), fp.Fp32(1<<16), "")
+	assertEqual(t, sustain.Meta().Default(), 1.0, "")
+}
+
+func TestParamFormat(t *testing.T) {
+	p := InitialPatch()
+
+	p.Uint16Param(ENV_ATTACK | GRP_VCA).Set(120)
+	p.Uint16Param(ENV_DECAY | GRP_VCA).Set(1500)
+	p.Fp32Param(ENV_SUSTAIN | GRP_VCA).Set(1 << 15)
+	p.ByteParam(OPR_WAVEFORM | GRP_A).Set(10)
+	p.Fp32Param(OPR_FREQ | GRP_A).Set(fp.Float2Fp32(440))
+
+	for id, want := range map[ParamId]string{
+		ENV_ATTACK | GRP_VCA:  "120 ms",
+		ENV_DECAY | GRP_VCA:   "1.50 s",
+		ENV_SUSTAIN | GRP_VCA: "50%",
+		OPR_RATIO | GRP_A:     "1.00",
+		OPR_WAVEFORM | GRP_A:  "SAW",
+		OPR_FREQ | GRP_A:      "440.0 Hz",
+		OPR_LS_BREAK | GRP_A:  "C4",
+		ENV_GATED | GRP_A:     "ON",
+		PATCH_ALGORITHM:       "1",
+		ENV_LOOP_MODE | GRP_B: "OFF",
+		OPR_DETUNE | GRP_C:    "+0 ct",
+		ENV_R1 | GRP_VCA:      "99",
+	} {
+		if got := p.GetParam(id).Format(); got != want {
+			t.Errorf("%x: expected %q, got %q", id, want, got)
+		}
+	}
+}
+
+func TestHighResolution(t *testing.T) {
+	p := InitialPatch()
+
+	// the NRPN number is the param id
+	attack := p.Uint16Param(ENV_ATTACK | GRP_VCA)
+	msb, lsb := attack.ID().NRPN()
+	assertEqual(t, uint16(msb)<<7|uint16(lsb), uint16(ENV_ATTACK|GRP_VCA), "")
+
+	// every ms of the range is reachable, which 7 bits can't do
+	p.SetNRPN(uint16(attack.ID()), CC14_MAX)
+	assertEqual(t, attack.Uint16(), uint16(envMaxTime), "")
+	for ms := uint16(0); ms <= envMaxTime; ms += 7 {
+		attack.Set(ms)
+		p.SetNRPN(uint16(attack.ID()), attack.ValAsCC14())
+		assertEqual(t, attack.Uint16(), ms, "")
+	}
+	p.StepNRPN(uint16(attack.ID()), -1)
+	assertEqual(t, attack.Uint16(), uint16(envMaxTime-1-(envMaxTime%7)), "")
+
+	// a 14 bit controller spans the whole range
+	alg := p.ByteParam(PATCH_ALGORITHM)
+	p.HandleCC14(3, CC14_MAX)
+	assertEqual(t, alg.Byte(), byte(len(AlgorithmNames)-1), "")
+	p.HandleCC14(3, 0)
+	assertEqual(t, alg.Byte(), byte(0), "")
+
+	detune := p.Fp32Param(OPR_DETUNE | GRP_A)
+	detune.SetFromCC14(CC14_MAX)
+	assertEqual(t, detune.Fp32(), fp.Float2Fp32(100.0), "")
+	detune.SetFromCC14(CC14_MAX / 2)
+	if d := detune.Format(); d != "-0 ct" && d != "+0 ct" {
+		t.Errorf("expected detune near zero, got %s", d)
+	}
+}
@@ -0,0 +1,101 @@
+package patch
+
+import "fmt"
+
+/*
+	Every param has a path for remote control (OSC, HTTP) made from its id:
+
+	  /patch/<name>                patch level params, eg /patch/algorithm
+	  /patch/opr/<operator>/<name> operators a, b1, b2 and c, eg /patch/opr/b1/ratio
+	  /patch/env/<envelope>/<name> envelopes a, b and vca, eg /patch/env/vca/attack
+*/
+
+var patchNames = map[ParamId]string{
+	PATCH_ALGORITHM:      "algorithm",
+	PATCH_FEEDBACK:       "feedback",
+	PATCH_MIX:            "mix",
+	PATCH_ENV_MODE:       "env_mode",
+	PATCH_SMOOTHING:      "smoothing",
+	PATCH_BEND_RANGE:     "bend_range",
+	PATCH_PRESSURE_LEVEL: "pressure_level",
+	PATCH_PRESSURE_INDEX: "pressure_index",
+	PATCH_TIMBRE_INDEX:   "timbre_index",
+}
+
+var oprNames = map[ParamId]string{
+	OPR_RATIO:     "ratio",
+	OPR_FEEDBACK:  "feedback",
+	OPR_WAVEFORM:  "waveform",
+	OPR_FIXED:     "fixed",
+	OPR_FREQ:      "freq",
+	OPR_DETUNE:    "detune",
+	OPR_LS_BREAK:  "ls_break",
+	OPR_LS_LDEPTH: "ls_ldepth",
+	OPR_LS_RDEPTH: "ls_rdepth",
+	OPR_LS_LCURVE: "ls_lcurve",
+	OPR_LS_RCURVE: "ls_rcurve",
+}
+
+var envNames = map[ParamId]string{
+	ENV_ATTACK:        "attack",
+	ENV_DECAY:         "decay",
+	ENV_ENDLEVEL:      "endlevel",
+	ENV_INDEX:         "index",
+	ENV_GATED:         "gated",
+	ENV_RETRIGGER:     "retrigger",
+	ENV_SUSTAIN:       "sustain",
+	ENV_RELEASE:       "release",
+	ENV_RATE_SCALE:    "rate_scale",
+	ENV_ATTACK_CURVE:  "attack_curve",
+	ENV_DECAY_CURVE:   "decay_curve",
+	ENV_RELEASE_CURVE: "release_curve",
+	ENV_R1:            "r1",
+	ENV_R2:            "r2",
+	ENV_R3:            "r3",
+	ENV_R4:            "r4",
+	ENV_L1:            "l1",
+	ENV_L2:            "l2",
+	ENV_L3:            "l3",
+	ENV_L4:            "l4",
+	ENV_LOOP_START:    "loop_start",
+	ENV_LOOP_END:      "loop_end",
+	ENV_LOOP_MODE:     "loop_mode",
+}
+
+// indexed by group
+var (
+	oprGroups = []string{"a", "b1", "c", "b2"}
+	envGroups = []string{"a", "b", "c", "vca"}
+)
+
+const (
+	groupMask = 0x3
+	typeMask  = 0x3 << 2
+)
+
+// Path is where a param lives for remote control
+func (id ParamId) Path() string {
+	group := id & groupMask
+	base := id &^ groupMask
+	switch id & typeMask {
+	case PATCH_TYPE:
+		if name, ok := patchNames[id]; ok {
+			return "/patch/" + name
+		}
+	case OPR_TYPE:
+		if name, ok := oprNames[base]; ok {
+			return "/patch/opr/" + oprGroups[group] + "/" + name
+		}
+	case ENV_TYPE:
+		if name, ok := envNames[base]; ok {
+			return "/patch/env/" + envGroups[group] + "/" + name
+		}
+	}
+	return fmt.Sprintf("/patch/%04x", uint16(id))
+}
+
+// ParamByPath finds a param from its Path
+func (p *Patch) ParamByPath(path string) (Param, bool) {
+	prm, ok := p.byPath[path]
+	return prm, ok
+}
@@ -0,0 +1,209 @@
+package patch
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+/*
+	Controller mappings live with the patch so the midi goroutine can find a param
+	from a cc without asking anyone, but they're saved as a Profile, separately from
+	patches, since they describe the controller and not the sound.
+
+	A mapping is for one midi channel or for any channel.  A channel mapping wins over
+	an any channel one for the same controller, so a second keyboard on its own channel
+	can reuse controller numbers for different things.
+
+	MIDI learn: Learn arms a param, from the UI or remotely over OSC or HTTP, and the
+	next controller to arrive on any channel is mapped to it on that channel.
+*/
+
+// mappings with this channel respond on every channel
+const ANY_CHANNEL byte = 0xFF
+
+type ccKey struct {
+	channel byte
+	cc      byte
+}
+
+// a controller on a channel driving a param
+type Mapping struct {
+	Channel byte    `json:"channel"` // 0-15, or ANY_CHANNEL
+	CC      byte    `json:"cc"`
+	Param   ParamId `json:"param"`
+}
+
+type Profile struct {
+	Mappings []Mapping `json:"mappings"`
+}
+
+func LoadProfile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pr := &Profile{}
+	if err := json.NewDecoder(f).Decode(pr); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (pr *Profile) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(pr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ControlledParam is the param a controller drives on a channel, preferring a mapping
+// for the channel.  If a param is armed for midi learn it's mapped to the controller and
+// returned instead.  It's called on the render loop so it doesn't lock
+func (p *Patch) ControlledParam(channel, cc byte) Param {
+	if p.learning.Load() != 0 {
+		if learned := p.learn(channel, cc); learned != nil {
+			return learned
+		}
+	}
+	return p.lookupCC(channel, cc)
+}
+
+func (p *Patch) lookupCC(channel, cc byte) Param {
+	byCC := *p.byCC.Load()
+	if prm, ok := byCC[ccKey{channel, cc}]; ok {
+		return prm
+	}
+	return byCC[ccKey{ANY_CHANNEL, cc}]
+}
+
+// Learn arms a param, the next controller that moves gets mapped to it
+// arming another param, or the same one again, replaces it
+func (p *Patch) Learn(id ParamId) bool {
+	if _, ok := p.params[id]; !ok {
+		return false
+	}
+	if prev := p.learning.Swap(uint32(id) + 1); prev != 0 {
+		p.update(ParamId(prev - 1))
+	}
+	p.update(id)
+	return true
+}
+
+func (p *Patch) CancelLearn() {
+	if prev := p.learning.Swap(0); prev != 0 {
+		p.update(ParamId(prev - 1))
+	}
+}
+
+// Learning returns the param that's armed, if any
+func (p *Patch) Learning() (ParamId, bool) {
+	armed := p.learning.Load()
+	if armed == 0 {
+		return 0, false
+	}
+	return ParamId(armed - 1), true
+}
+
+// OnLearn sets a function to call with each new mapping, to save the profile for instance
+// it's called on the engine's render loop where midi is handled, so it mustn't block:
+// hand anything slow to another goroutine
+func (p *Patch) OnLearn(f func(Mapping)) {
+	p.onLearn.Store(&f)
+}
+
+// maps the armed param to cc on channel, replacing whatever mappings it had
+// the mappings are copied, but that's once per learn rather than per controller.
+// Subscribers hear that learning's over when the caller sets the param
+func (p *Patch) learn(channel, cc byte) Param {
+	armed := p.learning.Swap(0)
+	if armed == 0 {
+		return nil
+	}
+	prm := p.params[ParamId(armed-1)]
+
+	// ApplyProfile may replace the mappings meanwhile, then it's done again on top of those
+	for {
+		old := p.byCC.Load()
+		byCC := make(map[ccKey]Param, len(*old)+1)
+		for k, mapped := range *old {
+			if mapped != prm {
+				byCC[k] = mapped
+			}
+		}
+		byCC[ccKey{channel, cc}] = prm
+		if p.byCC.CompareAndSwap(old, &byCC) {
+			break
+		}
+	}
+
+	if onLearn := p.onLearn.Load(); onLearn != nil && *onLearn != nil {
+		(*onLearn)(Mapping{Channel: channel, CC: cc, Param: prm.ID()})
+	}
+	return prm
+}
+
+// Profile returns the current mappings
+func (p *Patch) Profile() *Profile {
+	byCC := *p.byCC.Load()
+	pr := &Profile{Mappings: make([]Mapping, 0, len(byCC))}
+	for k, prm := range byCC {
+		pr.Mappings = append(pr.Mappings, Mapping{Channel: k.channel, CC: k.cc, Param: prm.ID()})
+	}
+	sort.Slice(pr.Mappings, func(i, j int) bool {
+		a, b := pr.Mappings[i], pr.Mappings[j]
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		return a.CC < b.CC
+	})
+	return pr
+}
+
+// ApplyProfile replaces all the mappings with the profile's
+// mappings for params this patch doesn't have are skipped
+func (p *Patch) ApplyProfile(pr *Profile) {
+	byCC := make(map[ccKey]Param, len(pr.Mappings))
+	for _, m := range pr.Mappings {
+		if prm, ok := p.params[m.Param]; ok && m.CC < 128 {
+			byCC[ccKey{m.Channel, m.CC}] = prm
+		}
+	}
+	p.byCC.Store(&byCC)
+}
+
+// MappedParam is the param a controller drives on a channel, without arming anything
+func (p *Patch) MappedParam(channel, cc byte) (ParamId, bool) {
+	prm := p.lookupCC(channel, cc)
+	if prm == nil {
+		return 0, false
+	}
+	return prm.ID(), true
+}
+
+// MappingFor finds the controller driving a param
+// if there's more than one, a channel mapping is preferred, then the lowest controller
+func (p *Patch) MappingFor(id ParamId) (Mapping, bool) {
+	var best Mapping
+	found := false
+	for k, prm := range *p.byCC.Load() {
+		if prm.ID() != id {
+			continue
+		}
+		m := Mapping{Channel: k.channel, CC: k.cc, Param: id}
+		if !found || m.Channel < best.Channel || (m.Channel == best.Channel && m.CC < best.CC) {
+			best = m
+			found = true
+		}
+	}
+	return best, found
+}
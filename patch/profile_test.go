@@ -0,0 +1,77 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMidiLearn(t *testing.T) {
+	p := InitialPatch()
+	var learned []Mapping
+	p.OnLearn(func(m Mapping) {
+		learned = append(learned, m)
+	})
+
+	release := p.Uint16Param(ENV_RELEASE | GRP_VCA)
+	detune := p.Fp32Param(OPR_DETUNE | GRP_A)
+
+	if !p.Learn(detune.ID()) {
+		t.Fatal("couldn't arm detune")
+	}
+	if id, ok := p.Learning(); !ok || id != detune.ID() {
+		t.Fatalf("expected detune to be armed, got %x %v", id, ok)
+	}
+
+	// cc 0x17 is release on every channel, but now it's detune on channel 2
+	p.HandleChannelCC(2, 0x17, 127)
+	if _, ok := p.Learning(); ok {
+		t.Error("expected learn to disarm after mapping")
+	}
+	assertEqual(t, len(learned), 1, "")
+	assertEqual(t, learned[0], Mapping{Channel: 2, CC: 0x17, Param: detune.ID()}, "")
+	assertEqual(t, detune.ValAsCC(), byte(127), "")
+
+	p.HandleChannelCC(2, 0x17, 0)
+	assertEqual(t, detune.ValAsCC(), byte(0), "")
+	assertEqual(t, release.Uint16(), uint16(0), "")
+	p.HandleChannelCC(0, 0x17, 127)
+	assertEqual(t, release.ValAsCC(), byte(127), "")
+	assertEqual(t, detune.ValAsCC(), byte(0), "")
+
+	// learning again moves the mapping rather than adding another
+	p.Learn(detune.ID())
+	p.HandleChannelCC(5, 0x30, 64)
+	p.HandleChannelCC(2, 0x17, 127)
+	assertEqual(t, detune.ValAsCC(), byte(64), "")
+	assertEqual(t, release.ValAsCC(), byte(127), "")
+}
+
+func TestProfileSaveLoad(t *testing.T) {
+	p := InitialPatch()
+	p.Learn(OPR_FREQ | GRP_C)
+	p.HandleChannelCC(9, 74, 0)
+
+	path := filepath.Join(t.TempDir(), "profile.json")
+	if err := p.Profile().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh patch picks up the learned mapping, and keeps the defaults that were saved with it
+	fresh := InitialPatch()
+	pr, err := LoadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.ApplyProfile(pr)
+
+	freq := fresh.Fp32Param(OPR_FREQ | GRP_C)
+	fresh.HandleChannelCC(9, 74, 127)
+	assertEqual(t, freq.ValAsCC(), byte(127), "")
+	fresh.HandleCC(3, 127)
+	assertEqual(t, fresh.ByteParam(PATCH_ALGORITHM).Byte(), byte(len(AlgorithmNames)-1), "")
+	assertEqual(t, len(fresh.Profile().Mappings), len(pr.Mappings), "")
+}
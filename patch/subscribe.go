@@ -0,0 +1,108 @@
+package patch
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// a Subscription delivers the ids of params that have been Set
+// updates are coalesced: an id that changes several times before the subscriber gets
+// around to reading it is only delivered once, and a subscriber that never reads
+// doesn't hold anyone up.  Read the current value from the param when the id arrives
+//
+// params are Set on the render loop, so noting an update mustn't lock or allocate.
+// Each subscription has a pending bit for every possible id, set atomically, and
+// pending ids are delivered in id order
+type Subscription struct {
+	C <-chan ParamId
+
+	out     chan ParamId
+	patch   *Patch
+	pending [1 << 16 / 64]atomic.Uint64
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Subscribe registers a new listener for param updates
+// call Unsubscribe when finished with it so its goroutine exits
+func (p *Patch) Subscribe() *Subscription {
+	s := &Subscription{
+		out:   make(chan ParamId),
+		patch: p,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	s.C = s.out
+
+	// update reads the list without locking, so it's replaced rather than changed
+	p.subsMu.Lock()
+	subs := p.subscribers()
+	next := append(subs[:len(subs):len(subs)], s)
+	p.subs.Store(&next)
+	p.subsMu.Unlock()
+
+	go s.pump()
+	return s
+}
+
+// Unsubscribe stops deliveries and closes C
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		p := s.patch
+		p.subsMu.Lock()
+		subs := p.subscribers()
+		for i, sub := range subs {
+			if sub == s {
+				next := append(subs[:i:i], subs[i+1:]...)
+				p.subs.Store(&next)
+				break
+			}
+		}
+		p.subsMu.Unlock()
+		close(s.done)
+	})
+}
+
+func (p *Patch) subscribers() []*Subscription {
+	if subs := p.subs.Load(); subs != nil {
+		return *subs
+	}
+	return nil
+}
+
+// called from update, must never block
+func (s *Subscription) notify(id ParamId) {
+	s.pending[id/64].Or(1 << (id % 64))
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) pump() {
+	defer close(s.out)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+
+		// ids are taken before they're delivered so a Set during delivery queues them again
+		for i := range s.pending {
+			word := s.pending[i].Swap(0)
+			for word != 0 {
+				bit := bits.TrailingZeros64(word)
+				word &^= 1 << bit
+				select {
+				case s.out <- ParamId(i*64 + bit):
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package patch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdatesDontBlock(t *testing.T) {
+	p := InitialPatch()
+	sub := p.Subscribe()
+	other := p.Subscribe()
+	defer other.Unsubscribe()
+
+	// nobody is reading yet, so these would hang with a blocking notify
+	sustain := p.Fp32Param(ENV_SUSTAIN | GRP_VCA)
+	for i := 0; i < 1000; i++ {
+		sustain.Set(0)
+	}
+	p.ByteParam(PATCH_ALGORITHM).Set(1)
+	sustain.Set(1 << 16)
+
+	// the repeats coalesce.  The pump may already have picked up the first sustain
+	// before the rest arrived, so it can legitimately see sustain twice but no more
+	for _, s := range []*Subscription{sub, other} {
+		counts := drainUpdates(s)
+		if counts[PATCH_ALGORITHM] != 1 {
+			t.Errorf("expected one algorithm update, got %d", counts[PATCH_ALGORITHM])
+		}
+		if n := counts[ENV_SUSTAIN|GRP_VCA]; n < 1 || n > 2 {
+			t.Errorf("expected sustain updates to coalesce, got %d", n)
+		}
+	}
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected channel to close after Unsubscribe")
+	}
+	sustain.Set(0)
+	expectUpdate(t, other, ENV_SUSTAIN|GRP_VCA)
+}
+
+func expectUpdate(t *testing.T, s *Subscription, id ParamId) {
+	t.Helper()
+	select {
+	case got := <-s.C:
+		if got != id {
+			t.Errorf("expected update for %x, got %x", id, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no update for %x", id)
+	}
+}
+
+// counts the updates delivered until the subscription goes quiet
+func drainUpdates(s *Subscription) map[ParamId]int {
+	counts := make(map[ParamId]int)
+	for {
+		select {
+		case id := <-s.C:
+			counts[id]++
+		case <-time.After(20 * time.Millisecond):
+			return counts
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/fp"
+	"github.com/ianmcmahon/fmsynth/midi"
+	"github.com/rakyll/portmidi"
+)
+
+/*
+	fmsynth play song.mid [-out song.wav]
+
+	Plays a midi file through the synth, or with -out renders it to a wav file as fast
+	as it can.  The synth's own flags (tuning, channels, profile) go before "play".
+*/
+
+// trackChannels moves a track's channel messages onto another channel
+// tracks are numbered from 1 in the order they're in the file, channels 1-16
+type trackChannels map[int]byte
+
+func (tc trackChannels) String() string {
+	var s []string
+	for track, ch := range tc {
+		s = append(s, fmt.Sprintf("%d=%d", track, ch+1))
+	}
+	return strings.Join(s, ",")
+}
+
+func (tc trackChannels) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%q should be track=channel", v)
+	}
+	track, err := strconv.Atoi(parts[0])
+	if err != nil || track < 1 {
+		return fmt.Errorf("%q isn't a track number", parts[0])
+	}
+	c, err := midi.ParseChannels(parts[1])
+	if err != nil {
+		return err
+	}
+	for ch := byte(0); ch < 16; ch++ {
+		if c == midi.Channel(ch) {
+			tc[track-1] = ch
+			return nil
+		}
+	}
+	return fmt.Errorf("a track can only go to one channel")
+}
+
+// the file's events as the engine wants them, leaving out meta events
+func playEvents(timeline []midi.TimedEvent, tracks trackChannels) []midi.TimedEvent {
+	events := make([]midi.TimedEvent, 0, len(timeline))
+	for _, ev := range timeline {
+		if ev.Status == 0xFF {
+			continue
+		}
+		if ch, ok := tracks[ev.Track]; ok && ev.IsChannelMessage() {
+			ev.Status = ev.Status&0xF0 | ch
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func toPortmidi(ev midi.TimedEvent) portmidi.Event {
+	pm := portmidi.Event{
+		Timestamp: portmidi.Timestamp(ev.Time / time.Millisecond),
+		Status:    int64(ev.Status),
+		Data1:     int64(ev.Data1),
+		Data2:     int64(ev.Data2),
+	}
+	if !ev.IsChannelMessage() {
+		pm.SysEx = ev.Data
+	}
+	return pm
+}
+
+func play(args []string, setup func(*audio.Engine)) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	out := fs.String("out", "", "wav file to render to, instead of playing")
+	tail := fs.Duration("tail", 2*time.Second, "how long to keep going after the last event, for releases to finish")
+	tracks := trackChannels{}
+	fs.Var(tracks, "track", "play a track on a channel, e.g. 2=10, can be repeated")
+
+	// flags can come before or after the file
+	var files []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("usage: fmsynth [flags] play song.mid [-out song.wav]")
+	}
+
+	smf, err := midi.LoadSMF(files[0])
+	if err != nil {
+		return err
+	}
+	events := playEvents(smf.Timeline(), tracks)
+
+	if *out != "" {
+		return bounce(events, *out, *tail, setup)
+	}
+
+	portaudio.Initialize()
+	defer portaudio.Terminate()
+
+	ch := make(chan portmidi.Event, 1024)
+	engine := audio.NewEngine(ch)
+	setup(engine)
+
+	start := time.Now()
+	for _, ev := range events {
+		time.Sleep(time.Until(start.Add(ev.Time)))
+		ch <- toPortmidi(ev)
+	}
+	time.Sleep(*tail)
+	engine.Stop()
+	return nil
+}
+
+// renders the events offline to a wav file
+func bounce(events []midi.TimedEvent, path string, tail time.Duration, setup func(*audio.Engine)) error {
+	engine := audio.NewOfflineEngine()
+	setup(engine)
+	rate := int64(engine.SamplingRate())
+
+	sample := func(t time.Duration) int64 {
+		return int64(t) * rate / int64(time.Second)
+	}
+	var length time.Duration
+	if len(events) > 0 {
+		length = events[len(events)-1].Time
+	}
+	samples := sample(length + tail)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := audio.NewWAVWriter(f, int(rate))
+	if err != nil {
+		return err
+	}
+
+	// events are queued a block at a time as they come up, the engine's queue is
+	// meant for what's about to be played rather than a whole song
+	buf := make([]fp.Fp32, audio.BUFFER_LEN)
+	for n := int64(0); n < samples; n += int64(len(buf)) {
+		for len(events) > 0 && sample(events[0].Time) < n+int64(len(buf)) {
+			engine.Queue(sample(events[0].Time), toPortmidi(events[0]))
+			events = events[1:]
+		}
+		engine.Render(buf)
+		if err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/midi"
+)
+
+func TestBounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := playEvents([]midi.TimedEvent{
+		{Time: 0, Track: 0, TrackEvent: midi.TrackEvent{Status: 0xFF, Meta: midi.META_TRACK_NAME}},
+		{Time: 0, Track: 1, TrackEvent: midi.TrackEvent{Status: 0x90, Data1: 60, Data2: 100}},
+		{Time: 500 * time.Millisecond, Track: 1, TrackEvent: midi.TrackEvent{Status: 0x80, Data1: 60}},
+	}, trackChannels{1: 4})
+	if len(events) != 2 || events[0].Status != 0x94 {
+		t.Fatalf("events to play are %+v", events)
+	}
+
+	path := filepath.Join(dir, "out.wav")
+	if err := bounce(events, path, 500*time.Millisecond, func(*audio.Engine) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		t.Fatalf("not a wav file")
+	}
+	dataLen := binary.LittleEndian.Uint32(b[40:])
+	if int(dataLen) != len(b)-44 {
+		t.Errorf("header says %d bytes of data, there are %d", dataLen, len(b)-44)
+	}
+	// a second, rounded up to a whole block
+	if samples := dataLen / 2; samples < audio.SAMPLING_RATE || samples > audio.SAMPLING_RATE+audio.BUFFER_LEN {
+		t.Errorf("rendered %d samples, want about a second", samples)
+	}
+
+	silent := true
+	for i := 44; i < len(b); i += 2 {
+		if b[i] != 0 || b[i+1] != 0 {
+			silent = false
+			break
+		}
+	}
+	if silent {
+		t.Errorf("the note didn't make any sound")
+	}
+}
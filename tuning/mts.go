@@ -0,0 +1,68 @@
+package tuning
+
+import "math"
+
+// midi tuning standard sysex
+// only the key based messages are handled: the realtime single note tuning change
+// and the non-realtime bulk tuning dump.  Scale/octave tuning messages are ignored
+
+const (
+	sysexStart    = 0xF0
+	sysexEnd      = 0xF7
+	universalNRT  = 0x7E
+	universalRT   = 0x7F
+	mtsSubID      = 0x08
+	mtsBulkDump   = 0x01
+	mtsSingleNote = 0x02
+)
+
+// Retune returns a copy of the tuning with the notes an MTS message retunes, or
+// false if the message isn't one we understand.  t itself is left alone, voices may
+// be reading it.  Tuning program numbers are ignored, every message applies to this tuning
+func (t *Tuning) Retune(msg []byte) (*Tuning, bool) {
+	if len(msg) < 6 || msg[0] != sysexStart {
+		return nil, false
+	}
+	// msg[2] is the device id, we accept anything
+	if msg[3] != mtsSubID {
+		return nil, false
+	}
+
+	switch {
+	case msg[1] == universalRT && msg[4] == mtsSingleNote:
+		// F0 7F dev 08 02 prog count [key xx yy zz]*count F7
+		if len(msg) < 7 {
+			return nil, false
+		}
+		retuned := *t
+		count := int(msg[6])
+		data := msg[7:]
+		for i := 0; i < count && len(data) >= 4; i++ {
+			retuned.applyMTSFreq(data[0], data[1:4])
+			data = data[4:]
+		}
+		return &retuned, true
+	case msg[1] == universalNRT && msg[4] == mtsBulkDump:
+		// F0 7E dev 08 01 prog name[16] [xx yy zz]*128 checksum F7
+		const header = 6 + 16
+		if len(msg) < header+128*3 {
+			return nil, false
+		}
+		retuned := *t
+		for n := 0; n < 128; n++ {
+			retuned.applyMTSFreq(byte(n), msg[header+n*3:header+n*3+3])
+		}
+		return &retuned, true
+	}
+	return nil, false
+}
+
+// an MTS frequency is a 12-TET semitone and a 14 bit fraction of a semitone above it
+// 7F 7F 7F means leave the note alone
+func (t *Tuning) applyMTSFreq(note byte, f []byte) {
+	if note > 127 || (f[0] == 0x7F && f[1] == 0x7F && f[2] == 0x7F) {
+		return
+	}
+	semitone := float64(f[0]) + float64(uint16(f[1])<<7|uint16(f[2]))/16384.0
+	t.setFreq(int(note), A4_FREQ*math.Pow(2, (semitone-A4)/12.0))
+}
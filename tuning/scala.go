@@ -0,0 +1,190 @@
+package tuning
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a Scale is a scala .scl file, see http://www.huygens-fokker.org/scala/scl_format.html
+// the degrees are in cents above the root, the root itself (0 cents) is implied
+// and the last degree is the period the scale repeats at, usually 1200 (an octave)
+type Scale struct {
+	Description string
+	Cents       []float64
+}
+
+// a KeyboardMap is a scala .kbm file, which says which midi notes play which scale degrees
+// see http://www.huygens-fokker.org/scala/help.htm#mappings
+type KeyboardMap struct {
+	Size    int // size of the mapping pattern, 0 means map every key linearly
+	First   int // first and last midi notes to retune
+	Last    int
+	Middle  int     // the note that plays scale degree 0
+	RefNote int     // the note that plays RefFreq
+	RefFreq float64 // in Hz
+	Period  int     // scale degree treated as the formal octave
+	Mapping []int   // scale degree for each key in the pattern, -1 leaves a key unmapped
+}
+
+func LoadScale(path string) (*Scale, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseScale(f)
+}
+
+func ParseScale(r io.Reader) (*Scale, error) {
+	lines, err := scalaLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) < 1 {
+		return nil, fmt.Errorf("scl: missing description")
+	}
+	// the description is allowed to be blank, nothing else is
+	s := &Scale{Description: strings.TrimSpace(lines[0])}
+	lines = append(lines[:1], nonBlank(lines[1:])...)
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("scl: missing note count")
+	}
+
+	count, err := strconv.Atoi(firstField(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("scl: bad note count %q", lines[1])
+	}
+	if len(lines)-2 < count {
+		return nil, fmt.Errorf("scl: expected %d notes, got %d", count, len(lines)-2)
+	}
+
+	for _, line := range lines[2 : 2+count] {
+		cents, err := parsePitch(firstField(line))
+		if err != nil {
+			return nil, err
+		}
+		s.Cents = append(s.Cents, cents)
+	}
+	if len(s.Cents) == 0 {
+		return nil, fmt.Errorf("scl: scale has no notes")
+	}
+	return s, nil
+}
+
+func LoadKeyboardMap(path string) (*KeyboardMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseKeyboardMap(f)
+}
+
+func ParseKeyboardMap(r io.Reader) (*KeyboardMap, error) {
+	lines, err := scalaLines(r)
+	if err != nil {
+		return nil, err
+	}
+	lines = nonBlank(lines)
+	if len(lines) < 7 {
+		return nil, fmt.Errorf("kbm: expected 7 header lines, got %d", len(lines))
+	}
+
+	ints := make([]int, 7)
+	for i := range ints {
+		if i == 5 {
+			continue
+		}
+		if ints[i], err = strconv.Atoi(firstField(lines[i])); err != nil {
+			return nil, fmt.Errorf("kbm: bad header line %d %q", i+1, lines[i])
+		}
+	}
+	k := &KeyboardMap{
+		Size:    ints[0],
+		First:   ints[1],
+		Last:    ints[2],
+		Middle:  ints[3],
+		RefNote: ints[4],
+		Period:  ints[6],
+	}
+	if k.RefFreq, err = strconv.ParseFloat(firstField(lines[5]), 64); err != nil {
+		return nil, fmt.Errorf("kbm: bad reference frequency %q", lines[5])
+	}
+
+	// the spec allows the mapping to be shorter than the size,
+	// the missing keys are unmapped
+	for i := 0; i < k.Size; i++ {
+		degree := -1
+		if 7+i < len(lines) {
+			field := firstField(lines[7+i])
+			if field != "x" {
+				if degree, err = strconv.Atoi(field); err != nil {
+					return nil, fmt.Errorf("kbm: bad mapping entry %q", lines[7+i])
+				}
+			}
+		}
+		k.Mapping = append(k.Mapping, degree)
+	}
+	return k, nil
+}
+
+// a pitch with a period in it is cents, anything else is a ratio like 3/2 or just 2
+func parsePitch(field string) (float64, error) {
+	if strings.Contains(field, ".") {
+		c, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, fmt.Errorf("scl: bad cents value %q", field)
+		}
+		return c, nil
+	}
+
+	num, den := field, "1"
+	if i := strings.Index(field, "/"); i >= 0 {
+		num, den = field[:i], field[i+1:]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("scl: bad ratio %q", field)
+	}
+	d, err := strconv.ParseInt(den, 10, 64)
+	if err != nil || d == 0 || n <= 0 {
+		return 0, fmt.Errorf("scl: bad ratio %q", field)
+	}
+	return 1200.0 * math.Log2(float64(n)/float64(d)), nil
+}
+
+func scalaLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func nonBlank(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func firstField(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,116 @@
+package tuning
+
+import (
+	"math"
+
+	"github.com/ianmcmahon/fmsynth/fp"
+)
+
+const (
+	A4      = 69
+	A4_FREQ = 440.0
+)
+
+// a Tuning is a table of frequencies for the 128 midi notes
+// pitches are stored as fp32 Hz so the voices can use them directly.
+// A tuning doesn't change once it's built, retuning makes a new one
+type Tuning struct {
+	pitches [128]fp.Fp32
+}
+
+// Equal returns 12 tone equal temperament with A4 at refFreq
+func Equal(refFreq float64) *Tuning {
+	t := &Tuning{}
+	for n := range t.pitches {
+		t.setFreq(n, refFreq*math.Pow(2, float64(n-A4)/12.0))
+	}
+	return t
+}
+
+// New builds a tuning from a scale and keyboard mapping
+// a nil mapping maps the scale linearly across the keyboard with degree 0 on middle C
+// and A4 at the reference frequency.  If refFreq is non-zero it overrides the mapping's
+// reference frequency, so the whole tuning can be shifted with a global A4 setting
+func New(scale *Scale, kbm *KeyboardMap, refFreq float64) *Tuning {
+	if kbm == nil {
+		kbm = &KeyboardMap{
+			First:   0,
+			Last:    127,
+			Middle:  60,
+			RefNote: A4,
+			RefFreq: A4_FREQ,
+			Period:  len(scale.Cents),
+		}
+	}
+	if refFreq <= 0 {
+		refFreq = kbm.RefFreq
+	}
+
+	t := &Tuning{}
+	refCents, ok := noteCents(scale, kbm, kbm.RefNote)
+	if !ok {
+		// the reference note isn't mapped to anything, fall back to
+		// pretending degree 0 of the scale is the reference
+		refCents = 0
+	}
+	for n := range t.pitches {
+		cents, ok := noteCents(scale, kbm, n)
+		if !ok || n < kbm.First || n > kbm.Last {
+			t.setFreq(n, 0)
+			continue
+		}
+		t.setFreq(n, refFreq*math.Pow(2, (cents-refCents)/1200.0))
+	}
+	return t
+}
+
+// the distance in cents from the mapping's middle note to note
+// returns false if the key is unmapped
+func noteCents(scale *Scale, kbm *KeyboardMap, note int) (float64, bool) {
+	offset := note - kbm.Middle
+	degree := offset
+	if kbm.Size > 0 {
+		octave := floorDiv(offset, kbm.Size)
+		key := offset - octave*kbm.Size
+		mapped := kbm.Mapping[key]
+		if mapped < 0 {
+			return 0, false
+		}
+		degree = octave*kbm.Period + mapped
+	}
+
+	size := len(scale.Cents)
+	period := scale.Cents[size-1]
+	octave := floorDiv(degree, size)
+	step := degree - octave*size
+
+	cents := float64(octave) * period
+	if step > 0 {
+		cents += scale.Cents[step-1]
+	}
+	return cents, true
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// Pitch returns the frequency of a note, zero means the note is unmapped
+func (t *Tuning) Pitch(note byte) fp.Fp32 {
+	if note > 127 {
+		return 0
+	}
+	return t.pitches[note]
+}
+
+func (t *Tuning) Freq(note byte) float64 {
+	return float64(t.Pitch(note)) / float64(1<<16)
+}
+
+func (t *Tuning) setFreq(note int, freq float64) {
+	t.pitches[note] = fp.Float2Fp32(freq)
+}
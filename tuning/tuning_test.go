@@ -0,0 +1,136 @@
+package tuning
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const justScl = `! just.scl
+!
+5-limit just intonation
+ 12
+!
+ 16/15
+ 9/8
+ 6/5
+ 5/4
+ 4/3
+ 45/32
+ 3/2
+ 8/5
+ 5/3
+ 9/5
+ 15/8
+ 2/1
+`
+
+const pentatonicKbm = `! maps a 5 note scale onto the white keys
+5
+0
+127
+60
+69
+432.0
+5
+! mapping
+0
+1
+x
+2
+3
+`
+
+func TestEqualTemperament(t *testing.T) {
+	et := Equal(A4_FREQ)
+	expectFreq(t, et.Freq(69), 440.0)
+	expectFreq(t, et.Freq(81), 880.0)
+	expectFreq(t, et.Freq(60), 261.6256)
+}
+
+func TestParseScale(t *testing.T) {
+	s, err := ParseScale(strings.NewReader(justScl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Description != "5-limit just intonation" {
+		t.Errorf("description: %q", s.Description)
+	}
+	if len(s.Cents) != 12 {
+		t.Fatalf("expected 12 degrees, got %d", len(s.Cents))
+	}
+	expectFreq(t, s.Cents[6], 701.955)
+	expectFreq(t, s.Cents[11], 1200.0)
+
+	cents, err := ParseScale(strings.NewReader("12tet\n12\n100.0\n200.\n300.0\n400.0\n500.0\n600.0\n700.0\n800.0\n900.0\n1000.0\n1100.0\n1200.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := New(cents, nil, A4_FREQ)
+	et := Equal(A4_FREQ)
+	for n := byte(0); n < 128; n++ {
+		expectFreq(t, tun.Freq(n), et.Freq(n))
+	}
+}
+
+func TestScaleWithMapping(t *testing.T) {
+	s, err := ParseScale(strings.NewReader(justScl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := New(s, nil, A4_FREQ)
+	expectFreq(t, tun.Freq(69), 440.0)
+	// C is a just major sixth below A
+	expectFreq(t, tun.Freq(60), 440.0*3.0/5.0)
+	expectFreq(t, tun.Freq(67), 440.0*3.0/5.0*3.0/2.0)
+
+	kbm, err := ParseKeyboardMap(strings.NewReader(pentatonicKbm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kbm.Mapping) != 5 || kbm.Mapping[2] != -1 {
+		t.Fatalf("bad mapping %v", kbm.Mapping)
+	}
+	pent, err := ParseScale(strings.NewReader("pentatonic\n5\n9/8\n5/4\n3/2\n5/3\n2/1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun = New(pent, kbm, 0)
+	// note 69 is 9 keys above middle C, one pattern up and then key 4, which is degree 3 (3/2) of the second period
+	expectFreq(t, tun.Freq(69), 432.0)
+	if tun.Freq(62) != 0 {
+		t.Errorf("expected unmapped key to have no pitch, got %f", tun.Freq(62))
+	}
+	expectFreq(t, tun.Freq(60), 432.0/(2.0*3.0/2.0))
+
+	// a global reference overrides the one in the mapping
+	tun = New(pent, kbm, 440.0)
+	expectFreq(t, tun.Freq(69), 440.0)
+}
+
+func TestSingleNoteTuningChange(t *testing.T) {
+	tun := Equal(A4_FREQ)
+	// retune A4 up a quarter tone, and leave B4 alone with 7F 7F 7F
+	msg := []byte{0xF0, 0x7F, 0x00, 0x08, 0x02, 0x00, 0x02,
+		69, 69, 0x40, 0x00,
+		71, 0x7F, 0x7F, 0x7F,
+		0xF7}
+	retuned, ok := tun.Retune(msg)
+	if !ok {
+		t.Fatal("single note tuning change not applied")
+	}
+	expectFreq(t, retuned.Freq(69), 440.0*math.Pow(2, 0.5/12.0))
+	expectFreq(t, retuned.Freq(71), Equal(A4_FREQ).Freq(71))
+	expectFreq(t, tun.Freq(69), 440.0)
+
+	if _, ok := tun.Retune([]byte{0xF0, 0x7E, 0x00, 0x06, 0x01, 0xF7}); ok {
+		t.Error("identity request shouldn't be treated as tuning")
+	}
+}
+
+func expectFreq(t *testing.T, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > want*0.0001+0.001 {
+		t.Errorf("expected %f, got %f", want, got)
+	}
+}
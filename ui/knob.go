@@ -33,6 +33,13 @@ func (k *knob) NeedsUpdate(id patch.ParamId) image.Rectangle {
 	return image.ZR
 }
 
+func (k *knob) ParamAt(pt image.Point) patch.Param {
+	if pt.In(k.Bounds()) {
+		return k.param
+	}
+	return nil
+}
+
 func (k *knob) paint(bounds image.Rectangle) {
 	if bounds == image.ZR {
 		return
@@ -59,6 +66,14 @@ func (k *knob) paint(bounds image.Rectangle) {
 	gc.FillStringAt(k.param.Label(), float64(center.X)-(r-l)/2.0, float64(k.Bounds().Max.Y-10))
 	gc.StrokeStringAt(k.param.Label(), float64(center.X)-(r-l)/2.0, float64(k.Bounds().Max.Y-10))
 
+	value := k.param.Format()
+	if id, ok := engine.CurrentPatch().Learning(); ok && id == k.param.ID() {
+		value = "LEARN"
+	}
+	gc.SetFontSize(11)
+	l, _, r, _ = gc.GetStringBounds(value)
+	gc.FillStringAt(value, float64(center.X)-(r-l)/2.0, float64(center.X)+5)
+
 	gc.SetStrokeColor(FUSCHIA)
 	gc.SetLineWidth(6)
 	gc.SetLineCap(draw2d.RoundCap)
@@ -23,6 +23,8 @@ type placement struct {
 type layout struct {
 	Pane
 	visible bool
+	page    *paramPage
+	pageAt  image.Point
 }
 
 func SampleLayout(bounds image.Rectangle) *layout {
@@ -38,21 +40,26 @@ func SampleLayout(bounds image.Rectangle) *layout {
 
 	layout := &layout{Pane: BackgroundPane(bounds, backgroundImg)}
 
+	layout.page = ParamPage(image.Rect(0, 0, 400, 240), pageParams(pages.Page()))
+	layout.pageAt = image.Pt(20, 20)
+	layout.AddChild(layout.page, layout.pageAt)
+
+	return layout
+}
+
+func pageParams(n int) []patch.Param {
 	ptch := engine.CurrentPatch()
-	params := []patch.Param{
-		ptch.GetParam(patch.PATCH_ALGORITHM),
-		ptch.GetParam(patch.OPR_RATIO | patch.GRP_A),
-		ptch.GetParam(patch.OPR_RATIO | patch.GRP_B1),
-		ptch.GetParam(patch.OPR_RATIO | patch.GRP_C),
-		ptch.GetParam(patch.ENV_ATTACK | patch.GRP_VCA),
-		ptch.GetParam(patch.ENV_DECAY | patch.GRP_VCA),
-		ptch.GetParam(patch.ENV_SUSTAIN | patch.GRP_VCA),
-		ptch.GetParam(patch.ENV_RELEASE | patch.GRP_VCA),
+	params := make([]patch.Param, 0, len(patch.Pages[n].Params))
+	for _, id := range patch.Pages[n].Params {
+		params = append(params, ptch.GetParam(id))
 	}
-	paramPage := ParamPage(image.Rect(0, 0, 400, 240), params)
-	layout.AddChild(paramPage, image.Pt(20, 20))
+	return params
+}
 
-	return layout
+// switches the param page to page n, returning the area to repaint
+func (l *layout) showPage(n int) image.Rectangle {
+	l.page.SetParams(pageParams(n))
+	return l.page.Bounds().Add(l.pageAt)
 }
 
 /*
@@ -13,6 +13,7 @@ type Pane interface {
 	paint(image.Rectangle)
 	AddChild(c Pane, at image.Point)
 	NeedsUpdate(id patch.ParamId) image.Rectangle
+	ParamAt(pt image.Point) patch.Param
 }
 
 type child struct {
@@ -46,6 +47,18 @@ func (p *pane) NeedsUpdate(id patch.ParamId) image.Rectangle {
 	return rect
 }
 
+// finds the param control under a point, in this pane's coordinates
+func (p *pane) ParamAt(pt image.Point) patch.Param {
+	for _, child := range p.children {
+		if pt.In(child.bounds) {
+			if prm := child.ParamAt(pt.Sub(child.bounds.Min)); prm != nil {
+				return prm
+			}
+		}
+	}
+	return nil
+}
+
 func (parent *pane) UpdateChildren(rect image.Rectangle) {
 	for _, child := range parent.children {
 		// parentRect is the area of the parent image that overlaps this child
@@ -9,22 +9,35 @@ import (
 type paramPage struct {
 	Pane
 	params []patch.Param
+	knobs  []*knob
 }
 
 func ParamPage(bounds image.Rectangle, params []patch.Param) *paramPage {
 	page := &paramPage{
-		RoundedRectPane(bounds),
-		params,
+		Pane:   RoundedRectPane(bounds),
+		params: params,
 	}
 
 	for i, p := range params {
 		childBounds := page.controlBounds(i)
-		page.AddChild(Knob(childBounds, p), childBounds.Min)
+		k := Knob(childBounds, p)
+		page.knobs = append(page.knobs, k)
+		page.AddChild(k, childBounds.Min)
 	}
 
 	return page
 }
 
+// points the knobs at another page of params, the caller repaints
+func (p *paramPage) SetParams(params []patch.Param) {
+	p.params = params
+	for i, k := range p.knobs {
+		if i < len(params) {
+			k.param = params[i]
+		}
+	}
+}
+
 func (p *paramPage) controlSize() image.Rectangle {
 	return image.Rect(0, 0, p.Bounds().Dx()/4, p.Bounds().Dy()/2)
 }
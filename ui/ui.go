@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/patch"
 	"github.com/llgcode/draw2d"
 	wde "github.com/skelterjohn/go.wde"
 )
@@ -35,10 +36,12 @@ const (
 )
 
 // temporary
-var engine *audio.Engine
+var (
+	engine *audio.Engine
+	pages  *patch.PageSelector
+)
 
-func Start(eng *audio.Engine) {
-	engine = eng
+func Start(eng *audio.Engine, pageSelector *patch.PageSelector) {
 	//// osx specific
 	window, err := wde.NewWindow(SCREEN_WIDTH, SCREEN_HEIGHT)
 	if err != nil {
@@ -48,6 +51,35 @@ func Start(eng *audio.Engine) {
 	window.LockSize(true)
 	/////
 
+	screen, layout := newScreen(eng, pageSelector)
+	show := func() {
+		// this copies the whole screenbuffer
+		// may be able to do it more efficiently on hardware
+		window.Screen().CopyRGBA(screen.Image.(*image.RGBA), screen.Bounds())
+		window.FlushImage()
+	}
+	show()
+	window.Show()
+
+	run(screen, layout, window.EventChan(), show)
+}
+
+// Offscreen runs the UI without a window, for machines that don't have one, calling
+// show with the screen each time it's repainted.  The image is only valid during the call
+func Offscreen(eng *audio.Engine, pageSelector *patch.PageSelector, show func(*image.RGBA)) {
+	screen, layout := newScreen(eng, pageSelector)
+	flush := func() {
+		show(screen.Image.(*image.RGBA))
+	}
+	flush()
+
+	run(screen, layout, nil, flush)
+}
+
+func newScreen(eng *audio.Engine, pageSelector *patch.PageSelector) (*pane, *layout) {
+	engine = eng
+	pages = pageSelector
+
 	draw2d.SetFontCache(draw2d.NewFolderFontCache("ui/fonts"))
 
 	screenBounds := image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT)
@@ -56,33 +88,61 @@ func Start(eng *audio.Engine) {
 	screen.AddChild(layout, image.ZP)
 
 	screen.paint(screen.Bounds())
+	return screen, layout
+}
 
-	window.Screen().CopyRGBA(screen.Image.(*image.RGBA), screen.Bounds())
-	window.FlushImage()
-	window.Show()
-
+// everything that touches the panes happens on this goroutine,
+// updates are collected and painted at most every 20ms
+func run(screen *pane, layout *layout, events <-chan interface{}, show func()) {
 	updateRect := image.ZR
-	go func() {
-		for id := range engine.CurrentPatch().UpdateChannel() {
-			// ask our children if anyone is interested in this param
-			rect := screen.NeedsUpdate(id)
-			updateRect = updateRect.Union(rect)
-		}
-	}()
+	updates := engine.CurrentPatch().Subscribe()
+	defer updates.Unsubscribe()
+	pageChanges := pages.Changes()
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
 
 	for {
-		time.Sleep(20 * time.Millisecond)
-		if updateRect == image.ZR {
-			continue
+		select {
+		case id := <-updates.C:
+			// ask our children if anyone is interested in this param
+			updateRect = updateRect.Union(screen.NeedsUpdate(id))
+		case n := <-pageChanges:
+			updateRect = updateRect.Union(layout.showPage(n))
+		case ev := <-events:
+			if !handleEvent(ev, screen) {
+				return
+			}
+		case <-tick.C:
+			if updateRect == image.ZR {
+				continue
+			}
+			screen.paint(updateRect)
+			updateRect = image.ZR
+			show()
 		}
-		screen.paint(updateRect)
-		updateRect = image.ZR
+	}
+}
 
-		// this copies the whole screenbuffer
-		// may be able to do it more efficiently on hardware
-		window.Screen().CopyRGBA(screen.Image.(*image.RGBA), screen.Bounds())
-		window.FlushImage()
+// clicking a param control arms it for midi learn, clicking it again cancels
+// returns false once the window has closed
+func handleEvent(ev interface{}, screen Pane) bool {
+	switch ev := ev.(type) {
+	case wde.MouseDownEvent:
+		prm := screen.ParamAt(ev.Where)
+		if prm == nil {
+			return true
+		}
+		p := engine.CurrentPatch()
+		if id, ok := p.Learning(); ok && id == prm.ID() {
+			p.CancelLearn()
+		} else {
+			p.Learn(prm.ID())
+		}
+	case wde.CloseEvent:
+		wde.Stop()
+		return false
 	}
+	return true
 }
 
 /*
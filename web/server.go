@@ -0,0 +1,375 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+/*
+	An HTTP server for browser based editors.  Everything is json.
+
+	  GET  /params         every param, with its value and range, see Param
+	  GET  /patch          every param's value by path, the same as a patch file
+	  PUT  /patch          sets the params given by path, {"/patch/mix": 0.5, ...}
+	  GET  /patch/...      one param, paths are from patch/paths.go
+	  PUT  /patch/...      sets it, {"value": 250} in the param's own units
+	  POST /patch/load     loads a patch from the patch directory, {"name": "bass"}
+	  POST /patch/save     saves the patch there, as bass.json
+	  GET  /patch/learn    the param armed for midi learn, {"path": ...}, "" if there isn't one
+	  POST /patch/learn    arms a param, {"path": "/patch/env/vca/attack"}, the next
+	                       controller to move is mapped to it
+	  DELETE /patch/learn  disarms it
+	  POST /note/on        {"note": 60, "velocity": 100, "channel": 1}, channel defaults to 1
+	  POST /note/off       {"note": 60, "channel": 1}
+	  GET  /meters         the engine's levels, see audio.Meters
+	  GET  /ws             a websocket of updates, see Update
+
+	Params are set the same way midi sets them, so the UI and midi out follow along,
+	and notes go in with the midi.
+
+	There's no authentication, so it's best to listen on localhost.  Even then any web page
+	open in a browser on the same machine can send it requests, so requests that change
+	anything and the websocket must come from a page served from the same host if they
+	come from a browser at all, and POSTs and PUTs must be json.  A page elsewhere can't
+	send json without a CORS preflight, which this server doesn't answer.  Patch names are
+	bare names confined to the patch directory.
+*/
+
+// how often meters are sent down a websocket
+const meterInterval = 50 * time.Millisecond
+
+type Server struct {
+	engine *audio.Engine
+	patch  *patch.Patch
+	dir    string // where patches are loaded and saved
+	events chan<- portmidi.Event
+	mux    *http.ServeMux
+}
+
+// Param describes a param and its current value
+type Param struct {
+	Path    string  `json:"path"`
+	Label   string  `json:"label"`
+	Value   float64 `json:"value"`
+	Text    string  `json:"text"` // the value as the UI shows it
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Default float64 `json:"default"`
+	Step    float64 `json:"step,omitempty"`
+	Unit    string  `json:"unit,omitempty"`
+}
+
+// Update is a websocket message, a param that's changed or the meters
+type Update struct {
+	Type   string        `json:"type"` // "param" or "meters"
+	Param  *Param        `json:"param,omitempty"`
+	Meters *audio.Meters `json:"meters,omitempty"`
+}
+
+// NewServer serves the engine's current patch, sending notes to events and keeping
+// patches in dir
+func NewServer(engine *audio.Engine, dir string, events chan<- portmidi.Event) *Server {
+	s := &Server{
+		engine: engine,
+		patch:  engine.CurrentPatch(),
+		dir:    dir,
+		events: events,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/params", s.handleParams)
+	s.mux.HandleFunc("/patch", s.handlePatch)
+	s.mux.HandleFunc("/patch/", s.handleParam)
+	s.mux.HandleFunc("/note/", s.handleNote)
+	s.mux.HandleFunc("/meters", s.handleMeters)
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the websocket checks for itself when it upgrades
+	changes := r.Method != http.MethodGet && r.Method != http.MethodHead
+	if changes && !sameOrigin(r) {
+		http.Error(w, "cross origin requests aren't allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// browsers say where a request came from, other clients usually don't and are let through
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && strings.EqualFold(u.Host, r.Host)
+}
+
+func describe(prm patch.Param) *Param {
+	meta := prm.Meta()
+	return &Param{
+		Path:    prm.ID().Path(),
+		Label:   prm.Label(),
+		Value:   patch.Float(prm),
+		Text:    prm.Format(),
+		Min:     meta.Min(),
+		Max:     meta.Max(),
+		Default: meta.Default(),
+		Step:    meta.Step(),
+		Unit:    meta.Unit().String(),
+	}
+}
+
+func (s *Server) handleParams(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	params := make([]*Param, 0)
+	for _, prm := range s.patch.Params() {
+		params = append(params, describe(prm))
+	}
+	reply(w, params)
+}
+
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var values map[string]float64
+		if !decode(w, r, &values) {
+			return
+		}
+		if err := s.patch.SetValues(values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reply(w, s.patch.Values())
+}
+
+func (s *Server) handleParam(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/patch/load", "/patch/save":
+		s.handleFile(w, r)
+		return
+	case "/patch/learn":
+		s.handleLearn(w, r)
+		return
+	}
+
+	prm, ok := s.patch.ParamByPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body struct {
+			Value *float64 `json:"value"`
+		}
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Value == nil {
+			http.Error(w, "needs a value", http.StatusBadRequest)
+			return
+		}
+		patch.SetFloat(prm, *body.Value)
+	}
+	reply(w, describe(prm))
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	var err error
+	if r.URL.Path == "/patch/load" {
+		err = s.patch.LoadNamed(s.dir, body.Name)
+	} else {
+		err = s.patch.SaveNamed(s.dir, body.Name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleLearn(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var body struct {
+			Path string `json:"path"`
+		}
+		if !decode(w, r, &body) {
+			return
+		}
+		prm, ok := s.patch.ParamByPath(body.Path)
+		if !ok {
+			http.Error(w, "no such param", http.StatusBadRequest)
+			return
+		}
+		s.patch.Learn(prm.ID())
+	case http.MethodDelete:
+		s.patch.CancelLearn()
+	}
+
+	var armed struct {
+		Path string `json:"path"`
+	}
+	if id, ok := s.patch.Learning(); ok {
+		armed.Path = id.Path()
+	}
+	reply(w, armed)
+}
+
+func (s *Server) handleNote(w http.ResponseWriter, r *http.Request) {
+	var status byte
+	switch r.URL.Path {
+	case "/note/on":
+		status = 0x90
+	case "/note/off":
+		status = 0x80
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	body := struct {
+		Note     int `json:"note"`
+		Velocity int `json:"velocity"`
+		Channel  int `json:"channel"`
+	}{Channel: 1}
+	if !decode(w, r, &body) {
+		return
+	}
+	if status == 0x80 {
+		body.Velocity = 0
+	}
+	if body.Note < 0 || body.Note > 127 || body.Velocity < 0 || body.Velocity > 127 || body.Channel < 1 || body.Channel > 16 {
+		http.Error(w, "out of range", http.StatusBadRequest)
+		return
+	}
+
+	s.events <- portmidi.Event{
+		Timestamp: portmidi.Time(),
+		Status:    int64(status | byte(body.Channel-1)),
+		Data1:     int64(body.Note),
+		Data2:     int64(body.Velocity),
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleMeters(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	reply(w, s.engine.Meters())
+}
+
+// streams param changes and meters until the client goes away
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrade(w, r)
+	if err != nil {
+		fmt.Printf("web: %v\n", err)
+		return
+	}
+	defer ws.Close()
+
+	// each client gets its own subscription, UpdateChannel's is the UI's
+	sub := s.patch.Subscribe()
+	defer sub.Unsubscribe()
+
+	gone := make(chan struct{})
+	go func() {
+		ws.readLoop()
+		close(gone)
+	}()
+
+	meters := time.NewTicker(meterInterval)
+	defer meters.Stop()
+
+	for {
+		var u Update
+		select {
+		case id := <-sub.C:
+			prm := s.patch.GetParam(id)
+			if prm == nil {
+				continue
+			}
+			u = Update{Type: "param", Param: describe(prm)}
+		case <-meters.C:
+			m := s.engine.Meters()
+			u = Update{Type: "meters", Meters: &m}
+		case <-gone:
+			return
+		}
+
+		b, err := json.Marshal(u)
+		if err != nil {
+			fmt.Printf("web: %v\n", err)
+			continue
+		}
+		if err := ws.WriteText(b); err != nil {
+			return
+		}
+	}
+}
+
+// answers 405 for methods other than those given
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("web: %v\n", err)
+	}
+}
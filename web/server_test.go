@@ -0,0 +1,281 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ianmcmahon/fmsynth/audio"
+	"github.com/ianmcmahon/fmsynth/patch"
+	"github.com/rakyll/portmidi"
+)
+
+// the patch directory is "patches" in the server's temporary directory
+func newTestServer(t *testing.T) (*httptest.Server, *audio.Engine, chan portmidi.Event, string) {
+	engine := audio.NewOfflineEngine()
+	events := make(chan portmidi.Event, 10)
+	dir := t.TempDir()
+	ts := httptest.NewServer(NewServer(engine, filepath.Join(dir, "patches"), events))
+	t.Cleanup(ts.Close)
+	return ts, engine, events, dir
+}
+
+// a request from a script, a body is sent as json
+func do(t *testing.T, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return send(t, req, v)
+}
+
+func send(t *testing.T, req *http.Request, v interface{}) int {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestParams(t *testing.T) {
+	ts, engine, _, _ := newTestServer(t)
+	p := engine.CurrentPatch()
+
+	var params []Param
+	if code := do(t, "GET", ts.URL+"/params", "", &params); code != http.StatusOK {
+		t.Fatalf("listing params: %d", code)
+	}
+	if len(params) != len(p.Params()) {
+		t.Errorf("listed %d params of %d", len(params), len(p.Params()))
+	}
+
+	var prm Param
+	code := do(t, "PUT", ts.URL+"/patch/env/vca/attack", `{"value": 250}`, &prm)
+	if code != http.StatusOK || prm.Value != 250 || prm.Unit != "ms" {
+		t.Errorf("setting attack: %d %+v", code, prm)
+	}
+	if got := p.Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA).Uint16(); got != 250 {
+		t.Errorf("attack is %d", got)
+	}
+	if code := do(t, "PUT", ts.URL+"/patch/env/vca/attack", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("setting without a value: %d", code)
+	}
+	if code := do(t, "GET", ts.URL+"/patch/nothing", "", nil); code != http.StatusNotFound {
+		t.Errorf("an unknown param: %d", code)
+	}
+	if code := do(t, "DELETE", ts.URL+"/patch/mix", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("deleting a param: %d", code)
+	}
+
+	var values map[string]float64
+	if code := do(t, "PUT", ts.URL+"/patch", `{"/patch/env/vca/release": 1000}`, &values); code != http.StatusOK {
+		t.Fatalf("setting the patch: %d", code)
+	}
+	if values["/patch/env/vca/release"] != 1000 || values["/patch/env/vca/attack"] != 250 {
+		t.Errorf("patch is %v", values)
+	}
+}
+
+func TestPatchFiles(t *testing.T) {
+	ts, engine, _, dir := newTestServer(t)
+	p := engine.CurrentPatch()
+
+	attack := p.Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA)
+	attack.Set(300)
+	if code := do(t, "POST", ts.URL+"/patch/save", `{"name": "bass"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("saving: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "patches", "bass.json")); err != nil {
+		t.Errorf("saved patch: %v", err)
+	}
+	attack.Set(10)
+	if code := do(t, "POST", ts.URL+"/patch/load", `{"name": "bass"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("loading: %d", code)
+	}
+	if attack.Uint16() != 300 {
+		t.Errorf("loaded attack is %d", attack.Uint16())
+	}
+	if code := do(t, "POST", ts.URL+"/patch/load", `{"name": "nothing"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("loading a missing patch: %d", code)
+	}
+
+	// names can't reach outside the patch directory
+	for _, name := range []string{"../escaped", "/tmp/escaped", ""} {
+		if code := do(t, "POST", ts.URL+"/patch/save", fmt.Sprintf(`{"name": %q}`, name), nil); code != http.StatusBadRequest {
+			t.Errorf("saving as %q: %d", name, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.json")); err == nil {
+		t.Errorf("saved outside the patch directory")
+	}
+}
+
+func TestLearn(t *testing.T) {
+	ts, engine, _, _ := newTestServer(t)
+	p := engine.CurrentPatch()
+	attack := patch.ENV_ATTACK | patch.GRP_VCA
+
+	var armed struct {
+		Path string `json:"path"`
+	}
+	if code := do(t, "POST", ts.URL+"/patch/learn", `{"path": "/patch/env/vca/attack"}`, &armed); code != http.StatusOK {
+		t.Fatalf("arming: %d", code)
+	}
+	if id, ok := p.Learning(); !ok || id != attack || armed.Path != "/patch/env/vca/attack" {
+		t.Errorf("learning %x %v, replied %q", id, ok, armed.Path)
+	}
+	if code := do(t, "DELETE", ts.URL+"/patch/learn", "", &armed); code != http.StatusOK || armed.Path != "" {
+		t.Errorf("disarming: %d, still armed %q", code, armed.Path)
+	}
+	if _, ok := p.Learning(); ok {
+		t.Errorf("still learning after disarming")
+	}
+	if code := do(t, "POST", ts.URL+"/patch/learn", `{"path": "/patch/nothing"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("arming an unknown param: %d", code)
+	}
+
+	// the next controller to move is mapped to it
+	do(t, "POST", ts.URL+"/patch/learn", `{"path": "/patch/env/vca/attack"}`, nil)
+	p.HandleChannelCC(0, 0x40, 64)
+	if id, ok := p.MappedParam(0, 0x40); !ok || id != attack {
+		t.Errorf("the controller mapped to %x %v, want attack", id, ok)
+	}
+	if code := do(t, "GET", ts.URL+"/patch/learn", "", &armed); code != http.StatusOK || armed.Path != "" {
+		t.Errorf("after learning: %d, still armed %q", code, armed.Path)
+	}
+}
+
+func TestCrossSiteRequests(t *testing.T) {
+	ts, engine, _, dir := newTestServer(t)
+	attack := engine.CurrentPatch().Uint16Param(patch.ENV_ATTACK | patch.GRP_VCA)
+	attack.Set(300)
+
+	// a form or fetch from another page can send text/plain without a preflight
+	req, _ := http.NewRequest("POST", ts.URL+"/patch/save", strings.NewReader(`{"name": "bass"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	if code := send(t, req, nil); code != http.StatusUnsupportedMediaType {
+		t.Errorf("a text/plain save: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "patches", "bass.json")); err == nil {
+		t.Errorf("a text/plain save saved")
+	}
+
+	put := func(origin string) int {
+		req, _ := http.NewRequest("PUT", ts.URL+"/patch/env/vca/attack", strings.NewReader(`{"value": 20}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", origin)
+		return send(t, req, nil)
+	}
+	if code := put("http://evil.example"); code != http.StatusForbidden || attack.Uint16() != 300 {
+		t.Errorf("a change from another site: %d, attack %d", code, attack.Uint16())
+	}
+	if code := put(ts.URL); code != http.StatusOK || attack.Uint16() != 20 {
+		t.Errorf("a change from our own page: %d, attack %d", code, attack.Uint16())
+	}
+
+	// reading is fine from anywhere, the browser won't show another site the answer
+	req, _ = http.NewRequest("GET", ts.URL+"/params", nil)
+	req.Header.Set("Origin", "http://evil.example")
+	if code := send(t, req, nil); code != http.StatusOK {
+		t.Errorf("reading params: %d", code)
+	}
+
+	// websockets aren't covered by the browser's same origin rules at all
+	req, _ = http.NewRequest("GET", ts.URL+"/ws", nil)
+	for k, v := range map[string]string{
+		"Connection": "Upgrade", "Upgrade": "websocket", "Origin": "http://evil.example",
+		"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version": "13",
+	} {
+		req.Header.Set(k, v)
+	}
+	if code := send(t, req, nil); code != http.StatusForbidden {
+		t.Errorf("a websocket from another site: %d", code)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	ts, _, events, _ := newTestServer(t)
+
+	if code := do(t, "POST", ts.URL+"/note/on", `{"note": 60, "velocity": 100, "channel": 3}`, nil); code != http.StatusNoContent {
+		t.Fatalf("note on: %d", code)
+	}
+	if ev := <-events; ev.Status != 0x92 || ev.Data1 != 60 || ev.Data2 != 100 {
+		t.Errorf("note on is %+v", ev)
+	}
+	if code := do(t, "POST", ts.URL+"/note/off", `{"note": 60}`, nil); code != http.StatusNoContent {
+		t.Fatalf("note off: %d", code)
+	}
+	if ev := <-events; ev.Status != 0x80 || ev.Data1 != 60 {
+		t.Errorf("note off is %+v", ev)
+	}
+	if code := do(t, "POST", ts.URL+"/note/on", `{"note": 200, "velocity": 100}`, nil); code != http.StatusBadRequest {
+		t.Errorf("a note out of range: %d", code)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	ts, engine, _, _ := newTestServer(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s %v", resp.Status, resp.Header)
+	}
+	ws := &wsConn{conn: conn, rw: bufio.NewReadWriter(r, bufio.NewWriter(conn))}
+
+	// let the server subscribe before changing anything
+	var u Update
+	next := func() {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != opText {
+			t.Fatalf("frame type %d", op)
+		}
+		if err := json.Unmarshal(payload, &u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next()
+	if u.Type != "meters" || u.Meters == nil {
+		t.Fatalf("first update is %+v", u)
+	}
+
+	engine.CurrentPatch().Uint16Param(patch.ENV_DECAY | patch.GRP_VCA).Set(400)
+	for next(); u.Type != "param"; next() {
+	}
+	if u.Param.Path != "/patch/env/vca/decay" || u.Param.Value != 400 {
+		t.Errorf("param update is %+v", u.Param)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	_ "github.com/skelterjohn/go.wde/cocoa"
+)
+
+// the ui has a window backend here, elsewhere we always run headless
+const haveWindows = true
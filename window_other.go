@@ -0,0 +1,6 @@
+//go:build !darwin
+
+package main
+
+// there's no window backend wired up for this platform yet, so we always run headless
+const haveWindows = false